@@ -1,29 +1,337 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/ajaen4/go-standard-lib-api/internal/db"
+	"github.com/ajaen4/go-standard-lib-api/pkg/content_filter"
+	"github.com/ajaen4/go-standard-lib-api/pkg/email_address"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
 	"github.com/ajaen4/go-standard-lib-api/pkg/handlers"
+	"github.com/ajaen4/go-standard-lib-api/pkg/mailer"
+	"github.com/ajaen4/go-standard-lib-api/pkg/password_policy"
 	"github.com/joho/godotenv"
 )
 
+var dbPaths = map[string]string{
+	"json":   "./database.json",
+	"sqlite": "./database.db",
+}
+
 func main() {
 	godotenv.Load()
 
-	db, err := db.NewDB("./database.json")
+	isDebug := flag.Bool("debug", false, "Enable debug mode")
+	storeDriver := flag.String("store", "json", "Storage backend: json or sqlite")
+	useJournal := flag.Bool("journal", false, "Journal JSON store writes for crash recovery")
+	flag.Parse()
+	log.Println("debug:", *isDebug)
+
+	dbPath, ok := dbPaths[*storeDriver]
+	if !ok {
+		log.Fatalf("Unknown store: %s", *storeDriver)
+	}
+	journalPath := dbPath + ".journal"
+	if *isDebug {
+		for _, path := range []string{dbPath, journalPath} {
+			err := os.Remove(path)
+			if err != nil && !os.IsNotExist(err) {
+				log.Fatalf("Error removing DB: %s", err)
+			}
+		}
+	}
+
+	storeOpts := []db.Option{db.WithPasswordHasher(passwordHasherFromEnv())}
+	if *useJournal {
+		storeOpts = append(storeOpts, db.WithJournal(journalPath))
+	}
+	store, err := db.NewStore(*storeDriver, dbPath, storeOpts...)
 	if err != nil {
 		log.Fatalf("Error initializing DB: %s", err)
 	}
+	defer store.Close()
+
+	if admins := os.Getenv("ADMIN_EMAILS"); admins != "" {
+		err = promoteAdmins(store, strings.Split(admins, ","))
+		if err != nil {
+			log.Fatalf("Error promoting admins: %s", err)
+		}
+	}
+
+	tokenConfig := encryption.NewTokenConfig(os.Getenv("JWT_SECRET"))
+	tokenConfig.DefaultTTL = durationFromEnv("JWT_TTL", tokenConfig.DefaultTTL)
+	tokenConfig.MaxTTL = durationFromEnv("JWT_MAX_TTL", tokenConfig.MaxTTL)
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		tokenConfig.Issuer = issuer
+	}
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		tokenConfig.Audience = audience
+	}
+	if keys := os.Getenv("JWT_SIGNING_KEYS"); keys != "" {
+		tokenConfig.Keys, err = loadSigningKeys(keys)
+		if err != nil {
+			log.Fatalf("Error loading JWT signing keys: %s", err)
+		}
+		// Keep accepting the HS256 tokens issued before the switch to keys
+		// until JWT_HS256_UNTIL, by default for as long as they can last.
+		// Set it when switching, or the window restarts with the server.
+		tokenConfig.HMACUntil = timeFromEnv("JWT_HS256_UNTIL", time.Now().Add(tokenConfig.MaxTTL))
+		if tokenConfig.Secret != "" && os.Getenv("JWT_HS256_UNTIL") == "" {
+			log.Printf("Accepting HS256 tokens until %s, set JWT_HS256_UNTIL to fix the cutoff",
+				tokenConfig.HMACUntil.Format(time.RFC3339))
+		}
+	}
+
+	contentFilter, err := loadContentFilter()
+	if err != nil {
+		log.Fatalf("Error loading content filter: %s", err)
+	}
+	go reloadOnHangup(contentFilter)
+
+	passwordPolicy, err := passwordPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("Error loading password policy: %s", err)
+	}
+
+	appMailer, err := mailerFromEnv()
+	if err != nil {
+		log.Fatalf("Error configuring mailer: %s", err)
+	}
 
 	apiCfg := &handlers.ApiConfig{
-		DB:        db,
-		JwtSecret: os.Getenv("JWT_SECRET"),
-		PolkaKey:  os.Getenv("POLKA_KEY"),
+		DB:                    store,
+		TokenConfig:           tokenConfig,
+		PolkaKey:              os.Getenv("POLKA_KEY"),
+		ChirpEditWindow:       durationFromEnv("CHIRP_EDIT_WINDOW", handlers.DefaultChirpEditWindow),
+		RefreshTokenTTL:       durationFromEnv("REFRESH_TOKEN_TTL", handlers.DefaultRefreshTokenTTL),
+		ContentFilter:         contentFilter,
+		PasswordPolicy:        passwordPolicy,
+		StripEmailPlusTags:    os.Getenv("EMAIL_STRIP_PLUS_TAGS") == "true",
+		Mailer:                appMailer,
+		AppURL:                strings.TrimSuffix(os.Getenv("APP_URL"), "/"),
+		VerificationTokenTTL:  durationFromEnv("VERIFICATION_TOKEN_TTL", handlers.DefaultVerificationTokenTTL),
+		PasswordResetTokenTTL: durationFromEnv("PASSWORD_RESET_TOKEN_TTL", handlers.DefaultPasswordResetTokenTTL),
+		LoginChallengeTTL:     durationFromEnv("LOGIN_CHALLENGE_TTL", handlers.DefaultLoginChallengeTTL),
+		RequireVerifiedEmail:  os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true",
+		AccountThrottle:       loginThrottleFromEnv("LOGIN_ACCOUNT", handlers.DefaultAccountThrottle),
+		IPThrottle:            loginThrottleFromEnv("LOGIN_IP", handlers.DefaultIPThrottle),
+		ResetAccountThrottle:  loginThrottleFromEnv("PASSWORD_RESET_ACCOUNT", handlers.DefaultResetAccountThrottle),
+		ResetIPThrottle:       loginThrottleFromEnv("PASSWORD_RESET_IP", handlers.DefaultResetIPThrottle),
 	}
 
 	mux := http.NewServeMux()
 	handlers.AssignHandlers(mux, apiCfg)
 }
+
+// durationFromEnv parses the environment variable name as a time.Duration,
+// returning fallback when it isn't set.
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %s", name, err)
+	}
+	return duration
+}
+
+// timeFromEnv parses the environment variable name as an RFC 3339 time,
+// returning fallback when it isn't set.
+func timeFromEnv(name string, fallback time.Time) time.Time {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %s", name, err)
+	}
+	return parsed
+}
+
+// intFromEnv parses the environment variable name as an integer, returning
+// fallback when it isn't set.
+func intFromEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number < 0 {
+		log.Fatalf("Invalid %s: %q", name, value)
+	}
+	return number
+}
+
+// boundedIntFromEnv is intFromEnv for values that must not exceed limit.
+func boundedIntFromEnv(name string, fallback int, limit int) int {
+	number := intFromEnv(name, fallback)
+	if number > limit {
+		log.Fatalf("Invalid %s: %d is over %d", name, number, limit)
+	}
+	return number
+}
+
+// loginThrottleFromEnv overrides when failed logins start being slowed down
+// and locked out with prefix_FREE_ATTEMPTS, prefix_LOCKOUT_AFTER (0 disables
+// lockouts) and prefix_LOCKOUT_DURATION, and how long until they're forgotten
+// with prefix_RESET_AFTER (0 never forgets).
+func loginThrottleFromEnv(prefix string, policy db.ThrottlePolicy) db.ThrottlePolicy {
+	policy.FreeAttempts = intFromEnv(prefix+"_FREE_ATTEMPTS", policy.FreeAttempts)
+	policy.LockoutAfter = intFromEnv(prefix+"_LOCKOUT_AFTER", policy.LockoutAfter)
+	policy.LockoutDuration = durationFromEnv(prefix+"_LOCKOUT_DURATION", policy.LockoutDuration)
+	policy.ResetAfter = durationFromEnv(prefix+"_RESET_AFTER", policy.ResetAfter)
+	return policy
+}
+
+// passwordHasherFromEnv overrides the default password hashing algorithm and
+// cost parameters with PASSWORD_HASH_ALGORITHM, BCRYPT_COST, ARGON2_TIME,
+// ARGON2_MEMORY_KIB and ARGON2_THREADS.
+func passwordHasherFromEnv() encryption.PasswordHasher {
+	hasher := encryption.DefaultPasswordHasher()
+	if algorithm := os.Getenv("PASSWORD_HASH_ALGORITHM"); algorithm != "" {
+		hasher.Algorithm = algorithm
+	}
+	hasher.BcryptCost = intFromEnv("BCRYPT_COST", hasher.BcryptCost)
+	hasher.Argon2.Time = uint32(boundedIntFromEnv("ARGON2_TIME", int(hasher.Argon2.Time), math.MaxUint32))
+	hasher.Argon2.Memory = uint32(boundedIntFromEnv("ARGON2_MEMORY_KIB", int(hasher.Argon2.Memory), math.MaxUint32))
+	hasher.Argon2.Threads = uint8(boundedIntFromEnv("ARGON2_THREADS", int(hasher.Argon2.Threads), math.MaxUint8))
+	if err := hasher.Validate(); err != nil {
+		log.Fatalf("Invalid password hashing settings: %s", err)
+	}
+	return hasher
+}
+
+// passwordPolicyFromEnv overrides the default password policy with
+// PASSWORD_MIN_LENGTH, PASSWORD_REQUIRE (e.g. "lower,upper,digit,symbol") and
+// BREACHED_PASSWORDS_FILE, a sorted Pwned Passwords SHA-1 list.
+func passwordPolicyFromEnv() (password_policy.Policy, error) {
+	policy := password_policy.DefaultPolicy()
+	policy.MinLength = intFromEnv("PASSWORD_MIN_LENGTH", policy.MinLength)
+	if classes := os.Getenv("PASSWORD_REQUIRE"); classes != "" {
+		var err error
+		policy.Require, err = password_policy.ParseClasses(classes)
+		if err != nil {
+			return password_policy.Policy{}, err
+		}
+	}
+	if path := os.Getenv("BREACHED_PASSWORDS_FILE"); path != "" {
+		var err error
+		policy.Breached, err = password_policy.OpenBreachList(path)
+		if err != nil {
+			return password_policy.Policy{}, err
+		}
+	}
+	return policy, nil
+}
+
+// mailerFromEnv sends mail through SMTP_ADDR when it's set, otherwise writes
+// it to MAIL_FILE or, when MAIL_LOG is true, the log. MAIL_FROM is the sender.
+// With none of them set it returns no mailer, and no mail is sent.
+func mailerFromEnv() (mailer.Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "Chirpy <no-reply@localhost>"
+	}
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		return mailer.NewSMTPMailer(addr, from, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	}
+	if path := os.Getenv("MAIL_FILE"); path != "" {
+		return mailer.NewFileMailer(path, from), nil
+	}
+	// Logged mail holds live tokens, so it has to be asked for.
+	if os.Getenv("MAIL_LOG") == "true" {
+		return mailer.LogMailer{From: from}, nil
+	}
+	log.Print("Warning: no mailer configured, set SMTP_ADDR, MAIL_FILE or MAIL_LOG=true to send verification and password reset emails")
+	return nil, nil
+}
+
+// loadSigningKeys parses a comma separated list of kid=path pairs. The first
+// key signs new tokens; the others are only used to verify existing ones.
+func loadSigningKeys(spec string) ([]encryption.SigningKey, error) {
+	keys := []encryption.SigningKey{}
+	for _, entry := range strings.Split(spec, ",") {
+		kid, path, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found || kid == "" || path == "" {
+			return nil, fmt.Errorf("invalid key %q, expected kid=path", entry)
+		}
+		key, err := encryption.LoadSigningKey(kid, path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if keys[0].Private == nil {
+		return nil, fmt.Errorf("signing key %s has no private key", keys[0].Id)
+	}
+	return keys, nil
+}
+
+// promoteAdmins gives the admin role to the existing users with the given
+// emails, so a fresh deployment has someone who can manage the others.
+func promoteAdmins(store db.Store, emails []string) error {
+	keys := make([]string, 0, len(emails))
+	for _, email := range emails {
+		keys = append(keys, email_address.Key(email))
+	}
+	users, err := store.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if user.Role == db.RoleAdmin || !slices.Contains(keys, email_address.Key(user.Email)) {
+			continue
+		}
+		_, err := store.SetUserRole(user.Id, db.RoleAdmin)
+		if err != nil {
+			return err
+		}
+		log.Printf("promoted %s to admin", user.Email)
+	}
+	return nil
+}
+
+// loadContentFilter reads the banned word list from CONTENT_FILTER_FILE or,
+// failing that, CONTENT_FILTER_WORDS, falling back to the default list.
+func loadContentFilter() (*content_filter.Filter, error) {
+	if path := os.Getenv("CONTENT_FILTER_FILE"); path != "" {
+		return content_filter.NewFileFilter(path)
+	}
+	if words := os.Getenv("CONTENT_FILTER_WORDS"); words != "" {
+		rules, err := content_filter.ParseRulesList(words)
+		if err != nil {
+			return nil, err
+		}
+		return content_filter.NewFilter(rules), nil
+	}
+	return content_filter.NewFilter(content_filter.DefaultRules), nil
+}
+
+// reloadOnHangup re-reads the word list file every time the process gets a
+// SIGHUP, so it can be changed without a restart.
+func reloadOnHangup(contentFilter *content_filter.Filter) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		err := contentFilter.Reload()
+		if err != nil {
+			log.Printf("Error reloading content filter: %s", err)
+			continue
+		}
+		log.Println("content filter reloaded")
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"testing"
 
 	"github.com/ajaen4/go-standard-lib-api/internal/db"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
 	"github.com/ajaen4/go-standard-lib-api/pkg/handlers"
+	"github.com/ajaen4/go-standard-lib-api/pkg/password_policy"
 )
 
 func setupTestCfg(t *testing.T) *handlers.ApiConfig {
@@ -16,9 +18,14 @@ func setupTestCfg(t *testing.T) *handlers.ApiConfig {
 	}
 
 	apiCfg := &handlers.ApiConfig{
-		DB:        testDB,
-		JwtSecret: os.Getenv("JWT_SECRET"),
-		PolkaKey:  os.Getenv("POLKA_KEY"),
+		DB:                    testDB,
+		TokenConfig:           encryption.NewTokenConfig(os.Getenv("JWT_SECRET")),
+		PolkaKey:              os.Getenv("POLKA_KEY"),
+		RefreshTokenTTL:       handlers.DefaultRefreshTokenTTL,
+		PasswordPolicy:        password_policy.DefaultPolicy(),
+		VerificationTokenTTL:  handlers.DefaultVerificationTokenTTL,
+		PasswordResetTokenTTL: handlers.DefaultPasswordResetTokenTTL,
+		LoginChallengeTTL:     handlers.DefaultLoginChallengeTTL,
 	}
 
 	return apiCfg
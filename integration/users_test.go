@@ -43,6 +43,15 @@ func TestPostUser(t *testing.T) {
 	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
 		t.Fatal(err)
 	}
+	if response.CreatedAt.IsZero() || !response.UpdatedAt.Equal(response.CreatedAt) {
+		t.Errorf(
+			"handler returned wrong timestamps: got created_at %v updated_at %v",
+			response.CreatedAt,
+			response.UpdatedAt,
+		)
+	}
+	expected.CreatedAt = response.CreatedAt
+	expected.UpdatedAt = response.UpdatedAt
 	if response != expected {
 		t.Errorf(
 			"handler returned wrong response: got %v want %v",
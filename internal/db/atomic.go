@@ -0,0 +1,70 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Overridden in tests to simulate a crash between writing the temp file and
+// publishing it.
+var renameFile = os.Rename
+
+// writeFileAtomic replaces path with data so that readers, and the file left
+// behind after a crash, only ever see the old or the new content in full.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := os.CreateTemp(dir, base+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if errC := tmp.Close(); err == nil {
+		err = errC
+	}
+	if err != nil {
+		return err
+	}
+
+	err = renameFile(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// removeTempFiles cleans up temp files left by writes that never got renamed.
+func removeTempFiles(path string) error {
+	matches, err := filepath.Glob(path + ".tmp-*")
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		err := os.Remove(match)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/email_address"
+)
+
+// cache is an immutable, decoded snapshot of the database file plus the
+// secondary indexes built from it. Update never mutates a published cache; it
+// builds a new one, so readers can use a snapshot without holding the lock.
+type cache struct {
+	data DBStructure
+	info os.FileInfo
+
+	usersByEmail    map[string]int // by email_address.Key
+	chirpIds        []int
+	flaggedChirpIds []int
+	chirpsByAuthor  map[int][]int
+
+	sessionsByToken   map[string]int
+	sessionsByRotated map[string]int
+	sessionsByUser    map[int][]int
+}
+
+func newCache(data DBStructure, info os.FileInfo) *cache {
+	c := &cache{
+		data:              data,
+		info:              info,
+		usersByEmail:      make(map[string]int, len(data.Users)),
+		chirpIds:          make([]int, 0, len(data.Chirps)),
+		chirpsByAuthor:    map[int][]int{},
+		sessionsByToken:   make(map[string]int, len(data.Sessions)),
+		sessionsByRotated: map[string]int{},
+		sessionsByUser:    map[int][]int{},
+	}
+
+	for id, user := range data.Users {
+		c.usersByEmail[email_address.Key(user.Email)] = id
+	}
+	for id, session := range data.Sessions {
+		c.sessionsByToken[session.TokenHash] = id
+		for _, hash := range session.RotatedHashes {
+			c.sessionsByRotated[hash] = id
+		}
+		c.sessionsByUser[session.UserId] = append(c.sessionsByUser[session.UserId], id)
+	}
+	for id, chirp := range data.Chirps {
+		c.chirpIds = append(c.chirpIds, id)
+		if chirp.Flagged {
+			c.flaggedChirpIds = append(c.flaggedChirpIds, id)
+		}
+		c.chirpsByAuthor[chirp.AuthorId] = append(c.chirpsByAuthor[chirp.AuthorId], id)
+	}
+	slices.Sort(c.chirpIds)
+	slices.Sort(c.flaggedChirpIds)
+	for _, ids := range c.chirpsByAuthor {
+		slices.Sort(ids)
+	}
+	for _, ids := range c.sessionsByUser {
+		slices.Sort(ids)
+	}
+	return c
+}
+
+// isStale reports whether the file on disk is no longer the one this cache
+// was loaded from, e.g. because it was edited or restored by hand.
+func (c *cache) isStale(info os.FileInfo) bool {
+	return !os.SameFile(c.info, info) ||
+		!c.info.ModTime().Equal(info.ModTime()) ||
+		c.info.Size() != info.Size()
+}
+
+func (dbStructure DBStructure) clone() DBStructure {
+	dbStructure.Sequences = maps.Clone(dbStructure.Sequences)
+	dbStructure.Chirps = maps.Clone(dbStructure.Chirps)
+	dbStructure.ChirpHistory = maps.Clone(dbStructure.ChirpHistory)
+	dbStructure.DeletedChirps = maps.Clone(dbStructure.DeletedChirps)
+	dbStructure.Users = maps.Clone(dbStructure.Users)
+	dbStructure.Sessions = maps.Clone(dbStructure.Sessions)
+	dbStructure.RevokedTokens = maps.Clone(dbStructure.RevokedTokens)
+	dbStructure.UserTokens = maps.Clone(dbStructure.UserTokens)
+	dbStructure.RecoveryCodes = maps.Clone(dbStructure.RecoveryCodes)
+	dbStructure.LoginAttempts = maps.Clone(dbStructure.LoginAttempts)
+	return dbStructure
+}
+
+// snapshot returns the current cache, reloading it from disk first if the
+// file changed since it was last read or written.
+func (db *DB) snapshot() (*cache, error) {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mux.RLock()
+	c := db.cache
+	db.mux.RUnlock()
+	if c != nil && !c.isStale(info) {
+		return c, nil
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.refresh()
+}
+
+// refresh must be called with the write lock held.
+func (db *DB) refresh() (*cache, error) {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return nil, err
+	}
+	if db.cache != nil && !db.cache.isStale(info) {
+		return db.cache, nil
+	}
+
+	data, err := db.readDB()
+	if err != nil {
+		return nil, err
+	}
+	if db.cache == nil {
+		db.search.reset()
+		db.search.sync(nil, data.Chirps)
+	} else {
+		db.search.sync(db.cache.data.Chirps, data.Chirps)
+	}
+	db.cache = newCache(data, info)
+	return db.cache, nil
+}
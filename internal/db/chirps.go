@@ -1,99 +1,211 @@
 package db
 
-import "slices"
+import (
+	"slices"
+	"time"
+)
 
-func (db *DB) GetChirps(sortBy string) ([]Chirp, error) {
-	chirpsById, err := db.loadDB()
+func (db *DB) GetChirps(query ChirpsQuery) ([]Chirp, bool, error) {
+	current, err := db.snapshot()
 	if err != nil {
-		return nil, err
-	}
-	chirps := []Chirp{}
-	for _, chirp := range chirpsById.Chirps {
-		chirps = append(chirps, chirp)
+		return nil, false, err
 	}
 
-	if sortBy == "desc" {
-		slices.Reverse(chirps)
+	ids := current.chirpIds
+	switch {
+	case query.AuthorId != 0 && query.Flagged:
+		ids = slices.DeleteFunc(slices.Clone(current.chirpsByAuthor[query.AuthorId]), func(id int) bool {
+			return !current.data.Chirps[id].Flagged
+		})
+	case query.AuthorId != 0:
+		ids = current.chirpsByAuthor[query.AuthorId]
+	case query.Flagged:
+		ids = current.flaggedChirpIds
 	}
+	ids = pageIds(ids, query)
 
-	return chirps, nil
+	hasMore := len(ids) > query.Limit
+	if hasMore {
+		ids = ids[:query.Limit]
+	}
+	chirps := make([]Chirp, 0, len(ids))
+	for _, id := range ids {
+		chirps = append(chirps, current.data.Chirps[id])
+	}
+	return chirps, hasMore, nil
 }
 
-func (db *DB) GetChirpsByAuthId(authorId int, sortBy string) ([]Chirp, error) {
-	chirpsById, err := db.loadDB()
+func (db *DB) SearchChirps(query SearchQuery) ([]Chirp, error) {
+	current, err := db.snapshot()
 	if err != nil {
 		return nil, err
 	}
-	chirps := []Chirp{}
-	for _, chirp := range chirpsById.Chirps {
-		if chirp.AuthorId == authorId {
+
+	ids := db.search.search(query)
+	chirps := make([]Chirp, 0, len(ids))
+	for _, id := range ids {
+		if chirp, ok := current.data.Chirps[id]; ok {
 			chirps = append(chirps, chirp)
 		}
 	}
+	return chirps, nil
+}
 
-	if sortBy == "desc" {
-		slices.Reverse(chirps)
+// pageIds returns the ids that come after query.AfterId in the requested
+// order. ids must be sorted ascending; it is never modified.
+func pageIds(ids []int, query ChirpsQuery) []int {
+	if query.SortBy == "desc" {
+		end := len(ids)
+		if query.AfterId != 0 {
+			end, _ = slices.BinarySearch(ids, query.AfterId)
+		}
+		page := slices.Clone(ids[max(0, end-query.Limit-1):end])
+		slices.Reverse(page)
+		return page
 	}
 
-	return chirps, nil
+	start := 0
+	if query.AfterId != 0 {
+		start, _ = slices.BinarySearch(ids, query.AfterId+1)
+	}
+	return ids[start:min(len(ids), start+query.Limit+1)]
 }
 
 func (db *DB) GetChirp(chirpID int) (Chirp, error) {
-	chirpsById, err := db.loadDB()
+	current, err := db.snapshot()
 	if err != nil {
 		return Chirp{}, err
 	}
-	for dbChirpID, dbChirp := range chirpsById.Chirps {
-		if dbChirpID == chirpID {
-			return dbChirp, nil
-		}
+	chirp, ok := current.data.Chirps[chirpID]
+	if !ok {
+		chirpNotFound := ErrChirpNotFound
+		return Chirp{}, &chirpNotFound
 	}
-	chirpNotFound := ErrChirpNotFound
-	return Chirp{}, &chirpNotFound
+	return chirp, nil
 }
 
-func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) CreateChirp(body string, authorId int, flagged bool) (Chirp, error) {
+	var newChirp Chirp
+	err := db.Update(func(dbStructure *DBStructure) error {
+		id := dbStructure.nextId(seqChirps)
+		now := time.Now().UTC()
+		newChirp = Chirp{
+			Body:      body,
+			Id:        id,
+			AuthorId:  authorId,
+			Flagged:   flagged,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		dbStructure.Chirps[id] = newChirp
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	id := len(dbStructure.Chirps) + 1
-	newChirp := Chirp{
-		Body:     body,
-		Id:       id,
-		AuthorId: authorId,
-	}
-	dbStructure.Chirps[id] = newChirp
-	err = db.writeDB(dbStructure)
+	return newChirp, nil
+}
+
+func (db *DB) DeleteChirp(userId int, chirpId int) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		chirp, ok := dbStructure.Chirps[chirpId]
+		if !ok {
+			err := ErrChirpNotFound
+			return &err
+		}
+
+		if chirp.AuthorId != userId && !canModerate(dbStructure.Users[userId].Role) {
+			err := ErrChirpForbidden
+			return &err
+		}
+
+		now := time.Now().UTC()
+		dbStructure.ChirpHistory[chirpId] = append(
+			slices.Clip(dbStructure.ChirpHistory[chirpId]),
+			ChirpVersion{
+				Body:       chirp.Body,
+				CreatedAt:  chirp.UpdatedAt,
+				ReplacedAt: now,
+			},
+		)
+		dbStructure.DeletedChirps[chirpId] = DeletedChirp{
+			AuthorId:  chirp.AuthorId,
+			DeletedBy: userId,
+			DeletedAt: now,
+		}
+		delete(dbStructure.Chirps, chirpId)
+		return nil
+	})
+}
+
+// UpdateChirp replaces the body of one of userId's chirps, keeping the old
+// body in the chirp's history. Chirps can only be edited for editWindow after
+// they were posted.
+func (db *DB) UpdateChirp(userId int, chirpId int, body string, flagged bool, editWindow time.Duration) (Chirp, error) {
+	var chirp Chirp
+	err := db.Update(func(dbStructure *DBStructure) error {
+		var ok bool
+		chirp, ok = dbStructure.Chirps[chirpId]
+		if !ok {
+			err := ErrChirpNotFound
+			return &err
+		}
+		if chirp.AuthorId != userId {
+			err := ErrChirpForbidden
+			return &err
+		}
+		now := time.Now().UTC()
+		if now.Sub(chirp.CreatedAt) > editWindow {
+			err := ErrChirpEditWindow
+			return &err
+		}
+
+		dbStructure.ChirpHistory[chirpId] = append(
+			slices.Clip(dbStructure.ChirpHistory[chirpId]),
+			ChirpVersion{
+				Body:       chirp.Body,
+				CreatedAt:  chirp.UpdatedAt,
+				ReplacedAt: now,
+			},
+		)
+		chirp.Body = body
+		chirp.Flagged = flagged
+		chirp.UpdatedAt = now
+		dbStructure.Chirps[chirpId] = chirp
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	return newChirp, nil
+	return chirp, nil
 }
 
-func (db *DB) DeleteChirp(userId int, chirpId int) error {
-	dbStructure, err := db.loadDB()
+// GetChirpHistory returns the earlier bodies of a chirp, including its last
+// one if it was deleted. Only its author and moderators can see them.
+func (db *DB) GetChirpHistory(userId int, chirpId int) ([]ChirpVersion, error) {
+	current, err := db.snapshot()
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	if chirpId != len(dbStructure.Chirps) {
-		err := ErrIncorrectChirpId
-		return &err
+	var authorId int
+	if chirp, ok := current.data.Chirps[chirpId]; ok {
+		authorId = chirp.AuthorId
+	} else if deleted, ok := current.data.DeletedChirps[chirpId]; ok {
+		authorId = deleted.AuthorId
+	} else {
+		chirpNotFound := ErrChirpNotFound
+		return nil, &chirpNotFound
 	}
-
-	if dbStructure.Chirps[chirpId].AuthorId != userId {
-		err := ErrIncorrectAuthorId
-		return &err
+	if authorId != userId && !canModerate(current.data.Users[userId].Role) {
+		err := ErrChirpForbidden
+		return nil, &err
 	}
 
-	delete(dbStructure.Chirps, chirpId)
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		return err
+	versions := current.data.ChirpHistory[chirpId]
+	if versions == nil {
+		versions = []ChirpVersion{}
 	}
-
-	return nil
+	return versions, nil
 }
@@ -3,42 +3,199 @@ package db
 import (
 	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
 )
 
 type DB struct {
-	path string
-	mux  *sync.RWMutex
+	path    string
+	mux     *sync.RWMutex
+	journal *journal
+	cache   *cache
+	search  *searchIndex
+	hasher  encryption.PasswordHasher
+	// dummyHash is checked instead of a user's when Login is given an unknown
+	// email, so it takes as long as a wrong password.
+	dummyHash func() ([]byte, error)
+	// attemptsPrunedAt is when expired login attempts of each kind were last
+	// forgotten. It's only used from Update.
+	attemptsPrunedAt map[string]time.Time
+}
+
+type options struct {
+	journalPath string
+	hasher      encryption.PasswordHasher
+}
+
+type Option func(*options)
+
+func newOptions(opts []Option) options {
+	dbOpts := options{hasher: encryption.DefaultPasswordHasher()}
+	for _, opt := range opts {
+		opt(&dbOpts)
+	}
+	return dbOpts
+}
+
+// WithJournal makes the JSON store append every mutation to an append-only
+// journal at path before rewriting the main file, and replay it on startup.
+// It has no effect on the SQLite store, which keeps its own write-ahead log.
+func WithJournal(path string) Option {
+	return func(opts *options) {
+		opts.journalPath = path
+	}
+}
+
+// WithPasswordHasher sets how passwords are hashed. Users whose hash was made
+// with other settings are rehashed the next time they log in.
+func WithPasswordHasher(hasher encryption.PasswordHasher) Option {
+	return func(opts *options) {
+		opts.hasher = hasher
+	}
 }
 
 type Chirp struct {
-	Id       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorId int    `json:"author_id"`
+	Id        int       `json:"id"`
+	Body      string    `json:"body"`
+	AuthorId  int       `json:"author_id"`
+	Flagged   bool      `json:"flagged"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ChirpVersion is a body a chirp had before it was edited or deleted.
+type ChirpVersion struct {
+	Body       string    `json:"body"`
+	CreatedAt  time.Time `json:"created_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// DeletedChirp records who deleted a chirp and when. The chirp's last body is
+// the final version in its history, which is kept for review.
+type DeletedChirp struct {
+	AuthorId  int       `json:"author_id"`
+	DeletedBy int       `json:"deleted_by"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// ChirpsQuery selects a page of chirps ordered by id, which is also the order
+// they were created in.
+type ChirpsQuery struct {
+	AuthorId int    // 0 matches every author
+	Flagged  bool   // only chirps flagged for review
+	SortBy   string // "asc" or "desc"
+	AfterId  int    // continue after this id in SortBy order; 0 starts at the top
+	Limit    int
 }
 
 type User struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	PssHash     []byte `json:"pss_hash"`
-	RefToken    string `json:"refresh_token"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Id          int       `json:"id"`
+	Email       string    `json:"email"`
+	PssHash     []byte    `json:"pss_hash"`
+	RefToken    string    `json:"refresh_token,omitempty"` // plaintext, only read by the hashRefreshTokens migration
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	Role        string    `json:"role"`
+	Banned      bool      `json:"banned"`
+	Verified    bool      `json:"verified"` // owns Email, proven with a verification token
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// Access tokens issued at or before TokensValidAfter are rejected. It
+	// keeps its full precision, to compare with the iat_ns claim.
+	TokensValidAfter time.Time `json:"tokens_valid_after"`
+	// TOTPSecret is set when the user starts enrolling in two-factor
+	// authentication, which is only required at login once TOTPEnabled.
+	TOTPSecret   string `json:"totp_secret,omitempty"`
+	TOTPEnabled  bool   `json:"totp_enabled"`
+	TOTPLastStep int64  `json:"totp_last_step,omitempty"` // codes from this step or earlier are replays
+}
+
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleModerator || role == RoleAdmin
 }
 
+// canModerate reports whether role may delete chirps written by other users.
+func canModerate(role string) bool {
+	return role == RoleModerator || role == RoleAdmin
+}
+
+// Session is one logged in device. Its refresh token is rotated on every use;
+// the digests of the tokens it replaced are kept so a replayed token can be
+// recognised as stolen.
+type Session struct {
+	Id            int       `json:"id"`
+	UserId        int       `json:"user_id"`
+	TokenHash     string    `json:"token_hash"`
+	RotatedHashes []string  `json:"rotated_hashes,omitempty"`
+	UserAgent     string    `json:"user_agent"`
+	IP            string    `json:"ip"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	LastUsedAt    time.Time `json:"last_used_at"`
+}
+
+// UserToken is a one-time token sent to a user by email, stored by its digest.
+// Email is the address it was sent to, so it stops working if the user's
+// email changes. Failures counts the wrong codes tried with a login challenge.
+type UserToken struct {
+	UserId    int       `json:"user_id"`
+	Purpose   string    `json:"purpose"`
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Failures  int       `json:"failures,omitempty"`
+}
+
+const (
+	TokenPurposeVerifyEmail    = "verify_email"
+	TokenPurposeResetPassword  = "reset_password"
+	TokenPurposeLoginChallenge = "login_challenge"
+)
+
+// legacySessionTTL is how long refresh tokens issued before sessions existed
+// stay valid once migrated.
+const legacySessionTTL = 60 * 24 * time.Hour
+
 type DBStructure struct {
-	Chirps map[int]Chirp `json:"chirps"`
-	Users  map[int]User  `json:"users"`
+	Version       uint64                   `json:"version"`
+	SchemaVersion int                      `json:"schema_version"`
+	Sequences     map[string]int           `json:"sequences"`
+	Chirps        map[int]Chirp            `json:"chirps"`
+	ChirpHistory  map[int][]ChirpVersion   `json:"chirp_history"`
+	DeletedChirps map[int]DeletedChirp     `json:"deleted_chirps"`
+	Users         map[int]User             `json:"users"`
+	Sessions      map[int]Session          `json:"sessions"`
+	RevokedTokens map[string]time.Time     `json:"revoked_tokens"` // jti -> expiry
+	UserTokens    map[string]UserToken     `json:"user_tokens"`    // digest -> token
+	RecoveryCodes map[int][]string         `json:"recovery_codes"` // user id -> digests
+	LoginAttempts map[string]LoginAttempts `json:"login_attempts"` // attemptsKey -> attempts
+}
+
+const (
+	seqChirps   = "chirps"
+	seqSessions = "sessions"
+	seqUsers    = "users"
+)
+
+// nextId hands out the next id of a collection. Ids are never reused, even
+// after the record holding the last one is deleted.
+func (dbStructure *DBStructure) nextId(collection string) int {
+	dbStructure.Sequences[collection]++
+	return dbStructure.Sequences[collection]
 }
 
 var ErrChirpNotFound = api_errors.ClientErr{
-	HttpCode: http.StatusBadRequest,
+	HttpCode: http.StatusNotFound,
 	Message:  "chirp id not found",
 }
 var ErrUserAlrExist = api_errors.ClientErr{
@@ -49,37 +206,123 @@ var ErrUserNotExist = api_errors.ClientErr{
 	HttpCode: http.StatusBadRequest,
 	Message:  "user doesn't exist",
 }
+
+// Every failed login gets the same response, so it can't be used to find out
+// which emails have an account.
+var ErrLoginUnknownEmail = api_errors.ClientErr{
+	HttpCode: http.StatusUnauthorized,
+	Message:  "invalid credentials",
+	LogMess:  "login with unknown email",
+}
 var ErrIncorrectPss = api_errors.ClientErr{
+	HttpCode: http.StatusUnauthorized,
+	Message:  "invalid credentials",
+	LogMess:  "incorrect password",
+}
+var ErrLoginThrottled = api_errors.ClientErr{
+	HttpCode: http.StatusUnauthorized,
+	Message:  "invalid credentials",
+	LogMess:  "too many failed logins",
+}
+var ErrChirpForbidden = api_errors.ClientErr{
+	HttpCode: http.StatusForbidden,
+	Message:  "chirp belongs to another user",
+}
+var ErrChirpEditWindow = api_errors.ClientErr{
+	HttpCode: http.StatusForbidden,
+	Message:  "chirp can no longer be edited",
+}
+var ErrInvalidRole = api_errors.ClientErr{
 	HttpCode: http.StatusBadRequest,
-	Message:  "incorrect password",
+	Message:  "unknown role",
+}
+var ErrUserBanned = api_errors.ClientErr{
+	HttpCode: http.StatusForbidden,
+	Message:  "account is banned",
+}
+var ErrSessionNotFound = api_errors.ClientErr{
+	HttpCode: http.StatusNotFound,
+	Message:  "session not found",
+}
+var ErrRefTokenInvalid = api_errors.ClientErr{
+	HttpCode: http.StatusUnauthorized,
+	Message:  "Unauthorized",
+	LogMess:  "unknown or expired refresh token",
 }
-var ErrIncorrectChirpId = api_errors.ClientErr{
+var ErrRefTokenReused = api_errors.ClientErr{
+	HttpCode: http.StatusUnauthorized,
+	Message:  "Unauthorized",
+	LogMess:  "refresh token reused, session revoked",
+}
+var ErrVerificationTokenInvalid = api_errors.ClientErr{
 	HttpCode: http.StatusBadRequest,
-	Message:  "incorrect chirp id",
+	Message:  "invalid or expired verification token",
 }
-var ErrIncorrectAuthorId = api_errors.ClientErr{
+var ErrResetTokenInvalid = api_errors.ClientErr{
 	HttpCode: http.StatusBadRequest,
-	Message:  "incorrect author id",
+	Message:  "invalid or expired password reset token",
+}
+var ErrTOTPAlrEnabled = api_errors.ClientErr{
+	HttpCode: http.StatusBadRequest,
+	Message:  "two-factor authentication already enabled",
+}
+var ErrTOTPNotEnrolled = api_errors.ClientErr{
+	HttpCode: http.StatusBadRequest,
+	Message:  "two-factor authentication not enrolled",
+}
+var ErrSecondFactorInvalid = api_errors.ClientErr{
+	HttpCode: http.StatusUnauthorized,
+	Message:  "invalid two-factor code",
+}
+var ErrLoginChallengeInvalid = api_errors.ClientErr{
+	HttpCode: http.StatusUnauthorized,
+	Message:  "invalid credentials",
+	LogMess:  "unknown or expired login challenge",
+}
+var ErrLoginCodeInvalid = api_errors.ClientErr{
+	HttpCode: http.StatusUnauthorized,
+	Message:  "invalid credentials",
+	LogMess:  "wrong second factor for login challenge",
+}
+var ErrEmailAlrVerified = api_errors.ClientErr{
+	HttpCode: http.StatusBadRequest,
+	Message:  "email already verified",
+}
+var ErrCurrentPssIncorrect = api_errors.ClientErr{
+	HttpCode: http.StatusForbidden,
+	Message:  "current password is incorrect",
 }
 
-func NewDB(path string) (*DB, error) {
-	isDebug := flag.Bool("debug", false, "Enable debug mode")
-	flag.Parse()
-	log.Println("debug:", *isDebug)
-
+func NewDB(path string, opts ...Option) (*DB, error) {
+	dbOpts := newOptions(opts)
 	db := &DB{
-		path: path,
-		mux:  &sync.RWMutex{},
+		path:      path,
+		mux:       &sync.RWMutex{},
+		search:    newSearchIndex(),
+		hasher:    dbOpts.hasher,
+		dummyHash: newDummyHash(dbOpts.hasher),
+	}
+
+	err := db.ensureDB()
+	if err != nil {
+		return &DB{}, err
 	}
-	if *isDebug {
-		err := db.RemoveDB()
+
+	if dbOpts.journalPath != "" {
+		db.journal, err = openJournal(dbOpts.journalPath)
 		if err != nil {
 			return &DB{}, err
 		}
+		err = db.replayJournal()
+		if err != nil {
+			db.journal.close()
+			return &DB{}, err
+		}
 	}
 
-	err := db.ensureDB()
+	err = db.migrate()
 	if err != nil {
+		db.Close()
 		return &DB{}, err
 	}
 
@@ -87,22 +330,52 @@ func NewDB(path string) (*DB, error) {
 }
 
 func (db *DB) RemoveDB() error {
-	if _, err := os.Stat(db.path); err == nil {
-		errR := os.Remove(db.path)
-		if errR != nil {
-			return errors.New(fmt.Sprintf("Failed to delete database: %v", errR))
+	paths := []string{db.path}
+	if db.journal != nil {
+		db.journal.close()
+		paths = append(paths, db.journal.path)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			errR := os.Remove(path)
+			if errR != nil {
+				return errors.New(fmt.Sprintf("Failed to delete database: %v", errR))
+			}
 		}
 	}
 	return nil
 }
 
+func (db *DB) Close() error {
+	if db.journal != nil {
+		return db.journal.close()
+	}
+	return nil
+}
+
 func (db *DB) ensureDB() error {
+	err := removeTempFiles(db.path)
+	if err != nil {
+		return err
+	}
+
 	_, errS := os.Stat(db.path)
 	if errS != nil && os.IsNotExist(errS) {
-		errW := db.writeDB(DBStructure{
-			Chirps: map[int]Chirp{},
-			Users:  map[int]User{},
+		jsonContent, err := json.Marshal(DBStructure{
+			Chirps:        map[int]Chirp{},
+			ChirpHistory:  map[int][]ChirpVersion{},
+			DeletedChirps: map[int]DeletedChirp{},
+			Users:         map[int]User{},
+			Sessions:      map[int]Session{},
+			RevokedTokens: map[string]time.Time{},
+			UserTokens:    map[string]UserToken{},
+			RecoveryCodes: map[int][]string{},
+			LoginAttempts: map[string]LoginAttempts{},
 		})
+		if err != nil {
+			return err
+		}
+		errW := writeFileAtomic(db.path, jsonContent, 0644)
 		if errW != nil {
 			return errW
 		}
@@ -112,10 +385,41 @@ func (db *DB) ensureDB() error {
 	return nil
 }
 
-func (db *DB) loadDB() (DBStructure, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// Update runs fn as a single transaction: the write lock is held from reading
+// the current state until fn's changes are on disk, so concurrent mutations
+// can't interleave. fn works on a copy of the cached state, so if it returns an
+// error nothing is written and readers never see its partial changes.
+func (db *DB) Update(fn func(*DBStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
 
+	current, err := db.refresh()
+	if err != nil {
+		return err
+	}
+	dbStructure := current.data.clone()
+	err = fn(&dbStructure)
+	if err != nil {
+		return err
+	}
+
+	dbStructure.Version = current.data.Version + 1
+	err = db.writeDB(current.data, dbStructure)
+	if err != nil {
+		return err
+	}
+	db.search.sync(current.data.Chirps, dbStructure.Chirps)
+
+	info, err := os.Stat(db.path)
+	if err != nil {
+		db.cache = nil
+		return nil
+	}
+	db.cache = newCache(dbStructure, info)
+	return nil
+}
+
+func (db *DB) readDB() (DBStructure, error) {
 	fileContent, err := os.ReadFile(db.path)
 	if err != nil {
 		return DBStructure{}, err
@@ -128,17 +432,44 @@ func (db *DB) loadDB() (DBStructure, error) {
 	return chirpsById, nil
 }
 
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
+// writeDB must only be called with the write lock held, i.e. from Update.
+func (db *DB) writeDB(prevStructure DBStructure, dbStructure DBStructure) error {
 	jsonContent, err := json.Marshal(dbStructure)
 	if err != nil {
 		return err
 	}
-	errW := os.WriteFile(db.path, jsonContent, 0644)
-	if errW != nil {
-		return errW
+	if db.journal == nil {
+		return writeFileAtomic(db.path, jsonContent, 0644)
+	}
+
+	prevContent, err := json.Marshal(prevStructure)
+	if err != nil {
+		return err
+	}
+	prev, err := decodeDocument(prevContent)
+	if err != nil {
+		return err
+	}
+	next, err := decodeDocument(jsonContent)
+	if err != nil {
+		return err
+	}
+
+	// The journal entry is durable before the main file is touched, so a crash
+	// past this point is recovered by replayJournal on the next start.
+	journalSize := db.journal.size
+	err = db.journal.append(diffDocuments(prev, next, dbStructure.Version))
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(db.path, jsonContent, 0644)
+	if err != nil {
+		db.journal.truncate(journalSize)
+		return err
+	}
+
+	if db.journal.size > maxJournalSize {
+		return db.journal.truncate(0)
 	}
 	return nil
 }
@@ -0,0 +1,493 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+)
+
+func setupTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatalf("Error initializing test DB: %s", err)
+	}
+	return db
+}
+
+func TestConcurrentCreateChirp(t *testing.T) {
+	db := setupTestDB(t)
+
+	const workers = 20
+	const chirpsPerWorker = 10
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*chirpsPerWorker)
+	for w := 1; w <= workers; w++ {
+		wg.Add(1)
+		go func(authorId int) {
+			defer wg.Done()
+			for i := 0; i < chirpsPerWorker; i++ {
+				_, err := db.CreateChirp(fmt.Sprintf("chirp %d", i), authorId, false)
+				if err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	chirps, _, err := db.GetChirps(ChirpsQuery{Limit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != workers*chirpsPerWorker {
+		t.Fatalf("lost chirps: got %d want %d", len(chirps), workers*chirpsPerWorker)
+	}
+	for w := 1; w <= workers; w++ {
+		authorChirps, _, err := db.GetChirps(ChirpsQuery{AuthorId: w, Limit: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(authorChirps) != chirpsPerWorker {
+			t.Errorf("author %d: got %d chirps want %d", w, len(authorChirps), chirpsPerWorker)
+		}
+	}
+}
+
+func TestConcurrentCreateUserSameEmail(t *testing.T) {
+	db := setupTestDB(t)
+
+	const workers = 10
+	var wg sync.WaitGroup
+	created := make(chan User, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user, err := db.CreateUser("test@email.com", "testPassword")
+			if err == nil {
+				created <- user
+			}
+		}()
+	}
+	wg.Wait()
+	close(created)
+
+	if n := len(created); n != 1 {
+		t.Errorf("duplicate users created: got %d want 1", n)
+	}
+}
+
+func TestUpdateDiscardsChangesOnError(t *testing.T) {
+	db := setupTestDB(t)
+
+	err := db.Update(func(dbStructure *DBStructure) error {
+		dbStructure.Chirps[1] = Chirp{Id: 1, Body: "never written"}
+		return fmt.Errorf("abort")
+	})
+	if err == nil {
+		t.Fatal("expected Update to return fn's error")
+	}
+
+	chirps, _, err := db.GetChirps(ChirpsQuery{Limit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 0 {
+		t.Errorf("aborted transaction was written: got %v", chirps)
+	}
+}
+
+func TestIdsNotReusedAfterDelete(t *testing.T) {
+	db := setupTestDB(t)
+
+	user, err := db.CreateUser("test@email.com", "testPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateChirp("first chirp", user.Id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := db.CreateChirp("second chirp", user.Id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteChirp(user.Id, second.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	third, err := db.CreateChirp("third chirp", user.Id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Id == second.Id {
+		t.Errorf("deleted chirp id %d was reused", second.Id)
+	}
+}
+
+func TestMigrationSeedsSequences(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	legacy := `{
+		"chirps": {
+			"1": {"id": 1, "body": "first chirp", "author_id": 1},
+			"3": {"id": 3, "body": "third chirp", "author_id": 2}
+		},
+		"users": {
+			"2": {"id": 2, "email": "test@email.com"}
+		}
+	}`
+	err := os.WriteFile(path, []byte(legacy), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chirp, err := db.CreateChirp("new chirp", 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Id != 4 {
+		t.Errorf("chirp id: got %d want 4", chirp.Id)
+	}
+	user, err := db.CreateUser("new@email.com", "testPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Id != 3 {
+		t.Errorf("user id: got %d want 3", user.Id)
+	}
+}
+
+func TestDeleteChirp(t *testing.T) {
+	db := setupTestDB(t)
+
+	author, err := db.CreateUser("author@email.com", "testPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.CreateUser("other@email.com", "testPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := db.CreateUser("admin@email.com", "testPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SetUserRole(admin.Id, RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moderator, err := db.CreateUser("moderator@email.com", "testPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.SetUserRole(moderator.Id, RoleModerator)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := db.CreateChirp("first chirp", author.Id, false)
+	second, _ := db.CreateChirp("second chirp", author.Id, false)
+	third, _ := db.CreateChirp("third chirp", author.Id, false)
+
+	tests := []struct {
+		name     string
+		userId   int
+		chirpId  int
+		expected *api_errors.ClientErr
+	}{
+		{"missing chirp", author.Id, 99, &ErrChirpNotFound},
+		{"someone else's chirp", other.Id, first.Id, &ErrChirpForbidden},
+		{"own older chirp", author.Id, first.Id, nil},
+		{"admin deletes any chirp", admin.Id, second.Id, nil},
+		{"moderator deletes any chirp", moderator.Id, third.Id, nil},
+		{"already deleted chirp", author.Id, first.Id, &ErrChirpNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := db.DeleteChirp(tt.userId, tt.chirpId)
+			if tt.expected == nil {
+				if err != nil {
+					t.Errorf("DeleteChirp(%d, %d) = %v; want nil", tt.userId, tt.chirpId, err)
+				}
+				return
+			}
+			clientErr, ok := err.(*api_errors.ClientErr)
+			if !ok || clientErr.HttpCode != tt.expected.HttpCode {
+				t.Errorf("DeleteChirp(%d, %d) = %v; want %v", tt.userId, tt.chirpId, err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRolesAndBans(t *testing.T) {
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			store, err := NewStore(driver, filepath.Join(t.TempDir(), "database"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			user, err := store.CreateUser("test@email.com", "testPassword")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Role != RoleUser {
+				t.Errorf("new user role: got %q want %q", user.Role, RoleUser)
+			}
+
+			_, err = store.SetUserRole(user.Id, "superuser")
+			if clientErr, ok := err.(*api_errors.ClientErr); !ok || clientErr.HttpCode != ErrInvalidRole.HttpCode {
+				t.Errorf("SetUserRole with unknown role = %v; want %v", err, ErrInvalidRole)
+			}
+			updated, err := store.SetUserRole(user.Id, RoleModerator)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated.Role != RoleModerator {
+				t.Errorf("updated role: got %q want %q", updated.Role, RoleModerator)
+			}
+
+			_, err = store.CreateSession(user.Id, "refresh-token", "test", "127.0.0.1", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			banned, err := store.SetUserBanned(user.Id, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !banned.Banned {
+				t.Error("user not banned")
+			}
+			sessions, err := store.GetSessions(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 0 {
+				t.Errorf("banned user still has sessions: %v", sessions)
+			}
+			_, err = store.Login("test@email.com", "testPassword")
+			if clientErr, ok := err.(*api_errors.ClientErr); !ok || clientErr.HttpCode != ErrUserBanned.HttpCode {
+				t.Errorf("Login of banned user = %v; want %v", err, ErrUserBanned)
+			}
+
+			_, err = store.SetUserBanned(user.Id, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.Login("test@email.com", "testPassword")
+			if err != nil {
+				t.Errorf("Login of unbanned user = %v; want nil", err)
+			}
+
+			users, err := store.ListUsers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != 1 || users[0].Id != user.Id || users[0].Role != RoleModerator {
+				t.Errorf("ListUsers() = %v", users)
+			}
+		})
+	}
+}
+
+func TestCacheReloadsWhenFileChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := db.CreateUser("test@email.com", "testPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = db.GetChirps(ChirpsQuery{AuthorId: user.Id, Limit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second handle on the same file stands in for another process or a
+	// manual edit.
+	other, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chirp, err := other.CreateChirp("written elsewhere", user.Id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.GetChirp(chirp.Id)
+	if err != nil {
+		t.Fatalf("cache not reloaded: %s", err)
+	}
+	if got != chirp {
+		t.Errorf("got %v want %v", got, chirp)
+	}
+	byAuthor, _, err := db.GetChirps(ChirpsQuery{AuthorId: user.Id, Limit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byAuthor) != 1 {
+		t.Errorf("author index not rebuilt: got %v", byAuthor)
+	}
+}
+
+func TestGetChirpsPagination(t *testing.T) {
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			store, err := NewStore(driver, filepath.Join(t.TempDir(), "database"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			author, _ := store.CreateUser("author@email.com", "testPassword")
+			other, _ := store.CreateUser("other@email.com", "testPassword")
+			for i := 1; i <= 7; i++ {
+				authorId := author.Id
+				if i%2 == 0 {
+					authorId = other.Id
+				}
+				_, err := store.CreateChirp(fmt.Sprintf("chirp %d", i), authorId, i%3 == 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tests := []struct {
+				name    string
+				query   ChirpsQuery
+				ids     []int
+				hasMore bool
+			}{
+				{"first page asc", ChirpsQuery{SortBy: "asc", Limit: 3}, []int{1, 2, 3}, true},
+				{"next page asc", ChirpsQuery{SortBy: "asc", AfterId: 3, Limit: 3}, []int{4, 5, 6}, true},
+				{"last page asc", ChirpsQuery{SortBy: "asc", AfterId: 6, Limit: 3}, []int{7}, false},
+				{"first page desc", ChirpsQuery{SortBy: "desc", Limit: 3}, []int{7, 6, 5}, true},
+				{"last page desc", ChirpsQuery{SortBy: "desc", AfterId: 2, Limit: 3}, []int{1}, false},
+				{"exact page", ChirpsQuery{SortBy: "asc", AfterId: 4, Limit: 3}, []int{5, 6, 7}, false},
+				{"by author", ChirpsQuery{AuthorId: author.Id, SortBy: "asc", AfterId: 1, Limit: 2}, []int{3, 5}, true},
+				{"by author desc", ChirpsQuery{AuthorId: other.Id, SortBy: "desc", Limit: 5}, []int{6, 4, 2}, false},
+				{"flagged", ChirpsQuery{Flagged: true, SortBy: "asc", Limit: 1}, []int{3}, true},
+				{"flagged by author", ChirpsQuery{AuthorId: other.Id, Flagged: true, SortBy: "asc", Limit: 5}, []int{6}, false},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					chirps, hasMore, err := store.GetChirps(tt.query)
+					if err != nil {
+						t.Fatal(err)
+					}
+					ids := []int{}
+					for _, chirp := range chirps {
+						ids = append(ids, chirp.Id)
+					}
+					if !slices.Equal(ids, tt.ids) || hasMore != tt.hasMore {
+						t.Errorf("GetChirps(%+v) = %v, %v; want %v, %v", tt.query, ids, hasMore, tt.ids, tt.hasMore)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestUpdateChirpKeepsHistory(t *testing.T) {
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			store, err := NewStore(driver, filepath.Join(t.TempDir(), "database"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			author, _ := store.CreateUser("author@email.com", "testPassword")
+			other, _ := store.CreateUser("other@email.com", "testPassword")
+			chirp, err := store.CreateChirp("first body", author.Id, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = store.UpdateChirp(other.Id, chirp.Id, "hijacked", false, time.Hour)
+			if clientErr, ok := err.(*api_errors.ClientErr); !ok || clientErr.HttpCode != ErrChirpForbidden.HttpCode {
+				t.Errorf("editing someone else's chirp: got %v want %v", err, &ErrChirpForbidden)
+			}
+			_, err = store.UpdateChirp(author.Id, chirp.Id, "too late", false, 0)
+			if clientErr, ok := err.(*api_errors.ClientErr); !ok || clientErr.Message != ErrChirpEditWindow.Message {
+				t.Errorf("editing after the window: got %v want %v", err, &ErrChirpEditWindow)
+			}
+
+			_, err = store.UpdateChirp(author.Id, chirp.Id, "second body", false, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			updated, err := store.UpdateChirp(author.Id, chirp.Id, "third body", false, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated.Body != "third body" || !updated.UpdatedAt.After(updated.CreatedAt) {
+				t.Errorf("chirp not updated: got %+v", updated)
+			}
+
+			versions, err := store.GetChirpHistory(author.Id, chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bodies := []string{}
+			for _, version := range versions {
+				bodies = append(bodies, version.Body)
+			}
+			if !slices.Equal(bodies, []string{"first body", "second body"}) {
+				t.Errorf("history: got %v", bodies)
+			}
+			if !versions[0].CreatedAt.Equal(chirp.CreatedAt) {
+				t.Errorf("first version created_at: got %v want %v", versions[0].CreatedAt, chirp.CreatedAt)
+			}
+
+			// Deleting the chirp keeps its history, for its author and
+			// moderators only.
+			moderator, _ := store.CreateUser("moderator@email.com", "testPassword")
+			moderator, _ = store.SetUserRole(moderator.Id, RoleModerator)
+			err = store.DeleteChirp(moderator.Id, chirp.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.GetChirpHistory(other.Id, chirp.Id)
+			if clientErr, ok := err.(*api_errors.ClientErr); !ok || clientErr.HttpCode != ErrChirpForbidden.HttpCode {
+				t.Errorf("someone else's history: got %v want %v", err, &ErrChirpForbidden)
+			}
+			for _, userId := range []int{author.Id, moderator.Id} {
+				versions, err = store.GetChirpHistory(userId, chirp.Id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(versions) != 3 || versions[2].Body != "third body" {
+					t.Errorf("history after delete: got %+v", versions)
+				}
+			}
+			_, err = store.GetChirpHistory(author.Id, chirp.Id+1)
+			if clientErr, ok := err.(*api_errors.ClientErr); !ok || clientErr.Message != ErrChirpNotFound.Message {
+				t.Errorf("unknown chirp history: got %v want %v", err, &ErrChirpNotFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// The journal is checkpointed (truncated) once it grows past this size, since
+// by then every entry in it is already reflected in the main file.
+const maxJournalSize = 4 << 20
+
+// journalEntry records what a single write changed, relative to the previous
+// version of the database file. Collections (top-level JSON objects such as
+// "chirps" or "users") are diffed per key; any other top-level value is stored
+// whole in Fields.
+type journalEntry struct {
+	Version uint64                                `json:"version"`
+	Fields  map[string]json.RawMessage            `json:"fields,omitempty"`
+	Set     map[string]map[string]json.RawMessage `json:"set,omitempty"`
+	Del     map[string][]string                   `json:"del,omitempty"`
+}
+
+type journal struct {
+	path string
+	file *os.File
+	size int64
+}
+
+func openJournal(path string) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &journal{
+		path: path,
+		file: file,
+		size: info.Size(),
+	}, nil
+}
+
+// entries returns every complete entry in the journal. A torn last line, left
+// by a crash in the middle of an append, is ignored.
+func (j *journal) entries() ([]journalEntry, error) {
+	_, err := j.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []journalEntry{}
+	reader := bufio.NewReader(j.file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var entry journalEntry
+		if json.Unmarshal(line, &entry) != nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (j *journal) append(entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	n, err := j.file.WriteAt(line, j.size)
+	if err != nil {
+		j.truncate(j.size)
+		return err
+	}
+	err = j.file.Sync()
+	if err != nil {
+		j.truncate(j.size)
+		return err
+	}
+	j.size += int64(n)
+	return nil
+}
+
+func (j *journal) truncate(size int64) error {
+	err := j.file.Truncate(size)
+	if err != nil {
+		return err
+	}
+	j.size = size
+	return j.file.Sync()
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+type document map[string]json.RawMessage
+
+func decodeDocument(data []byte) (document, error) {
+	doc := document{}
+	if len(data) == 0 {
+		return doc, nil
+	}
+	err := json.Unmarshal(data, &doc)
+	return doc, err
+}
+
+func (doc document) version() (uint64, error) {
+	var version uint64
+	raw, ok := doc["version"]
+	if !ok {
+		return 0, nil
+	}
+	err := json.Unmarshal(raw, &version)
+	return version, err
+}
+
+func decodeCollection(raw json.RawMessage) (map[string]json.RawMessage, bool) {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, false
+	}
+	coll := map[string]json.RawMessage{}
+	if json.Unmarshal(trimmed, &coll) != nil {
+		return nil, false
+	}
+	return coll, true
+}
+
+func diffDocuments(prev document, next document, version uint64) journalEntry {
+	entry := journalEntry{
+		Version: version,
+		Fields:  map[string]json.RawMessage{},
+		Set:     map[string]map[string]json.RawMessage{},
+		Del:     map[string][]string{},
+	}
+
+	for key, nextVal := range next {
+		if key == "version" {
+			continue
+		}
+		prevVal := prev[key]
+		prevColl, okPrev := decodeCollection(prevVal)
+		nextColl, okNext := decodeCollection(nextVal)
+		if !okPrev || !okNext {
+			if !bytes.Equal(prevVal, nextVal) {
+				entry.Fields[key] = nextVal
+			}
+			continue
+		}
+
+		for id, rec := range nextColl {
+			if !bytes.Equal(prevColl[id], rec) {
+				if entry.Set[key] == nil {
+					entry.Set[key] = map[string]json.RawMessage{}
+				}
+				entry.Set[key][id] = rec
+			}
+		}
+		for id := range prevColl {
+			if _, ok := nextColl[id]; !ok {
+				entry.Del[key] = append(entry.Del[key], id)
+			}
+		}
+		sort.Strings(entry.Del[key])
+	}
+	return entry
+}
+
+func (doc document) apply(entry journalEntry) error {
+	for key, val := range entry.Fields {
+		doc[key] = val
+	}
+
+	changed := map[string]map[string]json.RawMessage{}
+	collection := func(key string) map[string]json.RawMessage {
+		if coll, ok := changed[key]; ok {
+			return coll
+		}
+		coll, ok := decodeCollection(doc[key])
+		if !ok {
+			coll = map[string]json.RawMessage{}
+		}
+		changed[key] = coll
+		return coll
+	}
+	for key, recs := range entry.Set {
+		coll := collection(key)
+		for id, rec := range recs {
+			coll[id] = rec
+		}
+	}
+	for key, ids := range entry.Del {
+		coll := collection(key)
+		for _, id := range ids {
+			delete(coll, id)
+		}
+	}
+
+	for key, coll := range changed {
+		raw, err := json.Marshal(coll)
+		if err != nil {
+			return err
+		}
+		doc[key] = raw
+	}
+	raw, err := json.Marshal(entry.Version)
+	if err != nil {
+		return err
+	}
+	doc["version"] = raw
+	return nil
+}
+
+// replayJournal brings the main file up to date with any journal entries it
+// is missing, then checkpoints the journal.
+func (db *DB) replayJournal() error {
+	fileContent, err := os.ReadFile(db.path)
+	if err != nil {
+		return err
+	}
+	doc, err := decodeDocument(fileContent)
+	if err != nil {
+		return err
+	}
+	version, err := doc.version()
+	if err != nil {
+		return err
+	}
+
+	entries, err := db.journal.entries()
+	if err != nil {
+		return err
+	}
+	replayed := 0
+	for _, entry := range entries {
+		if entry.Version <= version {
+			continue
+		}
+		if entry.Version != version+1 {
+			return fmt.Errorf(
+				"journal %s is missing entries between version %d and %d",
+				db.journal.path, version, entry.Version,
+			)
+		}
+		err := doc.apply(entry)
+		if err != nil {
+			return err
+		}
+		version = entry.Version
+		replayed++
+	}
+
+	if replayed > 0 {
+		jsonContent, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(db.path, jsonContent, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return db.journal.truncate(0)
+}
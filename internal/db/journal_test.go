@@ -0,0 +1,174 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func setupJournaledDB(t *testing.T) (*DB, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "database.json")
+	journalPath := filepath.Join(dir, "database.json.journal")
+
+	db, err := NewDB(path, WithJournal(journalPath))
+	if err != nil {
+		t.Fatalf("Error initializing test DB: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, path, journalPath
+}
+
+func reopenJournaledDB(t *testing.T, db *DB, path string, journalPath string) *DB {
+	t.Helper()
+	db.Close()
+	reopened, err := NewDB(path, WithJournal(journalPath))
+	if err != nil {
+		t.Fatalf("Error reopening test DB: %s", err)
+	}
+	t.Cleanup(func() { reopened.Close() })
+	return reopened
+}
+
+func TestFailedWriteKeepsPreviousFile(t *testing.T) {
+	db, path, journalPath := setupJournaledDB(t)
+
+	user, err := db.CreateUser("test@email.com", "testPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renameFile = func(string, string) error { return errors.New("disk full") }
+	_, err = db.CreateChirp("lost chirp", user.Id, false)
+	renameFile = os.Rename
+	if err == nil {
+		t.Fatal("expected CreateChirp to fail when the file can't be replaced")
+	}
+
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("database file changed after a failed write: got %s want %s", after, before)
+	}
+	matches, _ := filepath.Glob(path + ".tmp-*")
+	if len(matches) != 0 {
+		t.Errorf("temp files left behind: %v", matches)
+	}
+
+	db = reopenJournaledDB(t, db, path, journalPath)
+	chirps, _, err := db.GetChirps(ChirpsQuery{Limit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 0 {
+		t.Errorf("failed write was replayed: got %v", chirps)
+	}
+}
+
+func TestJournalReplaysWritesMissingFromFile(t *testing.T) {
+	db, path, journalPath := setupJournaledDB(t)
+
+	user, err := db.CreateUser("test@email.com", "testPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chirp, err := db.CreateChirp("first chirp", user.Id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.UserChirpyRed(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash after the journal appends but before the renames: the
+	// main file is still the old version and a half-written temp file remains.
+	err = os.WriteFile(path, stale, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path+".tmp-123", stale[:len(stale)/2], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db = reopenJournaledDB(t, db, path, journalPath)
+
+	got, err := db.GetChirp(chirp.Id)
+	if err != nil {
+		t.Fatalf("chirp not recovered: %s", err)
+	}
+	if got != chirp {
+		t.Errorf("recovered chirp: got %v want %v", got, chirp)
+	}
+	loggedIn, err := db.Login("test@email.com", "testPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loggedIn.IsChirpyRed {
+		t.Error("user update not recovered")
+	}
+	matches, _ := filepath.Glob(path + ".tmp-*")
+	if len(matches) != 0 {
+		t.Errorf("temp files left behind: %v", matches)
+	}
+}
+
+func TestJournalIgnoresTornEntry(t *testing.T) {
+	db, path, journalPath := setupJournaledDB(t)
+
+	user, err := db.CreateUser("test@email.com", "testPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateChirp("first chirp", user.Id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut the last journal entry in half, as if the process died mid-append,
+	// and roll the main file back to before that entry.
+	db.Close()
+	journalContent, err := os.ReadFile(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(journalPath, journalContent[:len(journalContent)-10], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, stale, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db = reopenJournaledDB(t, db, path, journalPath)
+	chirps, _, err := db.GetChirps(ChirpsQuery{Limit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 0 {
+		t.Errorf("torn entry was replayed: got %v", chirps)
+	}
+	_, err = db.Login("test@email.com", "testPassword")
+	if err != nil {
+		t.Errorf("earlier write lost: %s", err)
+	}
+}
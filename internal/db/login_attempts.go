@@ -0,0 +1,308 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/email_address"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+)
+
+// LoginAttempts counts the recent failed logins for an account or for the IP
+// they came from.
+type LoginAttempts struct {
+	Kind          string    `json:"kind"`
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	// No logins are checked before BlockedUntil. Locked is set when that's
+	// because of a lockout rather than a backoff delay.
+	BlockedUntil time.Time `json:"blocked_until"`
+	Locked       bool      `json:"locked"`
+}
+
+const (
+	AttemptsByAccount = "account" // keyed by the email of an existing user
+	AttemptsByIP      = "ip"
+	// Password reset requests are counted apart from logins, keyed the same
+	// way, so asking for resets can't lock anyone out.
+	ResetsByAccount = "reset_account"
+	ResetsByIP      = "reset_ip"
+)
+
+// LoginAttemptKey names a counter of failed logins, and the policy that blocks
+// logins once it's high enough.
+type LoginAttemptKey struct {
+	Kind   string
+	Key    string
+	Policy ThrottlePolicy
+}
+
+// byAccount reports whether attempts of kind are keyed by email.
+func byAccount(kind string) bool {
+	return kind == AttemptsByAccount || kind == ResetsByAccount
+}
+
+// attemptsPruneInterval is how often expired attempts are looked for.
+const attemptsPruneInterval = time.Minute
+
+// Blocked reports whether logins must be refused at now.
+func (attempts LoginAttempts) Blocked(now time.Time) bool {
+	return now.Before(attempts.BlockedUntil)
+}
+
+// ThrottlePolicy decides how long logins are blocked after repeated failures.
+// The zero value never blocks.
+type ThrottlePolicy struct {
+	FreeAttempts int           // failures allowed before any delay
+	BaseDelay    time.Duration // delay after the first failure past FreeAttempts, doubled after each one
+	MaxDelay     time.Duration // caps the delay; 0 means no cap
+	// After LockoutAfter failures logins are locked for LockoutDuration, and
+	// every further failure locks them again. 0 never locks.
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	ResetAfter      time.Duration // failures are forgotten this long after the last one; 0 never forgets
+}
+
+// recordFailure adds a failure at now to attempts and works out how long
+// logins are blocked for.
+func (policy ThrottlePolicy) recordFailure(attempts *LoginAttempts, now time.Time) {
+	if policy.expired(*attempts, now) {
+		attempts.Failures = 0
+	}
+	attempts.Failures++
+	attempts.LastFailureAt = now
+	attempts.Locked = false
+
+	switch {
+	case policy.LockoutAfter > 0 && attempts.Failures >= policy.LockoutAfter:
+		attempts.BlockedUntil = now.Add(policy.LockoutDuration)
+		attempts.Locked = true
+	case policy.BaseDelay > 0 && attempts.Failures > policy.FreeAttempts:
+		delay := policy.BaseDelay << min(attempts.Failures-policy.FreeAttempts-1, 30)
+		if policy.MaxDelay > 0 && (delay > policy.MaxDelay || delay <= 0) {
+			delay = policy.MaxDelay
+		}
+		attempts.BlockedUntil = now.Add(delay)
+	default:
+		attempts.BlockedUntil = time.Time{}
+	}
+}
+
+// expired reports whether attempts can be forgotten at now.
+func (policy ThrottlePolicy) expired(attempts LoginAttempts, now time.Time) bool {
+	return policy.ResetAfter > 0 &&
+		!attempts.Blocked(now) &&
+		now.Sub(attempts.LastFailureAt) > policy.ResetAfter
+}
+
+// release takes back reserved, the attempt ReserveLoginAttempt counted on
+// attempts. Nothing was blocked before it, so the block it caused is lifted
+// too, unless other attempts were counted since.
+func (attempts *LoginAttempts) release(reserved LoginAttempts) {
+	if attempts.Failures == reserved.Failures && attempts.LastFailureAt.Equal(reserved.LastFailureAt) {
+		attempts.BlockedUntil = time.Time{}
+		attempts.Locked = false
+	}
+	attempts.Failures = max(attempts.Failures-1, 0)
+}
+
+func throttledErr(attempts LoginAttempts) error {
+	throttled := ErrLoginThrottled
+	throttled.LogMess = fmt.Sprintf(
+		"too many failed logins for %s %s, blocked until %s",
+		attempts.Kind, attempts.Key, attempts.BlockedUntil.Format(time.RFC3339),
+	)
+	return &throttled
+}
+
+// normalizeAttemptsKey makes every spelling of an email count against the
+// same account.
+func normalizeAttemptsKey(kind string, key string) string {
+	if byAccount(kind) {
+		return email_address.Key(key)
+	}
+	return key
+}
+
+func attemptsKey(kind string, key string) string {
+	return kind + ":" + normalizeAttemptsKey(kind, key)
+}
+
+// newDummyHash hashes a throwaway password the first time it's needed.
+func newDummyHash(hasher encryption.PasswordHasher) func() ([]byte, error) {
+	return sync.OnceValues(func() ([]byte, error) {
+		return hasher.Hash("not the password of any user")
+	})
+}
+
+// rejectUnknownEmail checks pss against the dummy hash, so logins with an
+// unknown email take as long as those with a wrong password.
+func rejectUnknownEmail(hasher encryption.PasswordHasher, dummyHash func() ([]byte, error), pss string) error {
+	hash, err := dummyHash()
+	if err != nil {
+		return err
+	}
+	hasher.Verify(hash, pss)
+	unknownEmail := ErrLoginUnknownEmail
+	return &unknownEmail
+}
+
+func (db *DB) GetLoginAttempts(kind string, key string) (LoginAttempts, error) {
+	current, err := db.snapshot()
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+	attempts, ok := current.data.LoginAttempts[attemptsKey(kind, key)]
+	if !ok {
+		return LoginAttempts{Kind: kind, Key: normalizeAttemptsKey(kind, key)}, nil
+	}
+	return attempts, nil
+}
+
+// RecordLoginFailure counts a failed login against key and returns the
+// attempts, blocked as policy says. Failed logins to emails without an account
+// aren't counted against them, or anyone could fill the database by trying
+// made up ones.
+func (db *DB) RecordLoginFailure(kind string, key string, policy ThrottlePolicy) (LoginAttempts, error) {
+	counted, err := db.countLoginAttempts([]LoginAttemptKey{{kind, key, policy}}, false)
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+	return counted[0], nil
+}
+
+// ReserveLoginAttempts counts a login against every key as failed before its
+// credentials are checked, unless a key is already blocked, in which case it
+// fails with ErrLoginThrottled and counts nothing. Checking and counting at
+// once keeps parallel logins from all getting in before the block. The
+// attempts stay counted unless they're given back to ReleaseLoginAttempts.
+func (db *DB) ReserveLoginAttempts(keys ...LoginAttemptKey) ([]LoginAttempts, error) {
+	return db.countLoginAttempts(keys, true)
+}
+
+func (db *DB) countLoginAttempts(keys []LoginAttemptKey, refuseBlocked bool) ([]LoginAttempts, error) {
+	var counted []LoginAttempts
+	err := db.Update(func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		counted = make([]LoginAttempts, 0, len(keys))
+		for _, key := range keys {
+			db.pruneLoginAttempts(dbStructure, key.Kind, key.Policy, now)
+			attempts := LoginAttempts{Kind: key.Kind, Key: normalizeAttemptsKey(key.Kind, key.Key)}
+			if stored, ok := dbStructure.LoginAttempts[attemptsKey(key.Kind, key.Key)]; ok {
+				attempts = stored
+			}
+			if refuseBlocked && attempts.Blocked(now) {
+				return throttledErr(attempts)
+			}
+			counted = append(counted, attempts)
+		}
+
+		for i, key := range keys {
+			if byAccount(key.Kind) && !emailTaken(dbStructure, key.Key, 0) {
+				counted[i] = LoginAttempts{Kind: key.Kind, Key: counted[i].Key}
+				continue
+			}
+			key.Policy.recordFailure(&counted[i], now)
+			dbStructure.LoginAttempts[attemptsKey(key.Kind, key.Key)] = counted[i]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counted, nil
+}
+
+// pruneLoginAttempts forgets the expired attempts of kind, at most once every
+// attemptsPruneInterval.
+func (db *DB) pruneLoginAttempts(dbStructure *DBStructure, kind string, policy ThrottlePolicy, now time.Time) {
+	if now.Sub(db.attemptsPrunedAt[kind]) <= attemptsPruneInterval {
+		return
+	}
+	if db.attemptsPrunedAt == nil {
+		db.attemptsPrunedAt = map[string]time.Time{}
+	}
+	db.attemptsPrunedAt[kind] = now
+	for stored, attempts := range dbStructure.LoginAttempts {
+		if attempts.Kind == kind && policy.expired(attempts, now) {
+			delete(dbStructure.LoginAttempts, stored)
+		}
+	}
+}
+
+// ReleaseLoginAttempts takes back the attempts ReserveLoginAttempts counted,
+// once they turned out not to have failed, and forgets every failure counted
+// against the keys in clear, as after a successful login.
+func (db *DB) ReleaseLoginAttempts(reserved []LoginAttempts, clear ...LoginAttemptKey) error {
+	current, err := db.snapshot()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for _, attempts := range reserved {
+		changed = changed || attempts.Failures > 0
+	}
+	for _, key := range clear {
+		_, ok := current.data.LoginAttempts[attemptsKey(key.Kind, key.Key)]
+		changed = changed || ok
+	}
+	if !changed {
+		return nil
+	}
+
+	return db.Update(func(dbStructure *DBStructure) error {
+		for _, attempts := range reserved {
+			stored := attemptsKey(attempts.Kind, attempts.Key)
+			latest, ok := dbStructure.LoginAttempts[stored]
+			if attempts.Failures == 0 || !ok {
+				continue
+			}
+			latest.release(attempts)
+			if latest.Failures == 0 {
+				delete(dbStructure.LoginAttempts, stored)
+			} else {
+				dbStructure.LoginAttempts[stored] = latest
+			}
+		}
+		for _, key := range clear {
+			delete(dbStructure.LoginAttempts, attemptsKey(key.Kind, key.Key))
+		}
+		return nil
+	})
+}
+
+func (db *DB) ClearLoginAttempts(kind string, key string) error {
+	current, err := db.snapshot()
+	if err != nil {
+		return err
+	}
+	if _, ok := current.data.LoginAttempts[attemptsKey(kind, key)]; !ok {
+		return nil
+	}
+	return db.Update(func(dbStructure *DBStructure) error {
+		delete(dbStructure.LoginAttempts, attemptsKey(kind, key))
+		return nil
+	})
+}
+
+// UnlockUser forgets the failed logins against a user's account, lifting any
+// lockout. Failures counted against IPs are kept.
+func (db *DB) UnlockUser(id int) (User, error) {
+	var user User
+	err := db.Update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[id]
+		if !ok {
+			err := ErrUserNotExist
+			return &err
+		}
+		delete(dbStructure.LoginAttempts, attemptsKey(AttemptsByAccount, user.Email))
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
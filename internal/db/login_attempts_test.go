@@ -0,0 +1,228 @@
+package db
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+)
+
+func TestThrottlePolicy(t *testing.T) {
+	policy := ThrottlePolicy{
+		FreeAttempts:    2,
+		BaseDelay:       time.Second,
+		MaxDelay:        3 * time.Second,
+		LockoutAfter:    6,
+		LockoutDuration: time.Hour,
+		ResetAfter:      24 * time.Hour,
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		failures int
+		blocked  time.Duration
+		locked   bool
+	}{
+		{1, 0, false},
+		{2, 0, false},
+		{3, time.Second, false},
+		{4, 2 * time.Second, false},
+		{5, 3 * time.Second, false}, // capped by MaxDelay
+		{6, time.Hour, true},
+		{7, time.Hour, true},
+	}
+	attempts := LoginAttempts{}
+	for _, tt := range tests {
+		policy.recordFailure(&attempts, now)
+		if attempts.Failures != tt.failures {
+			t.Fatalf("failures = %d; want %d", attempts.Failures, tt.failures)
+		}
+		var blocked time.Duration
+		if attempts.Blocked(now) {
+			blocked = attempts.BlockedUntil.Sub(now)
+		}
+		if blocked != tt.blocked {
+			t.Errorf("after %d failures blocked for %v; want %v", tt.failures, blocked, tt.blocked)
+		}
+		if attempts.Locked != tt.locked {
+			t.Errorf("after %d failures locked = %v; want %v", tt.failures, attempts.Locked, tt.locked)
+		}
+	}
+
+	later := attempts.BlockedUntil.Add(policy.ResetAfter + time.Second)
+	policy.recordFailure(&attempts, later)
+	if attempts.Failures != 1 || attempts.Blocked(later) {
+		t.Errorf("old failures not forgotten: %+v", attempts)
+	}
+
+	attempts = LoginAttempts{}
+	for range 10 {
+		ThrottlePolicy{}.recordFailure(&attempts, now)
+	}
+	if attempts.Blocked(now) {
+		t.Errorf("zero policy blocked logins: %+v", attempts)
+	}
+}
+
+func TestLoginAttempts(t *testing.T) {
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			store, err := NewStore(driver, filepath.Join(t.TempDir(), "database"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			user, _ := store.CreateUser("test@email.com", "testPassword")
+			_, err = store.Login("unknown@email.com", "testPassword")
+			expectClientErr(t, err, ErrLoginUnknownEmail)
+			_, err = store.Login("test@email.com", "wrongPassword")
+			expectClientErr(t, err, ErrIncorrectPss)
+
+			policy := ThrottlePolicy{LockoutAfter: 2, LockoutDuration: time.Hour}
+			for _, key := range []struct{ kind, key string }{
+				{AttemptsByAccount, "test@email.com"},
+				{AttemptsByAccount, "TEST@email.com"},
+				{AttemptsByAccount, "unknown@email.com"},
+				{AttemptsByIP, "10.0.0.1"},
+			} {
+				_, err = store.RecordLoginFailure(key.kind, key.key, policy)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			now := time.Now()
+			tests := []struct {
+				kind     string
+				key      string
+				failures int
+				blocked  bool
+			}{
+				{AttemptsByAccount, "Test@Email.com", 2, true},
+				{AttemptsByAccount, "unknown@email.com", 0, false},
+				{AttemptsByIP, "10.0.0.1", 1, false},
+				{AttemptsByIP, "10.0.0.2", 0, false},
+			}
+			for _, tt := range tests {
+				attempts, err := store.GetLoginAttempts(tt.kind, tt.key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if attempts.Failures != tt.failures || attempts.Blocked(now) != tt.blocked {
+					t.Errorf("GetLoginAttempts(%q, %q) = %+v; want %d failures, blocked %v",
+						tt.kind, tt.key, attempts, tt.failures, tt.blocked)
+				}
+			}
+
+			_, err = store.UnlockUser(user.Id + 1)
+			expectClientErr(t, err, ErrUserNotExist)
+			_, err = store.UnlockUser(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			attempts, _ := store.GetLoginAttempts(AttemptsByAccount, "test@email.com")
+			if attempts.Failures != 0 || attempts.Blocked(now) {
+				t.Errorf("account still locked after unlock: %+v", attempts)
+			}
+			attempts, _ = store.GetLoginAttempts(AttemptsByIP, "10.0.0.1")
+			if attempts.Failures != 1 {
+				t.Errorf("unlock cleared IP failures: %+v", attempts)
+			}
+
+			err = store.ClearLoginAttempts(AttemptsByIP, "10.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			attempts, _ = store.GetLoginAttempts(AttemptsByIP, "10.0.0.1")
+			if attempts.Failures != 0 {
+				t.Errorf("ClearLoginAttempts() kept %+v", attempts)
+			}
+		})
+	}
+}
+
+func TestReserveLoginAttempts(t *testing.T) {
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			store, err := NewStore(driver, filepath.Join(t.TempDir(), "database"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			store.CreateUser("test@email.com", "testPassword")
+
+			policy := ThrottlePolicy{FreeAttempts: 1, BaseDelay: time.Hour}
+			account := LoginAttemptKey{AttemptsByAccount, "test@email.com", policy}
+			ip := LoginAttemptKey{AttemptsByIP, "10.0.0.1", ThrottlePolicy{FreeAttempts: 3, BaseDelay: time.Hour}}
+			reserve := func() LoginAttempts {
+				t.Helper()
+				reserved, err := store.ReserveLoginAttempts(account)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return reserved[0]
+			}
+			release := func(reserved LoginAttempts) {
+				t.Helper()
+				if err := store.ReleaseLoginAttempts([]LoginAttempts{reserved}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expectKey := func(key LoginAttemptKey, failures int, blocked bool) {
+				t.Helper()
+				attempts, err := store.GetLoginAttempts(key.Kind, key.Key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if attempts.Failures != failures || attempts.Blocked(time.Now()) != blocked {
+					t.Errorf("attempts = %+v; want %d failures, blocked %v", attempts, failures, blocked)
+				}
+			}
+			expect := func(failures int, blocked bool) {
+				t.Helper()
+				expectKey(account, failures, blocked)
+			}
+
+			release(reserve())
+			expect(0, false)
+
+			first := reserve()
+			second := reserve()
+			expect(2, true)
+			// A blocked key counts nothing against the others.
+			_, err = store.ReserveLoginAttempts(ip, account)
+			if clientErr, ok := err.(*api_errors.ClientErr); !ok || !strings.HasPrefix(clientErr.LogMess, ErrLoginThrottled.LogMess) {
+				t.Errorf("ReserveLoginAttempts() while blocked = %v; want %v", err, &ErrLoginThrottled)
+			}
+			expect(2, true)
+			expectKey(ip, 0, false)
+
+			// The block the last attempt caused goes with it...
+			release(second)
+			expect(1, false)
+			// ...but not one caused by an attempt made since.
+			reserve()
+			release(first)
+			expect(1, true)
+
+			unknown := LoginAttemptKey{AttemptsByAccount, "unknown@email.com", policy}
+			reserved, err := store.ReserveLoginAttempts(unknown, ip)
+			if err != nil || reserved[0].Failures != 0 {
+				t.Errorf("ReserveLoginAttempts() for an unknown email = %+v, %v; want nothing counted", reserved, err)
+			}
+			expectKey(ip, 1, false)
+
+			// A successful login releases its attempts and clears the
+			// account at once.
+			err = store.ReleaseLoginAttempts(reserved, account)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expect(0, false)
+			expectKey(ip, 0, false)
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"slices"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/email_address"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+)
+
+// Each migration upgrades a database.json written by an older version of the
+// server and is recorded in DBStructure.SchemaVersion once applied. Append new
+// migrations at the end; never reorder or edit one that has shipped.
+var jsonMigrations = []func(*DBStructure) error{
+	seedSequences,
+	defaultUserRoles,
+	addChirpHistory,
+	addSessions,
+	hashRefreshTokens,
+	addRevokedTokens,
+	checkEmailsUnique,
+	addEmailVerification,
+	addRecoveryCodes,
+	addLoginAttempts,
+	addDeletedChirps,
+}
+
+func (db *DB) migrate() error {
+	current, err := db.snapshot()
+	if err != nil {
+		return err
+	}
+	if current.data.SchemaVersion >= len(jsonMigrations) {
+		return nil
+	}
+
+	return db.Update(func(dbStructure *DBStructure) error {
+		for i := dbStructure.SchemaVersion; i < len(jsonMigrations); i++ {
+			err := jsonMigrations[i](dbStructure)
+			if err != nil {
+				return err
+			}
+			dbStructure.SchemaVersion = i + 1
+		}
+		return nil
+	})
+}
+
+// seedSequences starts each id sequence at the highest id already in use, so
+// files written before sequences existed keep handing out fresh ids.
+func seedSequences(dbStructure *DBStructure) error {
+	dbStructure.Sequences = map[string]int{
+		seqChirps: 0,
+		seqUsers:  0,
+	}
+	for id := range dbStructure.Chirps {
+		dbStructure.Sequences[seqChirps] = max(dbStructure.Sequences[seqChirps], id)
+	}
+	for id := range dbStructure.Users {
+		dbStructure.Sequences[seqUsers] = max(dbStructure.Sequences[seqUsers], id)
+	}
+	return nil
+}
+
+func defaultUserRoles(dbStructure *DBStructure) error {
+	for id, user := range dbStructure.Users {
+		if user.Role == "" {
+			user.Role = RoleUser
+			dbStructure.Users[id] = user
+		}
+	}
+	return nil
+}
+
+func addChirpHistory(dbStructure *DBStructure) error {
+	if dbStructure.ChirpHistory == nil {
+		dbStructure.ChirpHistory = map[int][]ChirpVersion{}
+	}
+	return nil
+}
+
+func addSessions(dbStructure *DBStructure) error {
+	if dbStructure.Sessions == nil {
+		dbStructure.Sessions = map[int]Session{}
+	}
+	return nil
+}
+
+// hashRefreshTokens turns the plaintext refresh token each user had before
+// sessions existed into a session keyed by its digest.
+func hashRefreshTokens(dbStructure *DBStructure) error {
+	now := time.Now().UTC()
+	for userId, user := range dbStructure.Users {
+		if user.RefToken == "" {
+			continue
+		}
+		id := dbStructure.nextId(seqSessions)
+		dbStructure.Sessions[id] = Session{
+			Id:         id,
+			UserId:     userId,
+			TokenHash:  encryption.HashRefToken(user.RefToken),
+			CreatedAt:  now,
+			ExpiresAt:  now.Add(legacySessionTTL),
+			LastUsedAt: now,
+		}
+		user.RefToken = ""
+		dbStructure.Users[userId] = user
+	}
+	return nil
+}
+
+func addRevokedTokens(dbStructure *DBStructure) error {
+	if dbStructure.RevokedTokens == nil {
+		dbStructure.RevokedTokens = map[string]time.Time{}
+	}
+	return nil
+}
+
+// checkEmailsUnique fails if two users have emails that only differ in case,
+// since from now on they'd both match the same login.
+func checkEmailsUnique(dbStructure *DBStructure) error {
+	idsByKey := map[string]int{}
+	ids := make([]int, 0, len(dbStructure.Users))
+	for id := range dbStructure.Users {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		key := email_address.Key(dbStructure.Users[id].Email)
+		if otherId, ok := idsByKey[key]; ok {
+			return duplicateEmailsErr(otherId, id, key)
+		}
+		idsByKey[key] = id
+	}
+	return nil
+}
+
+// addEmailVerification treats every existing account as verified, since they
+// were created before there was a way to verify them.
+func addEmailVerification(dbStructure *DBStructure) error {
+	if dbStructure.UserTokens == nil {
+		dbStructure.UserTokens = map[string]UserToken{}
+	}
+	for id, user := range dbStructure.Users {
+		user.Verified = true
+		dbStructure.Users[id] = user
+	}
+	return nil
+}
+
+func addRecoveryCodes(dbStructure *DBStructure) error {
+	if dbStructure.RecoveryCodes == nil {
+		dbStructure.RecoveryCodes = map[int][]string{}
+	}
+	return nil
+}
+
+func addLoginAttempts(dbStructure *DBStructure) error {
+	if dbStructure.LoginAttempts == nil {
+		dbStructure.LoginAttempts = map[string]LoginAttempts{}
+	}
+	return nil
+}
+
+func addDeletedChirps(dbStructure *DBStructure) error {
+	if dbStructure.DeletedChirps == nil {
+		dbStructure.DeletedChirps = map[int]DeletedChirp{}
+	}
+	return nil
+}
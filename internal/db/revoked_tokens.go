@@ -0,0 +1,27 @@
+package db
+
+import "time"
+
+// RevokeAccessToken denylists the access token jti until it expires, after
+// which it would be rejected anyway and is forgotten.
+func (db *DB) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		now := time.Now().UTC()
+		for revoked, expiry := range dbStructure.RevokedTokens {
+			if !now.Before(expiry) {
+				delete(dbStructure.RevokedTokens, revoked)
+			}
+		}
+		dbStructure.RevokedTokens[jti] = expiresAt.UTC()
+		return nil
+	})
+}
+
+func (db *DB) IsAccessTokenRevoked(jti string) (bool, error) {
+	current, err := db.snapshot()
+	if err != nil {
+		return false, err
+	}
+	_, revoked := current.data.RevokedTokens[jti]
+	return revoked, nil
+}
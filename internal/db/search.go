@@ -0,0 +1,251 @@
+package db
+
+import (
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	SearchByRelevance = "relevance"
+	SearchByRecency   = "recent"
+)
+
+type SearchQuery struct {
+	Text     string
+	AuthorId int    // 0 matches every author
+	SortBy   string // SearchByRelevance or SearchByRecency
+	Limit    int
+}
+
+// BM25 parameters, see https://en.wikipedia.org/wiki/Okapi_BM25
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+type indexedChirp struct {
+	authorId int
+	length   int
+	terms    []string
+}
+
+// searchIndex is an inverted index over chirp bodies. It records the position
+// of every term so phrase queries can be answered without re-reading bodies.
+type searchIndex struct {
+	mux         sync.RWMutex
+	postings    map[string]map[int][]int
+	chirps      map[int]indexedChirp
+	totalLength int
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: map[string]map[int][]int{},
+		chirps:   map[int]indexedChirp{},
+	}
+}
+
+// tokenize splits text into case-folded words. Any rune that isn't a letter
+// or a digit separates words, so punctuation never sticks to a term.
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i, word := range words {
+		words[i] = strings.Map(func(r rune) rune {
+			return unicode.ToLower(unicode.ToUpper(r))
+		}, word)
+	}
+	return words
+}
+
+// parseSearchText splits a query into loose terms and "quoted phrases".
+func parseSearchText(text string) ([]string, [][]string) {
+	terms := []string{}
+	phrases := [][]string{}
+	for i, part := range strings.Split(text, `"`) {
+		tokens := tokenize(part)
+		if i%2 == 1 && len(tokens) > 1 {
+			phrases = append(phrases, tokens)
+		} else {
+			terms = append(terms, tokens...)
+		}
+	}
+	return terms, phrases
+}
+
+func (idx *searchIndex) add(chirp Chirp) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	idx.removeLocked(chirp.Id)
+	tokens := tokenize(chirp.Body)
+	terms := []string{}
+	for pos, token := range tokens {
+		docs, ok := idx.postings[token]
+		if !ok {
+			docs = map[int][]int{}
+			idx.postings[token] = docs
+		}
+		if _, seen := docs[chirp.Id]; !seen {
+			terms = append(terms, token)
+		}
+		docs[chirp.Id] = append(docs[chirp.Id], pos)
+	}
+	idx.chirps[chirp.Id] = indexedChirp{
+		authorId: chirp.AuthorId,
+		length:   len(tokens),
+		terms:    terms,
+	}
+	idx.totalLength += len(tokens)
+}
+
+func (idx *searchIndex) remove(chirpId int) {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+	idx.removeLocked(chirpId)
+}
+
+func (idx *searchIndex) removeLocked(chirpId int) {
+	indexed, ok := idx.chirps[chirpId]
+	if !ok {
+		return
+	}
+	for _, term := range indexed.terms {
+		delete(idx.postings[term], chirpId)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	delete(idx.chirps, chirpId)
+	idx.totalLength -= indexed.length
+}
+
+func (idx *searchIndex) reset() {
+	idx.mux.Lock()
+	defer idx.mux.Unlock()
+
+	idx.postings = map[string]map[int][]int{}
+	idx.chirps = map[int]indexedChirp{}
+	idx.totalLength = 0
+}
+
+// sync brings the index from prev to next, only touching chirps that were
+// created, edited or deleted in between.
+func (idx *searchIndex) sync(prev map[int]Chirp, next map[int]Chirp) {
+	for id, chirp := range next {
+		if old, ok := prev[id]; !ok || old.Body != chirp.Body {
+			idx.add(chirp)
+		}
+	}
+	for id := range prev {
+		if _, ok := next[id]; !ok {
+			idx.remove(id)
+		}
+	}
+}
+
+// search returns the ids of the chirps matching every term and phrase of the
+// query, best match first.
+func (idx *searchIndex) search(query SearchQuery) []int {
+	idx.mux.RLock()
+	defer idx.mux.RUnlock()
+
+	terms, phrases := parseSearchText(query.Text)
+	required := slices.Clone(terms)
+	for _, phrase := range phrases {
+		required = append(required, phrase...)
+	}
+	if len(required) == 0 {
+		return []int{}
+	}
+
+	// Start from the rarest term so the candidate set is as small as possible.
+	slices.SortFunc(required, func(a, b string) int {
+		return len(idx.postings[a]) - len(idx.postings[b])
+	})
+	candidates := []int{}
+	for id := range idx.postings[required[0]] {
+		if query.AuthorId != 0 && idx.chirps[id].authorId != query.AuthorId {
+			continue
+		}
+		if idx.matchesAll(id, required[1:]) && idx.matchesPhrases(id, phrases) {
+			candidates = append(candidates, id)
+		}
+	}
+
+	if query.SortBy == SearchByRecency {
+		slices.SortFunc(candidates, func(a, b int) int { return b - a })
+	} else {
+		scores := make(map[int]float64, len(candidates))
+		for _, id := range candidates {
+			scores[id] = idx.score(id, required)
+		}
+		slices.SortFunc(candidates, func(a, b int) int {
+			if scores[a] != scores[b] {
+				if scores[a] > scores[b] {
+					return -1
+				}
+				return 1
+			}
+			return b - a
+		})
+	}
+
+	if len(candidates) > query.Limit {
+		candidates = candidates[:query.Limit]
+	}
+	return candidates
+}
+
+func (idx *searchIndex) matchesAll(id int, terms []string) bool {
+	for _, term := range terms {
+		if _, ok := idx.postings[term][id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (idx *searchIndex) matchesPhrases(id int, phrases [][]string) bool {
+	for _, phrase := range phrases {
+		found := false
+		for _, start := range idx.postings[phrase[0]][id] {
+			found = true
+			for offset, term := range phrase[1:] {
+				if !slices.Contains(idx.postings[term][id], start+offset+1) {
+					found = false
+					break
+				}
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (idx *searchIndex) score(id int, terms []string) float64 {
+	total := float64(len(idx.chirps))
+	avgLength := float64(idx.totalLength) / total
+	length := float64(idx.chirps[id].length)
+
+	uniqueTerms := slices.Clone(terms)
+	slices.Sort(uniqueTerms)
+	score := 0.0
+	for _, term := range slices.Compact(uniqueTerms) {
+		docs := idx.postings[term]
+		df := float64(len(docs))
+		tf := float64(len(docs[id]))
+		idf := math.Log(1 + (total-df+0.5)/(df+0.5))
+		score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*length/avgLength))
+	}
+	return score
+}
@@ -0,0 +1,115 @@
+package db
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{"empty string", "", []string{}},
+		{"punctuation", "Hello, world! It's here.", []string{"hello", "world", "it", "s", "here"}},
+		{"unicode", "Ünïcode ÇAFÉ naïve", []string{"ünïcode", "çafé", "naïve"}},
+		{"case folding", "KELVIN ſtop", []string{"kelvin", "stop"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := tokenize(tt.input)
+			if !slices.Equal(result, tt.expected) {
+				t.Errorf("tokenize(%s) = %v; want %v", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSearchChirps(t *testing.T) {
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			store, err := NewStore(driver, filepath.Join(t.TempDir(), "database"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			author, _ := store.CreateUser("author@email.com", "testPassword")
+			other, _ := store.CreateUser("other@email.com", "testPassword")
+			bodies := []struct {
+				body     string
+				authorId int
+			}{
+				{"The quick brown fox", author.Id},
+				{"A brown dog and a quick cat", other.Id},
+				{"Fox! Fox! FOX! brown", other.Id},
+				{"Nothing to see here", author.Id},
+				{"quick thinking", author.Id},
+			}
+			for _, b := range bodies {
+				_, err := store.CreateChirp(b.body, b.authorId, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tests := []struct {
+				name  string
+				query SearchQuery
+				ids   []int
+			}{
+				{"single term by relevance", SearchQuery{Text: "fox", Limit: 10}, []int{3, 1}},
+				{"all terms must match", SearchQuery{Text: "brown QUICK", SortBy: SearchByRecency, Limit: 10}, []int{2, 1}},
+				{"phrase", SearchQuery{Text: `"quick brown"`, Limit: 10}, []int{1}},
+				{"phrase and term", SearchQuery{Text: `"brown dog" cat`, Limit: 10}, []int{2}},
+				{"by recency", SearchQuery{Text: "quick", SortBy: SearchByRecency, Limit: 10}, []int{5, 2, 1}},
+				{"by author", SearchQuery{Text: "quick", AuthorId: author.Id, SortBy: SearchByRecency, Limit: 10}, []int{5, 1}},
+				{"limit", SearchQuery{Text: "quick", SortBy: SearchByRecency, Limit: 1}, []int{5}},
+				{"no match", SearchQuery{Text: "elephant", Limit: 10}, []int{}},
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					chirps, err := store.SearchChirps(tt.query)
+					if err != nil {
+						t.Fatal(err)
+					}
+					ids := []int{}
+					for _, chirp := range chirps {
+						ids = append(ids, chirp.Id)
+					}
+					if !slices.Equal(ids, tt.ids) {
+						t.Errorf("SearchChirps(%+v) = %v; want %v", tt.query, ids, tt.ids)
+					}
+				})
+			}
+
+			err = store.DeleteChirp(other.Id, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.UpdateChirp(author.Id, 1, "The slow grey wolf", false, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			chirps, err := store.SearchChirps(SearchQuery{Text: "fox", Limit: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirps) != 0 {
+				t.Errorf("deleted or edited chirps still match: got %v", chirps)
+			}
+			chirps, err = store.SearchChirps(SearchQuery{Text: "wolf", Limit: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirps) != 1 || chirps[0].Id != 1 {
+				t.Errorf("edited chirp not reindexed: got %v", chirps)
+			}
+		})
+	}
+}
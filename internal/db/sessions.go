@@ -0,0 +1,193 @@
+package db
+
+import (
+	"slices"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+)
+
+// rotatedHashesKept is how many of the latest tokens a session replaced are
+// recognised when replayed. Older ones are forgotten, so a long lived session
+// doesn't keep growing.
+const rotatedHashesKept = 16
+
+func (db *DB) CreateSession(
+	userId int, refreshToken string, userAgent string, ip string, ttl time.Duration,
+) (Session, error) {
+	var session Session
+	err := db.Update(func(dbStructure *DBStructure) error {
+		if _, ok := dbStructure.Users[userId]; !ok {
+			err := ErrUserNotExist
+			return &err
+		}
+
+		now := time.Now().UTC()
+		deleteExpiredSessions(dbStructure, now)
+		id := dbStructure.nextId(seqSessions)
+		session = Session{
+			Id:         id,
+			UserId:     userId,
+			TokenHash:  encryption.HashRefToken(refreshToken),
+			UserAgent:  userAgent,
+			IP:         ip,
+			CreatedAt:  now,
+			ExpiresAt:  now.Add(ttl),
+			LastUsedAt: now,
+		}
+		dbStructure.Sessions[id] = session
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+
+	return session, nil
+}
+
+// RotateSession exchanges refreshToken for newRefreshToken and extends the
+// session by ttl. Presenting a token that was already rotated out means it
+// was copied, so the whole session is revoked.
+func (db *DB) RotateSession(refreshToken string, newRefreshToken string, ttl time.Duration) (Session, error) {
+	current, err := db.snapshot()
+	if err != nil {
+		return Session{}, err
+	}
+	hash := encryption.HashRefToken(refreshToken)
+	id, ok := current.sessionsByToken[hash]
+	if !ok {
+		id, ok = current.sessionsByRotated[hash]
+	}
+	if !ok {
+		err := ErrRefTokenInvalid
+		return Session{}, &err
+	}
+
+	var session Session
+	var failure *api_errors.ClientErr
+	err = db.Update(func(dbStructure *DBStructure) error {
+		var ok bool
+		session, ok = dbStructure.Sessions[id]
+		if !ok {
+			err := ErrRefTokenInvalid
+			return &err
+		}
+
+		now := time.Now().UTC()
+		if !encryption.RefTokenHashesEqual(session.TokenHash, hash) {
+			delete(dbStructure.Sessions, id)
+			err := ErrRefTokenReused
+			failure = &err
+			return nil
+		}
+		if !now.Before(session.ExpiresAt) {
+			delete(dbStructure.Sessions, id)
+			err := ErrRefTokenInvalid
+			failure = &err
+			return nil
+		}
+
+		rotated := append(slices.Clip(session.RotatedHashes), session.TokenHash)
+		session.RotatedHashes = rotated[max(len(rotated)-rotatedHashesKept, 0):]
+		session.TokenHash = encryption.HashRefToken(newRefreshToken)
+		session.LastUsedAt = now
+		session.ExpiresAt = now.Add(ttl)
+		dbStructure.Sessions[id] = session
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	if failure != nil {
+		return Session{}, failure
+	}
+
+	return session, nil
+}
+
+func (db *DB) RevokeSession(refreshToken string) error {
+	return db.revokeSession(refreshToken, func(Session) bool { return true })
+}
+
+// RevokeUserSession revokes the session refreshToken belongs to, as long as
+// it's one of the user's.
+func (db *DB) RevokeUserSession(userId int, refreshToken string) error {
+	return db.revokeSession(refreshToken, func(session Session) bool { return session.UserId == userId })
+}
+
+func (db *DB) revokeSession(refreshToken string, owned func(Session) bool) error {
+	current, err := db.snapshot()
+	if err != nil {
+		return err
+	}
+	hash := encryption.HashRefToken(refreshToken)
+	id, ok := current.sessionsByToken[hash]
+	if !ok {
+		err := ErrRefTokenInvalid
+		return &err
+	}
+
+	return db.Update(func(dbStructure *DBStructure) error {
+		session, ok := dbStructure.Sessions[id]
+		if !ok || !encryption.RefTokenHashesEqual(session.TokenHash, hash) || !owned(session) {
+			err := ErrRefTokenInvalid
+			return &err
+		}
+		delete(dbStructure.Sessions, id)
+		return nil
+	})
+}
+
+// GetSessions returns the user's unexpired sessions, oldest first.
+func (db *DB) GetSessions(userId int) ([]Session, error) {
+	current, err := db.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	sessions := []Session{}
+	for _, id := range current.sessionsByUser[userId] {
+		session := current.data.Sessions[id]
+		if now.Before(session.ExpiresAt) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (db *DB) DeleteSession(userId int, sessionId int) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		session, ok := dbStructure.Sessions[sessionId]
+		if !ok || session.UserId != userId {
+			err := ErrSessionNotFound
+			return &err
+		}
+		delete(dbStructure.Sessions, sessionId)
+		return nil
+	})
+}
+
+func (db *DB) DeleteSessions(userId int) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		deleteUserSessions(dbStructure, userId)
+		return nil
+	})
+}
+
+func deleteUserSessions(dbStructure *DBStructure, userId int) {
+	for id, session := range dbStructure.Sessions {
+		if session.UserId == userId {
+			delete(dbStructure.Sessions, id)
+		}
+	}
+}
+
+func deleteExpiredSessions(dbStructure *DBStructure, now time.Time) {
+	for id, session := range dbStructure.Sessions {
+		if !now.Before(session.ExpiresAt) {
+			delete(dbStructure.Sessions, id)
+		}
+	}
+}
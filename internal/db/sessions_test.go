@@ -0,0 +1,292 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+)
+
+func expectClientErr(t *testing.T, err error, expected api_errors.ClientErr) {
+	t.Helper()
+	clientErr, ok := err.(*api_errors.ClientErr)
+	if !ok || clientErr.HttpCode != expected.HttpCode || clientErr.LogMess != expected.LogMess {
+		t.Errorf("got error %v; want %v", err, &expected)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			store, err := NewStore(driver, filepath.Join(t.TempDir(), "database"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			user, _ := store.CreateUser("test@email.com", "testPassword")
+			other, _ := store.CreateUser("other@email.com", "testPassword")
+
+			laptop, err := store.CreateSession(user.Id, "laptop-1", "laptop", "10.0.0.1", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			phone, err := store.CreateSession(user.Id, "phone-1", "phone", "10.0.0.2", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if laptop.TokenHash == "laptop-1" {
+				t.Error("refresh token stored in plaintext")
+			}
+
+			// Logging in on the phone doesn't affect the laptop.
+			rotated, err := store.RotateSession("laptop-1", "laptop-2", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rotated.Id != laptop.Id || rotated.UserId != user.Id {
+				t.Errorf("rotated the wrong session: got %+v", rotated)
+			}
+			_, err = store.RotateSession("unknown", "unknown-2", time.Hour)
+			expectClientErr(t, err, ErrRefTokenInvalid)
+
+			// Replaying the rotated out token revokes the laptop session, so
+			// even its latest token stops working.
+			_, err = store.RotateSession("laptop-1", "laptop-3", time.Hour)
+			expectClientErr(t, err, ErrRefTokenReused)
+			_, err = store.RotateSession("laptop-2", "laptop-3", time.Hour)
+			expectClientErr(t, err, ErrRefTokenInvalid)
+
+			sessions, err := store.GetSessions(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 1 || sessions[0].Id != phone.Id || sessions[0].UserAgent != "phone" {
+				t.Errorf("GetSessions() = %+v; want only the phone session", sessions)
+			}
+
+			err = store.DeleteSession(other.Id, phone.Id)
+			expectClientErr(t, err, ErrSessionNotFound)
+			err = store.DeleteSession(user.Id, phone.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.RotateSession("phone-1", "phone-2", time.Hour)
+			expectClientErr(t, err, ErrRefTokenInvalid)
+
+			_, err = store.CreateSession(user.Id, "expired-1", "tablet", "10.0.0.3", -time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.RotateSession("expired-1", "expired-2", time.Hour)
+			expectClientErr(t, err, ErrRefTokenInvalid)
+
+			_, err = store.CreateSession(user.Id, "revoked-1", "tablet", "10.0.0.3", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.RevokeSession("revoked-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.RevokeSession("revoked-1")
+			expectClientErr(t, err, ErrRefTokenInvalid)
+
+			_, err = store.CreateSession(user.Id, "logged-out-1", "tablet", "10.0.0.3", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.RevokeUserSession(other.Id, "logged-out-1")
+			expectClientErr(t, err, ErrRefTokenInvalid)
+			err = store.RevokeUserSession(user.Id, "logged-out-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sessions, err = store.GetSessions(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 0 {
+				t.Errorf("GetSessions() = %+v; want none", sessions)
+			}
+		})
+	}
+}
+
+func TestRotatedHashesCapped(t *testing.T) {
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			store, err := NewStore(driver, filepath.Join(t.TempDir(), "database"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			user, _ := store.CreateUser("test@email.com", "testPassword")
+			_, err = store.CreateSession(user.Id, "token-0", "laptop", "10.0.0.1", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rotations := rotatedHashesKept + 2
+			for i := range rotations {
+				_, err = store.RotateSession(fmt.Sprintf("token-%d", i), fmt.Sprintf("token-%d", i+1), time.Hour)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The oldest tokens are forgotten rather than kept forever...
+			_, err = store.RotateSession("token-0", "replayed", time.Hour)
+			expectClientErr(t, err, ErrRefTokenInvalid)
+			sessions, _ := store.GetSessions(user.Id)
+			if len(sessions) != 1 {
+				t.Fatalf("forgotten token revoked the session: %+v", sessions)
+			}
+			if driver == "json" && len(sessions[0].RotatedHashes) != rotatedHashesKept {
+				t.Errorf("kept %d rotated hashes; want %d", len(sessions[0].RotatedHashes), rotatedHashesKept)
+			}
+			// ...but recent ones are still recognised when replayed.
+			_, err = store.RotateSession(fmt.Sprintf("token-%d", rotations-1), "replayed", time.Hour)
+			expectClientErr(t, err, ErrRefTokenReused)
+		})
+	}
+}
+
+func TestLegacyRefreshTokensMigrated(t *testing.T) {
+	t.Run("json", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "database.json")
+		legacy := `{
+			"schema_version": 4,
+			"sequences": {"chirps": 0, "users": 1},
+			"chirps": {},
+			"chirp_history": {},
+			"sessions": {},
+			"users": {
+				"1": {"id": 1, "email": "test@email.com", "role": "user", "refresh_token": "legacy-token"}
+			}
+		}`
+		err := os.WriteFile(path, []byte(legacy), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := NewDB(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(content), "legacy-token") {
+			t.Errorf("plaintext refresh token still stored: %s", content)
+		}
+		session, err := db.RotateSession("legacy-token", "new-token", time.Hour)
+		if err != nil {
+			t.Fatalf("legacy token rejected: %s", err)
+		}
+		if session.UserId != 1 {
+			t.Errorf("migrated session user: got %d want 1", session.UserId)
+		}
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "database.db")
+		conn, err := sql.Open("sqlite3", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Bring the schema up to the version before refresh tokens were hashed.
+		for _, migration := range sqliteMigrations[:6] {
+			tx, err := conn.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = migration(tx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tx.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = conn.Exec(`PRAGMA user_version = 6;
+		INSERT INTO users (email, pss_hash, refresh_token) VALUES ('test@email.com', '', 'legacy-token');`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		db, err := NewSQLiteDB(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		session, err := db.RotateSession("legacy-token", "new-token", time.Hour)
+		if err != nil {
+			t.Fatalf("legacy token rejected: %s", err)
+		}
+		if session.UserId != 1 {
+			t.Errorf("migrated session user: got %d want 1", session.UserId)
+		}
+	})
+}
+
+func TestRevokeAccessToken(t *testing.T) {
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			store, err := NewStore(driver, filepath.Join(t.TempDir(), "database"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			err = store.RevokeAccessToken("expired", time.Now().Add(-time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.RevokeAccessToken("live", time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				jti     string
+				revoked bool
+			}{
+				{"live", true},
+				{"expired", false}, // pruned when "live" was added
+				{"never-revoked", false},
+			}
+			for _, tt := range tests {
+				revoked, err := store.IsAccessTokenRevoked(tt.jti)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if revoked != tt.revoked {
+					t.Errorf("IsAccessTokenRevoked(%q) = %v; want %v", tt.jti, revoked, tt.revoked)
+				}
+			}
+
+			user, _ := store.CreateUser("test@email.com", "testPassword")
+			before := time.Now().UTC().Truncate(time.Second)
+			updated, err := store.UpdateUser(user.Id, user.Email, "newPassword")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated.TokensValidAfter.Before(before) {
+				t.Errorf("TokensValidAfter not bumped: got %v want at least %v", updated.TokensValidAfter, before)
+			}
+		})
+	}
+}
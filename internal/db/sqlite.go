@@ -0,0 +1,233 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type SQLiteDB struct {
+	path   string
+	conn   *sql.DB
+	search *searchIndex
+	hasher encryption.PasswordHasher
+	// dummyHash is checked instead of a user's when Login is given an unknown
+	// email, so it takes as long as a wrong password.
+	dummyHash func() ([]byte, error)
+}
+
+// Each entry is applied once, in order, and recorded in PRAGMA user_version.
+// Never edit an entry that has shipped: append a new one instead.
+var sqliteMigrations = []func(tx *sql.Tx) error{
+	execSQL(`CREATE TABLE users (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		email         TEXT    NOT NULL UNIQUE,
+		pss_hash      BLOB    NOT NULL,
+		refresh_token TEXT    NOT NULL DEFAULT '',
+		is_chirpy_red INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX users_refresh_token ON users (refresh_token);
+	CREATE TABLE chirps (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		body      TEXT    NOT NULL,
+		author_id INTEGER NOT NULL REFERENCES users (id)
+	);
+	CREATE INDEX chirps_author_id ON chirps (author_id);`),
+	execSQL(`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';`),
+	execSQL(`ALTER TABLE users ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	ALTER TABLE users ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	ALTER TABLE chirps ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	ALTER TABLE chirps ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	CREATE TABLE chirp_versions (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		chirp_id    INTEGER   NOT NULL REFERENCES chirps (id) ON DELETE CASCADE,
+		body        TEXT      NOT NULL,
+		created_at  TIMESTAMP NOT NULL,
+		replaced_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX chirp_versions_chirp_id ON chirp_versions (chirp_id);`),
+	execSQL(`ALTER TABLE chirps ADD COLUMN flagged INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX chirps_flagged ON chirps (id) WHERE flagged = 1;`),
+	execSQL(`ALTER TABLE users ADD COLUMN banned INTEGER NOT NULL DEFAULT 0;`),
+	execSQL(`CREATE TABLE sessions (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id      INTEGER   NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		token_hash   TEXT      NOT NULL UNIQUE,
+		user_agent   TEXT      NOT NULL,
+		ip           TEXT      NOT NULL,
+		created_at   TIMESTAMP NOT NULL,
+		expires_at   TIMESTAMP NOT NULL,
+		last_used_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX sessions_user_id ON sessions (user_id);
+	CREATE TABLE session_rotated_tokens (
+		token_hash TEXT    PRIMARY KEY,
+		session_id INTEGER NOT NULL REFERENCES sessions (id) ON DELETE CASCADE
+	);`),
+	sqliteHashRefreshTokens,
+	execSQL(`ALTER TABLE users ADD COLUMN tokens_valid_after TIMESTAMP NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	CREATE TABLE revoked_tokens (
+		jti        TEXT      PRIMARY KEY,
+		expires_at TIMESTAMP NOT NULL
+	);`),
+	sqliteAddEmailKeys,
+	// Existing accounts predate email verification, so they count as verified.
+	execSQL(`ALTER TABLE users ADD COLUMN verified INTEGER NOT NULL DEFAULT 0;
+	UPDATE users SET verified = 1;
+	CREATE TABLE user_tokens (
+		token_hash TEXT      PRIMARY KEY,
+		user_id    INTEGER   NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		purpose    TEXT      NOT NULL,
+		email      TEXT      NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX user_tokens_user_id ON user_tokens (user_id, purpose);`),
+	execSQL(`ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE recovery_codes (
+		user_id   INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		code_hash TEXT    NOT NULL,
+		PRIMARY KEY (user_id, code_hash)
+	);`),
+	execSQL(`CREATE TABLE login_attempts (
+		kind            TEXT      NOT NULL,
+		key             TEXT      NOT NULL,
+		failures        INTEGER   NOT NULL,
+		last_failure_at TIMESTAMP NOT NULL,
+		blocked_until   TIMESTAMP NOT NULL,
+		locked          INTEGER   NOT NULL,
+		PRIMARY KEY (kind, key)
+	);`),
+	// chirp_versions is rebuilt without its foreign key, so history outlives
+	// deleted chirps.
+	execSQL(`CREATE TABLE deleted_chirps (
+		id         INTEGER   PRIMARY KEY,
+		author_id  INTEGER   NOT NULL,
+		deleted_by INTEGER   NOT NULL,
+		deleted_at TIMESTAMP NOT NULL
+	);
+	CREATE TABLE chirp_versions_kept (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		chirp_id    INTEGER   NOT NULL,
+		body        TEXT      NOT NULL,
+		created_at  TIMESTAMP NOT NULL,
+		replaced_at TIMESTAMP NOT NULL
+	);
+	INSERT INTO chirp_versions_kept SELECT id, chirp_id, body, created_at, replaced_at FROM chirp_versions;
+	DROP TABLE chirp_versions;
+	ALTER TABLE chirp_versions_kept RENAME TO chirp_versions;
+	CREATE INDEX chirp_versions_chirp_id ON chirp_versions (chirp_id);`),
+	execSQL(`ALTER TABLE user_tokens ADD COLUMN failures INTEGER NOT NULL DEFAULT 0;`),
+	// Expired attempts are pruned on every failure.
+	execSQL(`CREATE INDEX login_attempts_last_failure_at ON login_attempts (kind, last_failure_at);`),
+}
+
+func execSQL(statements string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+func NewSQLiteDB(path string, opts ...Option) (*SQLiteDB, error) {
+	dsn := fmt.Sprintf(
+		"file:%s?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate",
+		path,
+	)
+	conn, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	dbOpts := newOptions(opts)
+	db := &SQLiteDB{
+		path:      path,
+		conn:      conn,
+		search:    newSearchIndex(),
+		hasher:    dbOpts.hasher,
+		dummyHash: newDummyHash(dbOpts.hasher),
+	}
+	err = db.migrate()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	err = db.buildSearchIndex()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (db *SQLiteDB) migrate() error {
+	var version int
+	err := db.conn.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return err
+		}
+		err = sqliteMigrations[i](tx)
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", i+1, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *SQLiteDB) Close() error {
+	return db.conn.Close()
+}
+
+func (db *SQLiteDB) RemoveDB() error {
+	db.conn.Close()
+	for _, path := range []string{db.path, db.path + "-wal", db.path + "-shm"} {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("Failed to delete database: %v", err)
+		}
+	}
+	return nil
+}
+
+// withTx runs fn inside a write transaction, committing only if fn succeeds.
+func (db *SQLiteDB) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// rowQuerier is a *sql.DB or a *sql.Tx.
+type rowQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
@@ -0,0 +1,307 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+const chirpColumns = "id, body, author_id, flagged, created_at, updated_at"
+
+func scanChirp(row rowScanner) (Chirp, error) {
+	chirp := Chirp{}
+	err := row.Scan(
+		&chirp.Id, &chirp.Body, &chirp.AuthorId, &chirp.Flagged, &chirp.CreatedAt, &chirp.UpdatedAt,
+	)
+	return chirp, err
+}
+
+func (db *SQLiteDB) queryChirps(query string, args ...any) ([]Chirp, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return nil, err
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, rows.Err()
+}
+
+func (db *SQLiteDB) GetChirps(query ChirpsQuery) ([]Chirp, bool, error) {
+	where := "1 = 1"
+	args := []any{}
+	if query.AuthorId != 0 {
+		where += " AND author_id = ?"
+		args = append(args, query.AuthorId)
+	}
+	if query.Flagged {
+		where += " AND flagged = 1"
+	}
+	order := "ASC"
+	if query.SortBy == "desc" {
+		order = "DESC"
+		if query.AfterId != 0 {
+			where += " AND id < ?"
+			args = append(args, query.AfterId)
+		}
+	} else if query.AfterId != 0 {
+		where += " AND id > ?"
+		args = append(args, query.AfterId)
+	}
+	args = append(args, query.Limit+1)
+
+	chirps, err := db.queryChirps(
+		"SELECT "+chirpColumns+" FROM chirps WHERE "+where+" ORDER BY id "+order+" LIMIT ?",
+		args...,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	hasMore := len(chirps) > query.Limit
+	if hasMore {
+		chirps = chirps[:query.Limit]
+	}
+	return chirps, hasMore, nil
+}
+
+// The search index lives in memory and is kept up to date by this process's
+// writes, so it won't see chirps written to the file by anyone else.
+func (db *SQLiteDB) buildSearchIndex() error {
+	chirps, err := db.queryChirps("SELECT " + chirpColumns + " FROM chirps")
+	if err != nil {
+		return err
+	}
+	for _, chirp := range chirps {
+		db.search.add(chirp)
+	}
+	return nil
+}
+
+func (db *SQLiteDB) SearchChirps(query SearchQuery) ([]Chirp, error) {
+	ids := db.search.search(query)
+	if len(ids) == 0 {
+		return []Chirp{}, nil
+	}
+
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	placeholders := strings.Repeat("?, ", len(ids)-1) + "?"
+	found, err := db.queryChirps(
+		"SELECT "+chirpColumns+" FROM chirps WHERE id IN ("+placeholders+")",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	byId := make(map[int]Chirp, len(found))
+	for _, chirp := range found {
+		byId[chirp.Id] = chirp
+	}
+	chirps := make([]Chirp, 0, len(ids))
+	for _, id := range ids {
+		if chirp, ok := byId[id]; ok {
+			chirps = append(chirps, chirp)
+		}
+	}
+	return chirps, nil
+}
+
+func (db *SQLiteDB) GetChirp(chirpID int) (Chirp, error) {
+	chirp, err := scanChirp(db.conn.QueryRow(
+		"SELECT "+chirpColumns+" FROM chirps WHERE id = ?",
+		chirpID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		chirpNotFound := ErrChirpNotFound
+		return Chirp{}, &chirpNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+func (db *SQLiteDB) CreateChirp(body string, authorId int, flagged bool) (Chirp, error) {
+	now := time.Now().UTC()
+	res, err := db.conn.Exec(
+		"INSERT INTO chirps (body, author_id, flagged, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+		body, authorId, flagged, now, now,
+	)
+	if err != nil {
+		return Chirp{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	chirp := Chirp{
+		Id:        int(id),
+		Body:      body,
+		AuthorId:  authorId,
+		Flagged:   flagged,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	db.search.add(chirp)
+	return chirp, nil
+}
+
+func (db *SQLiteDB) DeleteChirp(userId int, chirpId int) error {
+	err := db.withTx(func(tx *sql.Tx) error {
+		chirp, err := scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", chirpId))
+		if errors.Is(err, sql.ErrNoRows) {
+			err := ErrChirpNotFound
+			return &err
+		}
+		if err != nil {
+			return err
+		}
+		err = sqliteCheckChirpAccess(tx, userId, chirp.AuthorId)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		_, err = tx.Exec(
+			"INSERT INTO chirp_versions (chirp_id, body, created_at, replaced_at) VALUES (?, ?, ?, ?)",
+			chirpId, chirp.Body, chirp.UpdatedAt, now,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"INSERT INTO deleted_chirps (id, author_id, deleted_by, deleted_at) VALUES (?, ?, ?, ?)",
+			chirpId, chirp.AuthorId, userId, now,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM chirps WHERE id = ?", chirpId)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	db.search.remove(chirpId)
+	return nil
+}
+
+func (db *SQLiteDB) UpdateChirp(userId int, chirpId int, body string, flagged bool, editWindow time.Duration) (Chirp, error) {
+	var chirp Chirp
+	err := db.withTx(func(tx *sql.Tx) error {
+		var err error
+		chirp, err = scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", chirpId))
+		if errors.Is(err, sql.ErrNoRows) {
+			err := ErrChirpNotFound
+			return &err
+		}
+		if err != nil {
+			return err
+		}
+		if chirp.AuthorId != userId {
+			err := ErrChirpForbidden
+			return &err
+		}
+		now := time.Now().UTC()
+		if now.Sub(chirp.CreatedAt) > editWindow {
+			err := ErrChirpEditWindow
+			return &err
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO chirp_versions (chirp_id, body, created_at, replaced_at) VALUES (?, ?, ?, ?)",
+			chirpId, chirp.Body, chirp.UpdatedAt, now,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"UPDATE chirps SET body = ?, flagged = ?, updated_at = ? WHERE id = ?",
+			body, flagged, now, chirpId,
+		)
+		if err != nil {
+			return err
+		}
+		chirp.Body = body
+		chirp.Flagged = flagged
+		chirp.UpdatedAt = now
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	db.search.add(chirp)
+	return chirp, nil
+}
+
+// sqliteCheckChirpAccess allows userId to act on a chirp by authorId if they
+// wrote it or are a moderator.
+func sqliteCheckChirpAccess(q rowQuerier, userId int, authorId int) error {
+	if authorId == userId {
+		return nil
+	}
+	var role string
+	err := q.QueryRow("SELECT role FROM users WHERE id = ?", userId).Scan(&role)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if !canModerate(role) {
+		err := ErrChirpForbidden
+		return &err
+	}
+	return nil
+}
+
+func (db *SQLiteDB) GetChirpHistory(userId int, chirpId int) ([]ChirpVersion, error) {
+	var authorId int
+	err := db.conn.QueryRow(
+		"SELECT author_id FROM chirps WHERE id = ? UNION ALL SELECT author_id FROM deleted_chirps WHERE id = ?",
+		chirpId, chirpId,
+	).Scan(&authorId)
+	if errors.Is(err, sql.ErrNoRows) {
+		chirpNotFound := ErrChirpNotFound
+		return nil, &chirpNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = sqliteCheckChirpAccess(db.conn, userId, authorId)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.Query(
+		"SELECT body, created_at, replaced_at FROM chirp_versions WHERE chirp_id = ? ORDER BY id",
+		chirpId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []ChirpVersion{}
+	for rows.Next() {
+		version := ChirpVersion{}
+		err := rows.Scan(&version.Body, &version.CreatedAt, &version.ReplacedAt)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	loginAttemptsColumns = "kind, key, failures, last_failure_at, blocked_until, locked"
+	selectLoginAttempts  = "SELECT " + loginAttemptsColumns + " FROM login_attempts WHERE kind = ? AND key = ?"
+)
+
+// scanLoginAttempts reads the attempts selected for kind and key, which are
+// empty when nothing failed yet.
+func scanLoginAttempts(row rowScanner, kind string, key string) (LoginAttempts, error) {
+	attempts := LoginAttempts{}
+	err := row.Scan(
+		&attempts.Kind, &attempts.Key, &attempts.Failures,
+		&attempts.LastFailureAt, &attempts.BlockedUntil, &attempts.Locked,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return LoginAttempts{Kind: kind, Key: key}, nil
+	}
+	return attempts, err
+}
+
+func (db *SQLiteDB) GetLoginAttempts(kind string, key string) (LoginAttempts, error) {
+	key = normalizeAttemptsKey(kind, key)
+	return scanLoginAttempts(db.conn.QueryRow(selectLoginAttempts, kind, key), kind, key)
+}
+
+func (db *SQLiteDB) RecordLoginFailure(kind string, key string, policy ThrottlePolicy) (LoginAttempts, error) {
+	counted, err := db.countLoginAttempts([]LoginAttemptKey{{kind, key, policy}}, false)
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+	return counted[0], nil
+}
+
+func (db *SQLiteDB) ReserveLoginAttempts(keys ...LoginAttemptKey) ([]LoginAttempts, error) {
+	return db.countLoginAttempts(keys, true)
+}
+
+func (db *SQLiteDB) countLoginAttempts(keys []LoginAttemptKey, refuseBlocked bool) ([]LoginAttempts, error) {
+	var counted []LoginAttempts
+	err := db.withTx(func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		counted = make([]LoginAttempts, 0, len(keys))
+		for _, key := range keys {
+			if key.Policy.ResetAfter > 0 {
+				_, err := tx.Exec(
+					"DELETE FROM login_attempts WHERE kind = ? AND last_failure_at < ? AND blocked_until <= ?",
+					key.Kind, now.Add(-key.Policy.ResetAfter), now,
+				)
+				if err != nil {
+					return err
+				}
+			}
+			normalized := normalizeAttemptsKey(key.Kind, key.Key)
+			attempts, err := scanLoginAttempts(tx.QueryRow(selectLoginAttempts, key.Kind, normalized), key.Kind, normalized)
+			if err != nil {
+				return err
+			}
+			if refuseBlocked && attempts.Blocked(now) {
+				return throttledErr(attempts)
+			}
+			counted = append(counted, attempts)
+		}
+
+		for i, key := range keys {
+			if byAccount(key.Kind) {
+				var registered bool
+				err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE email_key = ?)", counted[i].Key).Scan(&registered)
+				if err != nil {
+					return err
+				}
+				if !registered {
+					counted[i] = LoginAttempts{Kind: key.Kind, Key: counted[i].Key}
+					continue
+				}
+			}
+			key.Policy.recordFailure(&counted[i], now)
+			if err := sqliteSaveLoginAttempts(tx, counted[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counted, nil
+}
+
+func (db *SQLiteDB) ReleaseLoginAttempts(reserved []LoginAttempts, clear ...LoginAttemptKey) error {
+	return db.withTx(func(tx *sql.Tx) error {
+		for _, reservedAttempts := range reserved {
+			if reservedAttempts.Failures == 0 {
+				continue
+			}
+			attempts, err := scanLoginAttempts(
+				tx.QueryRow(selectLoginAttempts, reservedAttempts.Kind, reservedAttempts.Key),
+				reservedAttempts.Kind, reservedAttempts.Key,
+			)
+			if err != nil {
+				return err
+			}
+			if attempts.Failures == 0 {
+				continue
+			}
+			attempts.release(reservedAttempts)
+			if attempts.Failures == 0 {
+				_, err = tx.Exec("DELETE FROM login_attempts WHERE kind = ? AND key = ?", attempts.Kind, attempts.Key)
+			} else {
+				err = sqliteSaveLoginAttempts(tx, attempts)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, key := range clear {
+			_, err := tx.Exec(
+				"DELETE FROM login_attempts WHERE kind = ? AND key = ?", key.Kind, normalizeAttemptsKey(key.Kind, key.Key),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func sqliteSaveLoginAttempts(tx *sql.Tx, attempts LoginAttempts) error {
+	_, err := tx.Exec(
+		"INSERT OR REPLACE INTO login_attempts ("+loginAttemptsColumns+") VALUES (?, ?, ?, ?, ?, ?)",
+		attempts.Kind, attempts.Key, attempts.Failures,
+		attempts.LastFailureAt.UTC(), attempts.BlockedUntil.UTC(), attempts.Locked,
+	)
+	return err
+}
+
+func (db *SQLiteDB) ClearLoginAttempts(kind string, key string) error {
+	_, err := db.conn.Exec(
+		"DELETE FROM login_attempts WHERE kind = ? AND key = ?", kind, normalizeAttemptsKey(kind, key),
+	)
+	return err
+}
+
+func (db *SQLiteDB) UnlockUser(id int) (User, error) {
+	var user User
+	err := db.withTx(func(tx *sql.Tx) error {
+		var err error
+		user, err = scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"DELETE FROM login_attempts WHERE kind = ? AND key = ?",
+			AttemptsByAccount, normalizeAttemptsKey(AttemptsByAccount, user.Email),
+		)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
@@ -0,0 +1,26 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+func (db *SQLiteDB) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	return db.withTx(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM revoked_tokens WHERE expires_at <= ?", time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"INSERT OR REPLACE INTO revoked_tokens (jti, expires_at) VALUES (?, ?)",
+			jti, expiresAt.UTC(),
+		)
+		return err
+	})
+}
+
+func (db *SQLiteDB) IsAccessTokenRevoked(jti string) (bool, error) {
+	var revoked bool
+	err := db.conn.QueryRow("SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = ?)", jti).Scan(&revoked)
+	return revoked, err
+}
@@ -0,0 +1,262 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+)
+
+const sessionColumns = "id, user_id, token_hash, user_agent, ip, created_at, expires_at, last_used_at"
+
+func scanSession(row rowScanner) (Session, error) {
+	session := Session{}
+	err := row.Scan(
+		&session.Id, &session.UserId, &session.TokenHash, &session.UserAgent, &session.IP,
+		&session.CreatedAt, &session.ExpiresAt, &session.LastUsedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		sessionNotFound := ErrSessionNotFound
+		return Session{}, &sessionNotFound
+	}
+	return session, err
+}
+
+func (db *SQLiteDB) CreateSession(
+	userId int, refreshToken string, userAgent string, ip string, ttl time.Duration,
+) (Session, error) {
+	var session Session
+	err := db.withTx(func(tx *sql.Tx) error {
+		now := time.Now().UTC()
+		_, err := tx.Exec("DELETE FROM sessions WHERE expires_at <= ?", now)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.Exec(
+			`INSERT INTO sessions (user_id, token_hash, user_agent, ip, created_at, expires_at, last_used_at)
+			SELECT id, ?, ?, ?, ?, ?, ? FROM users WHERE id = ?`,
+			encryption.HashRefToken(refreshToken), userAgent, ip, now, now.Add(ttl), now, userId,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			err := ErrUserNotExist
+			return &err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		session, err = scanSession(tx.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE id = ?", id))
+		return err
+	})
+	if err != nil {
+		return Session{}, err
+	}
+
+	return session, nil
+}
+
+func (db *SQLiteDB) RotateSession(refreshToken string, newRefreshToken string, ttl time.Duration) (Session, error) {
+	hash := encryption.HashRefToken(refreshToken)
+	var session Session
+	var failure *api_errors.ClientErr
+	err := db.withTx(func(tx *sql.Tx) error {
+		var sessionId int
+		err := tx.QueryRow("SELECT id FROM sessions WHERE token_hash = ?", hash).Scan(&sessionId)
+		if errors.Is(err, sql.ErrNoRows) {
+			reused, err := revokeRotatedSession(tx, hash)
+			if err != nil {
+				return err
+			}
+			if reused {
+				reusedErr := ErrRefTokenReused
+				failure = &reusedErr
+				return nil
+			}
+			invalid := ErrRefTokenInvalid
+			return &invalid
+		}
+		if err != nil {
+			return err
+		}
+		session, err = scanSession(tx.QueryRow(
+			"SELECT "+sessionColumns+" FROM sessions WHERE id = ?", sessionId,
+		))
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if !now.Before(session.ExpiresAt) {
+			expired := ErrRefTokenInvalid
+			failure = &expired
+			_, err := tx.Exec("DELETE FROM sessions WHERE id = ?", session.Id)
+			return err
+		}
+
+		_, err = tx.Exec(
+			"INSERT INTO session_rotated_tokens (token_hash, session_id) VALUES (?, ?)",
+			hash, session.Id,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			`DELETE FROM session_rotated_tokens WHERE session_id = ? AND rowid NOT IN (
+				SELECT rowid FROM session_rotated_tokens WHERE session_id = ? ORDER BY rowid DESC LIMIT ?
+			)`,
+			session.Id, session.Id, rotatedHashesKept,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			"UPDATE sessions SET token_hash = ?, last_used_at = ?, expires_at = ? WHERE id = ?",
+			encryption.HashRefToken(newRefreshToken), now, now.Add(ttl), session.Id,
+		)
+		if err != nil {
+			return err
+		}
+
+		session, err = scanSession(tx.QueryRow(
+			"SELECT "+sessionColumns+" FROM sessions WHERE id = ?", session.Id,
+		))
+		return err
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	if failure != nil {
+		return Session{}, failure
+	}
+
+	return session, nil
+}
+
+// revokeRotatedSession deletes the session hash was rotated out of, if any.
+func revokeRotatedSession(tx *sql.Tx, hash string) (bool, error) {
+	var sessionId int
+	err := tx.QueryRow(
+		"SELECT session_id FROM session_rotated_tokens WHERE token_hash = ?", hash,
+	).Scan(&sessionId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec("DELETE FROM sessions WHERE id = ?", sessionId)
+	return err == nil, err
+}
+
+func (db *SQLiteDB) RevokeSession(refreshToken string) error {
+	return sqliteRevokeSessions(db.conn.Exec(
+		"DELETE FROM sessions WHERE token_hash = ?",
+		encryption.HashRefToken(refreshToken),
+	))
+}
+
+func (db *SQLiteDB) RevokeUserSession(userId int, refreshToken string) error {
+	return sqliteRevokeSessions(db.conn.Exec(
+		"DELETE FROM sessions WHERE token_hash = ? AND user_id = ?",
+		encryption.HashRefToken(refreshToken), userId,
+	))
+}
+
+// sqliteRevokeSessions fails with ErrRefTokenInvalid when no session was
+// deleted.
+func sqliteRevokeSessions(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err := ErrRefTokenInvalid
+		return &err
+	}
+	return nil
+}
+
+func (db *SQLiteDB) GetSessions(userId int) ([]Session, error) {
+	rows, err := db.conn.Query(
+		"SELECT "+sessionColumns+" FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY id",
+		userId, time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (db *SQLiteDB) DeleteSession(userId int, sessionId int) error {
+	res, err := db.conn.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", sessionId, userId)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err := ErrSessionNotFound
+		return &err
+	}
+	return nil
+}
+
+func (db *SQLiteDB) DeleteSessions(userId int) error {
+	_, err := db.conn.Exec("DELETE FROM sessions WHERE user_id = ?", userId)
+	return err
+}
+
+// sqliteHashRefreshTokens moves the plaintext refresh tokens stored on users
+// before sessions existed into sessions keyed by their digest.
+func sqliteHashRefreshTokens(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, refresh_token FROM users WHERE refresh_token != ''")
+	if err != nil {
+		return err
+	}
+	tokens := map[int]string{}
+	for rows.Next() {
+		var userId int
+		var refreshToken string
+		err := rows.Scan(&userId, &refreshToken)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tokens[userId] = refreshToken
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for userId, refreshToken := range tokens {
+		_, err := tx.Exec(
+			`INSERT INTO sessions (user_id, token_hash, user_agent, ip, created_at, expires_at, last_used_at)
+			VALUES (?, ?, '', '', ?, ?, ?)`,
+			userId, encryption.HashRefToken(refreshToken), now, now.Add(legacySessionTTL), now,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`DROP INDEX users_refresh_token;
+	ALTER TABLE users DROP COLUMN refresh_token;`)
+	return err
+}
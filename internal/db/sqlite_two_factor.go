@@ -0,0 +1,196 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+)
+
+func sqliteCheckSecondFactor(tx *sql.Tx, user *User, code string) (bool, error) {
+	if user.TOTPSecret == "" {
+		return false, nil
+	}
+	step, ok := encryption.ValidateTOTP(user.TOTPSecret, code, time.Now())
+	if ok {
+		if step <= user.TOTPLastStep {
+			return false, nil
+		}
+		user.TOTPLastStep = step
+		_, err := tx.Exec("UPDATE users SET totp_last_step = ? WHERE id = ?", step, user.Id)
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	res, err := tx.Exec(
+		"DELETE FROM recovery_codes WHERE user_id = ? AND code_hash = ?",
+		user.Id, encryption.HashRecoveryCode(code),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (db *SQLiteDB) EnrollTOTP(userId int, secret string) error {
+	return db.withTx(func(tx *sql.Tx) error {
+		user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userId))
+		if err != nil {
+			return err
+		}
+		if user.TOTPEnabled {
+			err := ErrTOTPAlrEnabled
+			return &err
+		}
+		_, err = tx.Exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?", secret, userId)
+		return err
+	})
+}
+
+func (db *SQLiteDB) ConfirmTOTP(userId int, code string, recoveryCodes []string) (User, error) {
+	var user User
+	err := db.withTx(func(tx *sql.Tx) error {
+		var err error
+		user, err = scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userId))
+		if err != nil {
+			return err
+		}
+		if user.TOTPEnabled {
+			err := ErrTOTPAlrEnabled
+			return &err
+		}
+		if user.TOTPSecret == "" {
+			err := ErrTOTPNotEnrolled
+			return &err
+		}
+		step, ok := encryption.ValidateTOTP(user.TOTPSecret, code, time.Now())
+		if !ok || step <= user.TOTPLastStep {
+			err := ErrSecondFactorInvalid
+			return &err
+		}
+
+		_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userId)
+		if err != nil {
+			return err
+		}
+		for _, recoveryCode := range recoveryCodes {
+			_, err := tx.Exec(
+				"INSERT OR IGNORE INTO recovery_codes (user_id, code_hash) VALUES (?, ?)",
+				userId, encryption.HashRecoveryCode(recoveryCode),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.UpdatedAt = time.Now().UTC()
+		_, err = tx.Exec(
+			"UPDATE users SET totp_enabled = 1, totp_last_step = ?, updated_at = ? WHERE id = ?",
+			step, user.UpdatedAt, userId,
+		)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (db *SQLiteDB) DisableTOTP(userId int, code string) error {
+	return db.withTx(func(tx *sql.Tx) error {
+		user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userId))
+		if err != nil {
+			return err
+		}
+		if !user.TOTPEnabled {
+			err := ErrTOTPNotEnrolled
+			return &err
+		}
+		ok, err := sqliteCheckSecondFactor(tx, &user, code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			err := ErrSecondFactorInvalid
+			return &err
+		}
+		_, err = tx.Exec(
+			"UPDATE users SET totp_secret = '', totp_enabled = 0, totp_last_step = 0, updated_at = ? WHERE id = ?",
+			time.Now().UTC(), userId,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userId)
+		return err
+	})
+}
+
+func (db *SQLiteDB) CreateLoginChallenge(userId int, token string, ttl time.Duration) error {
+	return db.withTx(func(tx *sql.Tx) error {
+		user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userId))
+		if err != nil {
+			return err
+		}
+		return sqliteIssueUserToken(tx, user, TokenPurposeLoginChallenge, token, ttl)
+	})
+}
+
+func (db *SQLiteDB) CompleteLoginChallenge(token string, code string) (User, error) {
+	var user User
+	var failure error
+	err := db.withTx(func(tx *sql.Tx) error {
+		hash := encryption.HashOneTimeToken(token)
+		var failures int
+		var expiresAt time.Time
+		err := tx.QueryRow(
+			"SELECT failures, expires_at FROM user_tokens WHERE token_hash = ? AND purpose = ?",
+			hash, TokenPurposeLoginChallenge,
+		).Scan(&failures, &expiresAt)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		var ok bool
+		user, ok, err = sqliteConsumeUserToken(tx, TokenPurposeLoginChallenge, token)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			err := ErrLoginChallengeInvalid
+			return &err
+		}
+		ok, err = sqliteCheckSecondFactor(tx, &user, code)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			invalid := ErrLoginCodeInvalid
+			failure = &invalid
+			if failures+1 >= MaxLoginChallengeFailures {
+				return nil
+			}
+			_, err = tx.Exec(
+				"INSERT INTO user_tokens (token_hash, user_id, purpose, email, expires_at, failures) VALUES (?, ?, ?, ?, ?, ?)",
+				hash, user.Id, TokenPurposeLoginChallenge, user.Email, expiresAt, failures+1,
+			)
+			return err
+		}
+		if user.Banned {
+			err := ErrUserBanned
+			return &err
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	if failure != nil {
+		return user, failure
+	}
+	return user, nil
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/email_address"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+)
+
+func sqliteIssueUserToken(tx *sql.Tx, user User, purpose string, token string, ttl time.Duration) error {
+	now := time.Now().UTC()
+	_, err := tx.Exec(
+		"DELETE FROM user_tokens WHERE expires_at <= ? OR (user_id = ? AND purpose = ?)",
+		now, user.Id, purpose,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO user_tokens (token_hash, user_id, purpose, email, expires_at) VALUES (?, ?, ?, ?, ?)",
+		encryption.HashOneTimeToken(token), user.Id, purpose, user.Email, now.Add(ttl),
+	)
+	return err
+}
+
+func sqliteConsumeUserToken(tx *sql.Tx, purpose string, token string) (User, bool, error) {
+	hash := encryption.HashOneTimeToken(token)
+	var userId int
+	var email string
+	var expiresAt time.Time
+	err := tx.QueryRow(
+		"SELECT user_id, email, expires_at FROM user_tokens WHERE token_hash = ? AND purpose = ?",
+		hash, purpose,
+	).Scan(&userId, &email, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, false, nil
+	}
+	if err != nil {
+		return User{}, false, err
+	}
+	_, err = tx.Exec("DELETE FROM user_tokens WHERE token_hash = ?", hash)
+	if err != nil {
+		return User{}, false, err
+	}
+
+	user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userId))
+	if err != nil {
+		return User{}, false, err
+	}
+	if !time.Now().Before(expiresAt) || email_address.Key(user.Email) != email_address.Key(email) {
+		return User{}, false, nil
+	}
+	return user, true, nil
+}
+
+func (db *SQLiteDB) CreateVerificationToken(userId int, token string, ttl time.Duration) error {
+	return db.withTx(func(tx *sql.Tx) error {
+		user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userId))
+		if err != nil {
+			return err
+		}
+		if user.Verified {
+			err := ErrEmailAlrVerified
+			return &err
+		}
+		return sqliteIssueUserToken(tx, user, TokenPurposeVerifyEmail, token, ttl)
+	})
+}
+
+func (db *SQLiteDB) VerifyEmail(token string) (User, error) {
+	var user User
+	err := db.withTx(func(tx *sql.Tx) error {
+		var ok bool
+		var err error
+		user, ok, err = sqliteConsumeUserToken(tx, TokenPurposeVerifyEmail, token)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			err := ErrVerificationTokenInvalid
+			return &err
+		}
+		user.Verified = true
+		user.UpdatedAt = time.Now().UTC()
+		_, err = tx.Exec(
+			"UPDATE users SET verified = 1, updated_at = ? WHERE id = ?",
+			user.UpdatedAt, user.Id,
+		)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (db *SQLiteDB) CreatePasswordResetToken(email string, token string, ttl time.Duration) (User, error) {
+	var user User
+	err := db.withTx(func(tx *sql.Tx) error {
+		var err error
+		user, err = scanUser(tx.QueryRow(
+			"SELECT "+userColumns+" FROM users WHERE email_key = ?", email_address.Key(email),
+		))
+		if err != nil {
+			return err
+		}
+		return sqliteIssueUserToken(tx, user, TokenPurposeResetPassword, token, ttl)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (db *SQLiteDB) ResetPassword(token string, newPss string) (User, error) {
+	newPssHash, err := db.hasher.Hash(newPss)
+	if err != nil {
+		return User{}, err
+	}
+
+	var user User
+	err = db.withTx(func(tx *sql.Tx) error {
+		var ok bool
+		var err error
+		user, ok, err = sqliteConsumeUserToken(tx, TokenPurposeResetPassword, token)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			err := ErrResetTokenInvalid
+			return &err
+		}
+		now := time.Now().UTC()
+		user.PssHash = newPssHash
+		user.Verified = true
+		user.UpdatedAt = now
+		user.TokensValidAfter = now
+		_, err = tx.Exec(
+			"UPDATE users SET pss_hash = ?, verified = 1, updated_at = ?, tokens_valid_after = ? WHERE id = ?",
+			user.PssHash, user.UpdatedAt, user.TokensValidAfter, user.Id,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", user.Id)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
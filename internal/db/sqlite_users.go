@@ -0,0 +1,336 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+	"github.com/ajaen4/go-standard-lib-api/pkg/email_address"
+)
+
+const userColumns = "id, email, pss_hash, is_chirpy_red, role, banned, verified, created_at, updated_at, tokens_valid_after, " +
+	"totp_secret, totp_enabled, totp_last_step"
+
+func scanUser(row rowScanner) (User, error) {
+	user := User{}
+	err := row.Scan(
+		&user.Id, &user.Email, &user.PssHash, &user.IsChirpyRed, &user.Role, &user.Banned, &user.Verified,
+		&user.CreatedAt, &user.UpdatedAt, &user.TokensValidAfter,
+		&user.TOTPSecret, &user.TOTPEnabled, &user.TOTPLastStep,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		userNotExist := ErrUserNotExist
+		return User{}, &userNotExist
+	}
+	return user, err
+}
+
+func (db *SQLiteDB) GetUser(id int) (User, error) {
+	return scanUser(db.conn.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+}
+
+func (db *SQLiteDB) CreateUser(email string, pss string) (User, error) {
+	pssHash, err := db.hasher.Hash(pss)
+	if err != nil {
+		return User{}, err
+	}
+
+	now := time.Now().UTC()
+	newUser := User{
+		Email:     email,
+		PssHash:   pssHash,
+		Role:      RoleUser,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	err = db.withTx(func(tx *sql.Tx) error {
+		var exists bool
+		err := tx.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM users WHERE email_key = ?)", email_address.Key(email),
+		).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			err := ErrUserAlrExist
+			return &err
+		}
+
+		res, err := tx.Exec(
+			"INSERT INTO users (email, email_key, pss_hash, role, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+			email, email_address.Key(email), pssHash, RoleUser, now, now,
+		)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		newUser.Id = int(id)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return newUser, nil
+}
+
+func (db *SQLiteDB) UpdateUser(id int, newEmail string, newPss string) (User, error) {
+	return db.PatchUser(id, UserPatch{Email: &newEmail, Password: &newPss})
+}
+
+func (db *SQLiteDB) PatchUser(id int, patch UserPatch) (User, error) {
+	newPssHash, err := patch.hashPassword(db.hasher)
+	if err != nil {
+		return User{}, err
+	}
+
+	var user User
+	err = db.withTx(func(tx *sql.Tx) error {
+		var err error
+		user, err = scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+		if err != nil {
+			return err
+		}
+		if patch.Email != nil {
+			var taken bool
+			err := tx.QueryRow(
+				"SELECT EXISTS (SELECT 1 FROM users WHERE email_key = ? AND id != ?)",
+				email_address.Key(*patch.Email), id,
+			).Scan(&taken)
+			if err != nil {
+				return err
+			}
+			if taken {
+				err := ErrUserAlrExist
+				return &err
+			}
+		}
+
+		patch.apply(&user, newPssHash, time.Now().UTC())
+		_, err = tx.Exec(
+			`UPDATE users SET email = ?, email_key = ?, pss_hash = ?, verified = ?, updated_at = ?, tokens_valid_after = ?
+			WHERE id = ?`,
+			user.Email, email_address.Key(user.Email), user.PssHash, user.Verified,
+			user.UpdatedAt, user.TokensValidAfter, id,
+		)
+		if err != nil || newPssHash == nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", id)
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (db *SQLiteDB) CheckPassword(id int, pss string) error {
+	user, err := db.GetUser(id)
+	if err != nil {
+		return err
+	}
+	return checkCurrentPassword(db.hasher, user, pss)
+}
+
+func (db *SQLiteDB) EmailRegistered(email string) (bool, error) {
+	var registered bool
+	err := db.conn.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM users WHERE email_key = ?)", email_address.Key(email),
+	).Scan(&registered)
+	return registered, err
+}
+
+func (db *SQLiteDB) Login(email string, pss string) (User, error) {
+	user, err := scanUser(db.conn.QueryRow(
+		"SELECT "+userColumns+" FROM users WHERE email_key = ?", email_address.Key(email),
+	))
+	var clientErr *api_errors.ClientErr
+	if errors.As(err, &clientErr) && clientErr.Message == ErrUserNotExist.Message {
+		return User{}, rejectUnknownEmail(db.hasher, db.dummyHash, pss)
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	ok, needsRehash, err := db.hasher.Verify(user.PssHash, pss)
+	if err != nil {
+		return User{}, err
+	}
+	if !ok {
+		incPss := ErrIncorrectPss
+		return User{}, &incPss
+	}
+	if user.Banned {
+		err := ErrUserBanned
+		return User{}, &err
+	}
+	if needsRehash {
+		err = db.rehashPassword(&user, pss)
+		if err != nil {
+			log.Printf("Error rehashing password of user %d: %s", user.Id, err)
+		}
+	}
+	return user, nil
+}
+
+// rehashPassword replaces user's hash with one made by the current hasher,
+// unless the password was changed since user was read.
+func (db *SQLiteDB) rehashPassword(user *User, pss string) error {
+	newPssHash, err := db.hasher.Hash(pss)
+	if err != nil {
+		return err
+	}
+	res, err := db.conn.Exec(
+		"UPDATE users SET pss_hash = ? WHERE id = ? AND pss_hash = ?",
+		newPssHash, user.Id, user.PssHash,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		user.PssHash = newPssHash
+	}
+	return nil
+}
+
+func (db *SQLiteDB) UserChirpyRed(userId int) error {
+	res, err := db.conn.Exec(
+		"UPDATE users SET is_chirpy_red = 1, updated_at = ? WHERE id = ?",
+		time.Now().UTC(), userId,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		err := ErrUserNotExist
+		return &err
+	}
+	return nil
+}
+
+func (db *SQLiteDB) ListUsers() ([]User, error) {
+	rows, err := db.conn.Query("SELECT " + userColumns + " FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (db *SQLiteDB) SetUserRole(id int, role string) (User, error) {
+	if !ValidRole(role) {
+		err := ErrInvalidRole
+		return User{}, &err
+	}
+
+	var user User
+	err := db.withTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(
+			"UPDATE users SET role = ?, updated_at = ? WHERE id = ?",
+			role, time.Now().UTC(), id,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			err := ErrUserNotExist
+			return &err
+		}
+
+		user, err = scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (db *SQLiteDB) SetUserBanned(id int, banned bool) (User, error) {
+	var user User
+	err := db.withTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(
+			"UPDATE users SET banned = ?, updated_at = ? WHERE id = ?",
+			banned, time.Now().UTC(), id,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			err := ErrUserNotExist
+			return &err
+		}
+		if banned {
+			_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", id)
+			if err != nil {
+				return err
+			}
+		}
+
+		user, err = scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// sqliteAddEmailKeys adds the column users are looked up by, their email in
+// the case-insensitive form of email_address.Key. SQLite's lower() only
+// folds ASCII, so keys are computed here rather than in SQL.
+func sqliteAddEmailKeys(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE users ADD COLUMN email_key TEXT")
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT id, email FROM users ORDER BY id")
+	if err != nil {
+		return err
+	}
+	idsByKey := map[string]int{}
+	for rows.Next() {
+		var id int
+		var email string
+		err := rows.Scan(&id, &email)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		key := email_address.Key(email)
+		if otherId, ok := idsByKey[key]; ok {
+			rows.Close()
+			return duplicateEmailsErr(otherId, id, key)
+		}
+		idsByKey[key] = id
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for key, id := range idsByKey {
+		_, err := tx.Exec("UPDATE users SET email_key = ? WHERE id = ?", key, id)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("CREATE UNIQUE INDEX users_email_key ON users (email_key)")
+	return err
+}
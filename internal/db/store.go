@@ -0,0 +1,73 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+type Store interface {
+	GetChirps(query ChirpsQuery) ([]Chirp, bool, error)
+	SearchChirps(query SearchQuery) ([]Chirp, error)
+	GetChirp(chirpID int) (Chirp, error)
+	CreateChirp(body string, authorId int, flagged bool) (Chirp, error)
+	DeleteChirp(userId int, chirpId int) error
+	UpdateChirp(userId int, chirpId int, body string, flagged bool, editWindow time.Duration) (Chirp, error)
+	GetChirpHistory(userId int, chirpId int) ([]ChirpVersion, error)
+
+	GetUser(id int) (User, error)
+	CreateUser(email string, pss string) (User, error)
+	UpdateUser(id int, newEmail string, newPss string) (User, error)
+	PatchUser(id int, patch UserPatch) (User, error)
+	CheckPassword(id int, pss string) error
+	EmailRegistered(email string) (bool, error)
+	Login(email string, pss string) (User, error)
+	UserChirpyRed(userId int) error
+	ListUsers() ([]User, error)
+	SetUserRole(id int, role string) (User, error)
+	SetUserBanned(id int, banned bool) (User, error)
+	CreateVerificationToken(userId int, token string, ttl time.Duration) error
+	VerifyEmail(token string) (User, error)
+	CreatePasswordResetToken(email string, token string, ttl time.Duration) (User, error)
+	ResetPassword(token string, newPss string) (User, error)
+
+	GetLoginAttempts(kind string, key string) (LoginAttempts, error)
+	RecordLoginFailure(kind string, key string, policy ThrottlePolicy) (LoginAttempts, error)
+	ReserveLoginAttempts(keys ...LoginAttemptKey) ([]LoginAttempts, error)
+	ReleaseLoginAttempts(reserved []LoginAttempts, clear ...LoginAttemptKey) error
+	ClearLoginAttempts(kind string, key string) error
+	UnlockUser(id int) (User, error)
+
+	EnrollTOTP(userId int, secret string) error
+	ConfirmTOTP(userId int, code string, recoveryCodes []string) (User, error)
+	DisableTOTP(userId int, code string) error
+	CreateLoginChallenge(userId int, token string, ttl time.Duration) error
+	CompleteLoginChallenge(token string, code string) (User, error)
+
+	CreateSession(userId int, refreshToken string, userAgent string, ip string, ttl time.Duration) (Session, error)
+	RotateSession(refreshToken string, newRefreshToken string, ttl time.Duration) (Session, error)
+	RevokeSession(refreshToken string) error
+	RevokeUserSession(userId int, refreshToken string) error
+	GetSessions(userId int) ([]Session, error)
+	DeleteSession(userId int, sessionId int) error
+	DeleteSessions(userId int) error
+
+	RevokeAccessToken(jti string, expiresAt time.Time) error
+	IsAccessTokenRevoked(jti string) (bool, error)
+
+	RemoveDB() error
+	Close() error
+}
+
+var _ Store = (*DB)(nil)
+var _ Store = (*SQLiteDB)(nil)
+
+func NewStore(driver string, path string, opts ...Option) (Store, error) {
+	switch driver {
+	case "json":
+		return NewDB(path, opts...)
+	case "sqlite":
+		return NewSQLiteDB(path, opts...)
+	default:
+		return nil, fmt.Errorf("unknown store driver: %s", driver)
+	}
+}
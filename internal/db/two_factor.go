@@ -0,0 +1,186 @@
+package db
+
+import (
+	"slices"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+)
+
+// checkSecondFactor accepts either a TOTP code newer than the last one used
+// or one of the user's recovery codes, which is then used up. It records
+// what it accepted on user, which the caller must store.
+func checkSecondFactor(dbStructure *DBStructure, user *User, code string) bool {
+	if user.TOTPSecret == "" {
+		return false
+	}
+	step, ok := encryption.ValidateTOTP(user.TOTPSecret, code, time.Now())
+	if ok && step > user.TOTPLastStep {
+		user.TOTPLastStep = step
+		return true
+	}
+	if ok {
+		return false
+	}
+
+	hash := encryption.HashRecoveryCode(code)
+	codes := dbStructure.RecoveryCodes[user.Id]
+	index := slices.IndexFunc(codes, func(stored string) bool {
+		return encryption.RefTokenHashesEqual(stored, hash)
+	})
+	if index < 0 {
+		return false
+	}
+	dbStructure.RecoveryCodes[user.Id] = slices.Delete(slices.Clone(codes), index, index+1)
+	return true
+}
+
+// EnrollTOTP gives the user a new TOTP secret, which they have to prove
+// they've added to their authenticator with ConfirmTOTP before it's enabled.
+func (db *DB) EnrollTOTP(userId int, secret string) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userId]
+		if !ok {
+			err := ErrUserNotExist
+			return &err
+		}
+		if user.TOTPEnabled {
+			err := ErrTOTPAlrEnabled
+			return &err
+		}
+		user.TOTPSecret = secret
+		user.TOTPLastStep = 0
+		dbStructure.Users[userId] = user
+		return nil
+	})
+}
+
+// ConfirmTOTP enables two-factor authentication once code shows the user's
+// authenticator has the secret from EnrollTOTP, and replaces their recovery
+// codes with recoveryCodes.
+func (db *DB) ConfirmTOTP(userId int, code string, recoveryCodes []string) (User, error) {
+	var user User
+	err := db.Update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[userId]
+		if !ok {
+			err := ErrUserNotExist
+			return &err
+		}
+		if user.TOTPEnabled {
+			err := ErrTOTPAlrEnabled
+			return &err
+		}
+		if user.TOTPSecret == "" {
+			err := ErrTOTPNotEnrolled
+			return &err
+		}
+		step, ok := encryption.ValidateTOTP(user.TOTPSecret, code, time.Now())
+		if !ok || step <= user.TOTPLastStep {
+			err := ErrSecondFactorInvalid
+			return &err
+		}
+
+		hashes := make([]string, 0, len(recoveryCodes))
+		for _, recoveryCode := range recoveryCodes {
+			hashes = append(hashes, encryption.HashRecoveryCode(recoveryCode))
+		}
+		dbStructure.RecoveryCodes[userId] = hashes
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.UpdatedAt = time.Now().UTC()
+		dbStructure.Users[userId] = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// DisableTOTP turns two-factor authentication off, which takes a current
+// code or a recovery code.
+func (db *DB) DisableTOTP(userId int, code string) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userId]
+		if !ok {
+			err := ErrUserNotExist
+			return &err
+		}
+		if !user.TOTPEnabled {
+			err := ErrTOTPNotEnrolled
+			return &err
+		}
+		if !checkSecondFactor(dbStructure, &user, code) {
+			err := ErrSecondFactorInvalid
+			return &err
+		}
+		user.TOTPSecret = ""
+		user.TOTPEnabled = false
+		user.TOTPLastStep = 0
+		user.UpdatedAt = time.Now().UTC()
+		dbStructure.Users[userId] = user
+		delete(dbStructure.RecoveryCodes, userId)
+		return nil
+	})
+}
+
+// CreateLoginChallenge stores the token a user who passed the password step
+// of login exchanges, along with a second factor, in CompleteLoginChallenge.
+func (db *DB) CreateLoginChallenge(userId int, token string, ttl time.Duration) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userId]
+		if !ok {
+			err := ErrUserNotExist
+			return &err
+		}
+		issueUserToken(dbStructure, user, TokenPurposeLoginChallenge, token, ttl)
+		return nil
+	})
+}
+
+// MaxLoginChallengeFailures is how many wrong codes a login challenge takes
+// before it's used up, so codes can't be guessed until it expires.
+const MaxLoginChallengeFailures = 5
+
+// CompleteLoginChallenge returns the user token was issued to if code is a
+// valid second factor for them, using the challenge up. A wrong code counts
+// against the challenge, which is used up after MaxLoginChallengeFailures,
+// and fails with ErrLoginCodeInvalid and the user, so the caller can count it
+// against their account too.
+func (db *DB) CompleteLoginChallenge(token string, code string) (User, error) {
+	var user User
+	var failure error
+	err := db.Update(func(dbStructure *DBStructure) error {
+		hash := encryption.HashOneTimeToken(token)
+		challenge := dbStructure.UserTokens[hash]
+		var ok bool
+		user, ok = consumeUserToken(dbStructure, TokenPurposeLoginChallenge, token)
+		if !ok {
+			err := ErrLoginChallengeInvalid
+			return &err
+		}
+		if !checkSecondFactor(dbStructure, &user, code) {
+			challenge.Failures++
+			if challenge.Failures < MaxLoginChallengeFailures {
+				dbStructure.UserTokens[hash] = challenge
+			}
+			err := ErrLoginCodeInvalid
+			failure = &err
+			return nil
+		}
+		if user.Banned {
+			err := ErrUserBanned
+			return &err
+		}
+		dbStructure.Users[user.Id] = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	if failure != nil {
+		return user, failure
+	}
+	return user, nil
+}
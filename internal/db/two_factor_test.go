@@ -0,0 +1,109 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+)
+
+func TestTwoFactor(t *testing.T) {
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			store, err := NewStore(driver, filepath.Join(t.TempDir(), "database"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			secret, _ := encryption.GenerateTOTPSecret()
+			step := encryption.TOTPStep(time.Now())
+			code := func(step int64) string {
+				code, _ := encryption.TOTPCode(secret, step)
+				return code
+			}
+			user, _ := store.CreateUser("test@email.com", "testPassword")
+
+			_, err = store.ConfirmTOTP(user.Id, code(step), nil)
+			expectClientErr(t, err, ErrTOTPNotEnrolled)
+			err = store.EnrollTOTP(user.Id, secret)
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, _ = store.GetUser(user.Id)
+			if user.TOTPEnabled {
+				t.Fatal("TOTP enabled before being confirmed")
+			}
+			_, err = store.ConfirmTOTP(user.Id, "000000", nil)
+			expectClientErr(t, err, ErrSecondFactorInvalid)
+			user, err = store.ConfirmTOTP(user.Id, code(step), []string{"aaaa-bbbb", "cccc-dddd"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !user.TOTPEnabled {
+				t.Fatal("TOTP not enabled after confirming")
+			}
+			err = store.EnrollTOTP(user.Id, secret)
+			expectClientErr(t, err, ErrTOTPAlrEnabled)
+
+			err = store.CreateLoginChallenge(user.Id, "challenge", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CompleteLoginChallenge("unknown", code(step+1))
+			expectClientErr(t, err, ErrLoginChallengeInvalid)
+			wrongCode, err := store.CompleteLoginChallenge("challenge", code(step))
+			expectClientErr(t, err, ErrLoginCodeInvalid) // replayed from confirming
+			if wrongCode.Id != user.Id {
+				t.Errorf("CompleteLoginChallenge() with a wrong code returned user %d; want %d", wrongCode.Id, user.Id)
+			}
+			loggedIn, err := store.CompleteLoginChallenge("challenge", code(step+1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loggedIn.Id != user.Id {
+				t.Errorf("CompleteLoginChallenge() user = %d; want %d", loggedIn.Id, user.Id)
+			}
+			_, err = store.CompleteLoginChallenge("challenge", code(step+1))
+			expectClientErr(t, err, ErrLoginChallengeInvalid)
+
+			err = store.CreateLoginChallenge(user.Id, "second-challenge", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CompleteLoginChallenge("second-challenge", "AAAA BBBB")
+			if err != nil {
+				t.Fatalf("recovery code rejected: %v", err)
+			}
+			err = store.CreateLoginChallenge(user.Id, "third-challenge", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CompleteLoginChallenge("third-challenge", "aaaa-bbbb")
+			expectClientErr(t, err, ErrLoginCodeInvalid)
+
+			err = store.CreateLoginChallenge(user.Id, "guessed-challenge", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for range MaxLoginChallengeFailures {
+				_, err = store.CompleteLoginChallenge("guessed-challenge", "000000")
+				expectClientErr(t, err, ErrLoginCodeInvalid)
+			}
+			_, err = store.CompleteLoginChallenge("guessed-challenge", code(step+2))
+			expectClientErr(t, err, ErrLoginChallengeInvalid)
+
+			err = store.DisableTOTP(user.Id, code(step+1))
+			expectClientErr(t, err, ErrSecondFactorInvalid) // replayed from logging in
+			err = store.DisableTOTP(user.Id, "cccc-dddd")
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, _ = store.GetUser(user.Id)
+			if user.TOTPEnabled || user.TOTPSecret != "" {
+				t.Errorf("TOTP still set up after disabling: %+v", user)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package db
+
+import (
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/email_address"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+)
+
+// issueUserToken stores token for user, replacing any token it was sent
+// earlier for the same purpose, and forgets expired tokens.
+func issueUserToken(dbStructure *DBStructure, user User, purpose string, token string, ttl time.Duration) {
+	now := time.Now().UTC()
+	for hash, userToken := range dbStructure.UserTokens {
+		if !now.Before(userToken.ExpiresAt) || userToken.UserId == user.Id && userToken.Purpose == purpose {
+			delete(dbStructure.UserTokens, hash)
+		}
+	}
+	dbStructure.UserTokens[encryption.HashOneTimeToken(token)] = UserToken{
+		UserId:    user.Id,
+		Purpose:   purpose,
+		Email:     user.Email,
+		ExpiresAt: now.Add(ttl),
+	}
+}
+
+// consumeUserToken deletes token and returns the user it was issued to, as
+// long as it was issued for purpose, hasn't expired and was sent to the
+// user's current email.
+func consumeUserToken(dbStructure *DBStructure, purpose string, token string) (User, bool) {
+	hash := encryption.HashOneTimeToken(token)
+	userToken, ok := dbStructure.UserTokens[hash]
+	if !ok || userToken.Purpose != purpose {
+		return User{}, false
+	}
+	delete(dbStructure.UserTokens, hash)
+
+	user, ok := dbStructure.Users[userToken.UserId]
+	if !ok || !time.Now().Before(userToken.ExpiresAt) ||
+		email_address.Key(user.Email) != email_address.Key(userToken.Email) {
+		return User{}, false
+	}
+	return user, true
+}
+
+// CreateVerificationToken stores a token proving the user owns their current
+// email once it comes back through VerifyEmail.
+func (db *DB) CreateVerificationToken(userId int, token string, ttl time.Duration) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userId]
+		if !ok {
+			err := ErrUserNotExist
+			return &err
+		}
+		if user.Verified {
+			err := ErrEmailAlrVerified
+			return &err
+		}
+		issueUserToken(dbStructure, user, TokenPurposeVerifyEmail, token, ttl)
+		return nil
+	})
+}
+
+func (db *DB) VerifyEmail(token string) (User, error) {
+	var user User
+	err := db.Update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = consumeUserToken(dbStructure, TokenPurposeVerifyEmail, token)
+		if !ok {
+			err := ErrVerificationTokenInvalid
+			return &err
+		}
+		user.Verified = true
+		user.UpdatedAt = time.Now().UTC()
+		dbStructure.Users[user.Id] = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// CreatePasswordResetToken stores a token that lets whoever can read the
+// mail sent to email set a new password through ResetPassword.
+func (db *DB) CreatePasswordResetToken(email string, token string, ttl time.Duration) (User, error) {
+	var user User
+	err := db.Update(func(dbStructure *DBStructure) error {
+		key := email_address.Key(email)
+		for _, candidate := range dbStructure.Users {
+			if email_address.Key(candidate.Email) == key {
+				user = candidate
+				issueUserToken(dbStructure, user, TokenPurposeResetPassword, token, ttl)
+				return nil
+			}
+		}
+		err := ErrUserNotExist
+		return &err
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// ResetPassword sets a new password for the user token was issued to and
+// logs them out everywhere. Since the token was mailed to them, it also
+// proves they own their email.
+func (db *DB) ResetPassword(token string, newPss string) (User, error) {
+	newPssHash, err := db.hasher.Hash(newPss)
+	if err != nil {
+		return User{}, err
+	}
+
+	var user User
+	err = db.Update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = consumeUserToken(dbStructure, TokenPurposeResetPassword, token)
+		if !ok {
+			err := ErrResetTokenInvalid
+			return &err
+		}
+		now := time.Now().UTC()
+		user.PssHash = newPssHash
+		user.Verified = true
+		user.UpdatedAt = now
+		user.TokensValidAfter = now
+		dbStructure.Users[user.Id] = user
+		deleteUserSessions(dbStructure, user.Id)
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
@@ -1,37 +1,56 @@
 package db
 
 import (
-	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+	"bytes"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/email_address"
 	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func (db *DB) CreateUser(email string, pss string) (User, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) GetUser(id int) (User, error) {
+	current, err := db.snapshot()
 	if err != nil {
 		return User{}, err
 	}
 
-	for _, user := range dbStructure.Users {
-		if user.Email == email {
-			err := ErrUserAlrExist
-			return User{}, &err
-		}
+	user, ok := current.data.Users[id]
+	if !ok {
+		err := ErrUserNotExist
+		return User{}, &err
 	}
+	return user, nil
+}
 
-	id := len(dbStructure.Users) + 1
-	pssHash, err := bcrypt.GenerateFromPassword([]byte(pss), 4)
+func (db *DB) CreateUser(email string, pss string) (User, error) {
+	pssHash, err := db.hasher.Hash(pss)
 	if err != nil {
 		return User{}, err
 	}
 
-	newUser := User{
-		Email:   email,
-		PssHash: pssHash,
-		Id:      id,
-	}
-	dbStructure.Users[id] = newUser
-	err = db.writeDB(dbStructure)
+	var newUser User
+	err = db.Update(func(dbStructure *DBStructure) error {
+		if emailTaken(dbStructure, email, 0) {
+			err := ErrUserAlrExist
+			return &err
+		}
+
+		id := dbStructure.nextId(seqUsers)
+		now := time.Now().UTC()
+		newUser = User{
+			Email:     email,
+			PssHash:   pssHash,
+			Id:        id,
+			Role:      RoleUser,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		dbStructure.Users[id] = newUser
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
@@ -40,141 +59,255 @@ func (db *DB) CreateUser(email string, pss string) (User, error) {
 }
 
 func (db *DB) UpdateUser(id int, newEmail string, newPss string) (User, error) {
-	dbStructure, err := db.loadDB()
+	return db.PatchUser(id, UserPatch{Email: &newEmail, Password: &newPss})
+}
+
+// PatchUser applies patch to a user. A new password logs them out of every
+// session, as ResetPassword does.
+func (db *DB) PatchUser(id int, patch UserPatch) (User, error) {
+	newPssHash, err := patch.hashPassword(db.hasher)
 	if err != nil {
 		return User{}, err
 	}
 
-	newPssHash, err := encryption.Hash(newPss)
+	var user User
+	err = db.Update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[id]
+		if !ok {
+			err := ErrUserNotExist
+			return &err
+		}
+		if patch.Email != nil && emailTaken(dbStructure, *patch.Email, id) {
+			err := ErrUserAlrExist
+			return &err
+		}
+
+		patch.apply(&user, newPssHash, time.Now().UTC())
+		dbStructure.Users[id] = user
+		if newPssHash != nil {
+			deleteUserSessions(dbStructure, id)
+		}
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	user, ok := dbStructure.Users[id]
-	if !ok {
-		err := ErrUserNotExist
-		return User{}, &err
-	}
+	return user, nil
+}
 
-	user.Email = newEmail
-	user.PssHash = newPssHash
-	dbStructure.Users[id] = user
-	err = db.writeDB(dbStructure)
+func (db *DB) CheckPassword(id int, pss string) error {
+	user, err := db.GetUser(id)
 	if err != nil {
-		return User{}, err
+		return err
 	}
+	return checkCurrentPassword(db.hasher, user, pss)
+}
 
-	return user, nil
+// EmailRegistered reports whether a user has email, ignoring case.
+func (db *DB) EmailRegistered(email string) (bool, error) {
+	current, err := db.snapshot()
+	if err != nil {
+		return false, err
+	}
+	_, ok := current.usersByEmail[email_address.Key(email)]
+	return ok, nil
 }
 
 func (db *DB) Login(email string, pss string) (User, error) {
-	dbStructure, err := db.loadDB()
+	current, err := db.snapshot()
 	if err != nil {
 		return User{}, err
 	}
 
-	for _, user := range dbStructure.Users {
-		if user.Email == email {
-			err := bcrypt.CompareHashAndPassword(user.PssHash, []byte(pss))
-			if err == nil {
-				return user, nil
-			} else {
-				incPss := ErrIncorrectPss
-				return User{}, &incPss
-			}
+	id, ok := current.usersByEmail[email_address.Key(email)]
+	if !ok {
+		return User{}, rejectUnknownEmail(db.hasher, db.dummyHash, pss)
+	}
+	user := current.data.Users[id]
+	ok, needsRehash, err := db.hasher.Verify(user.PssHash, pss)
+	if err != nil {
+		return User{}, err
+	}
+	if !ok {
+		incPss := ErrIncorrectPss
+		return User{}, &incPss
+	}
+	if user.Banned {
+		err := ErrUserBanned
+		return User{}, &err
+	}
+	if needsRehash {
+		err = db.rehashPassword(&user, pss)
+		if err != nil {
+			log.Printf("Error rehashing password of user %d: %s", user.Id, err)
 		}
 	}
-	userNotExist := ErrUserNotExist
-	return User{}, &userNotExist
+	return user, nil
 }
 
-func (db *DB) SaveRefToken(id int, refreshToken string) error {
-	dbStructure, err := db.loadDB()
+// rehashPassword replaces user's hash with one made by the current hasher,
+// unless the password was changed since user was read.
+func (db *DB) rehashPassword(user *User, pss string) error {
+	newPssHash, err := db.hasher.Hash(pss)
 	if err != nil {
 		return err
 	}
+	return db.Update(func(dbStructure *DBStructure) error {
+		stored, ok := dbStructure.Users[user.Id]
+		if !ok || !bytes.Equal(stored.PssHash, user.PssHash) {
+			return nil
+		}
+		stored.PssHash = newPssHash
+		dbStructure.Users[user.Id] = stored
+		user.PssHash = newPssHash
+		return nil
+	})
+}
 
-	user, ok := dbStructure.Users[id]
-	if !ok {
-		err := ErrUserNotExist
-		return &err
-	}
-	user.RefToken = refreshToken
-	dbStructure.Users[id] = user
-	err = db.writeDB(dbStructure)
+func (db *DB) UserChirpyRed(userId int) error {
+	return db.Update(func(dbStructure *DBStructure) error {
+		user, ok := dbStructure.Users[userId]
+		if !ok {
+			err := ErrUserNotExist
+			return &err
+		}
+
+		user.IsChirpyRed = true
+		user.UpdatedAt = time.Now().UTC()
+		dbStructure.Users[userId] = user
+		return nil
+	})
+}
+
+func (db *DB) ListUsers() ([]User, error) {
+	current, err := db.snapshot()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	users := make([]User, 0, len(current.data.Users))
+	for _, user := range current.data.Users {
+		users = append(users, user)
+	}
+	slices.SortFunc(users, func(a, b User) int { return a.Id - b.Id })
+	return users, nil
 }
 
-func (db *DB) ValidateRefToken(refreshToken string) (User, error) {
-	dbStructure, err := db.loadDB()
+func (db *DB) SetUserRole(id int, role string) (User, error) {
+	if !ValidRole(role) {
+		err := ErrInvalidRole
+		return User{}, &err
+	}
+
+	var user User
+	err := db.Update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[id]
+		if !ok {
+			err := ErrUserNotExist
+			return &err
+		}
+
+		user.Role = role
+		user.UpdatedAt = time.Now().UTC()
+		dbStructure.Users[id] = user
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
+	return user, nil
+}
+
+// SetUserBanned bans or unbans a user. Banning also ends all their sessions so
+// they can't mint new access tokens.
+func (db *DB) SetUserBanned(id int, banned bool) (User, error) {
 	var user User
-	for _, User := range dbStructure.Users {
-		if User.RefToken == refreshToken {
-			user = User
-			break
+	err := db.Update(func(dbStructure *DBStructure) error {
+		var ok bool
+		user, ok = dbStructure.Users[id]
+		if !ok {
+			err := ErrUserNotExist
+			return &err
 		}
-	}
-	if user.Id == 0 {
-		err := ErrUserNotExist
-		return User{}, &err
-	}
-	if user.RefToken != refreshToken {
-		err := api_errors.UnauthErr
-		err.LogMess = "Incorrect refresh token"
-		return User{}, &err
+
+		user.Banned = banned
+		user.UpdatedAt = time.Now().UTC()
+		dbStructure.Users[id] = user
+		if banned {
+			deleteUserSessions(dbStructure, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
 	}
 
 	return user, nil
 }
 
-func (db *DB) RevokeRefToken(refreshToken string) error {
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
+// UserPatch holds changes to a user; nil fields are left as they are.
+type UserPatch struct {
+	Email    *string
+	Password *string
+}
+
+func (patch UserPatch) hashPassword(hasher encryption.PasswordHasher) ([]byte, error) {
+	if patch.Password == nil {
+		return nil, nil
 	}
+	return hasher.Hash(*patch.Password)
+}
 
-	for _, user := range dbStructure.Users {
-		if user.RefToken == refreshToken {
-			user.RefToken = ""
-			dbStructure.Users[user.Id] = user
-			err := db.writeDB(dbStructure)
-			if err != nil {
-				return err
-			}
-			return nil
+// apply changes user as of now. A new email has to be verified again, and a
+// new password invalidates the access tokens issued before it; the caller
+// must also delete the user's sessions then.
+func (patch UserPatch) apply(user *User, newPssHash []byte, now time.Time) {
+	if patch.Email != nil {
+		if email_address.Key(*patch.Email) != email_address.Key(user.Email) {
+			user.Verified = false
 		}
+		user.Email = *patch.Email
 	}
-
-	userNotExist := ErrUserNotExist
-	return &userNotExist
+	if newPssHash != nil {
+		user.PssHash = newPssHash
+		user.TokensValidAfter = now
+	}
+	user.UpdatedAt = now
 }
 
-func (db *DB) UserChirpyRed(userId int) error {
-	dbStructure, err := db.loadDB()
+// checkCurrentPassword makes sure a user changing sensitive settings knows
+// their password, not just holds one of their tokens.
+func checkCurrentPassword(hasher encryption.PasswordHasher, user User, pss string) error {
+	ok, _, err := hasher.Verify(user.PssHash, pss)
 	if err != nil {
 		return err
 	}
-
-	user, ok := dbStructure.Users[userId]
 	if !ok {
-		err := ErrUserNotExist
+		err := ErrCurrentPssIncorrect
 		return &err
 	}
+	return nil
+}
 
-	user.IsChirpyRed = true
-	dbStructure.Users[userId] = user
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		return err
+// emailTaken reports whether a user other than exceptId has an email that
+// matches email ignoring case.
+func emailTaken(dbStructure *DBStructure, email string, exceptId int) bool {
+	key := email_address.Key(email)
+	for id, user := range dbStructure.Users {
+		if id != exceptId && email_address.Key(user.Email) == key {
+			return true
+		}
 	}
+	return false
+}
 
-	return nil
+// duplicateEmailsErr describes two accounts whose emails only differ in case,
+// which have to be merged or renamed by hand before emails can be matched
+// ignoring case.
+func duplicateEmailsErr(firstId int, secondId int, email string) error {
+	return fmt.Errorf("users %d and %d both have email %s ignoring case: rename one of them before upgrading", firstId, secondId, email)
 }
@@ -0,0 +1,338 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+)
+
+func TestLoginRehashesOutdatedPasswords(t *testing.T) {
+	legacy := encryption.DefaultPasswordHasher()
+	legacy.Algorithm = encryption.AlgBcrypt
+	legacy.BcryptCost = 4
+	current := encryption.DefaultPasswordHasher()
+	current.Argon2.Memory = 64
+
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database")
+			store, err := NewStore(driver, path, WithPasswordHasher(legacy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, err := store.CreateUser("test@email.com", "testPassword")
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+			if !strings.HasPrefix(string(user.PssHash), "$2a$04$") {
+				t.Fatalf("legacy hash = %s", user.PssHash)
+			}
+
+			store, err = NewStore(driver, path, WithPasswordHasher(current))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			_, err = store.Login("test@email.com", "wrongPassword")
+			expectClientErr(t, err, ErrIncorrectPss)
+			user, err = store.GetUser(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(user.PssHash), "$2a$04$") {
+				t.Errorf("failed login rehashed password: %s", user.PssHash)
+			}
+
+			_, err = store.Login("test@email.com", "testPassword")
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, err = store.GetUser(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(user.PssHash), "$argon2id$v=19$m=64,t=2,p=1$") {
+				t.Errorf("password not rehashed on login: %s", user.PssHash)
+			}
+			_, err = store.Login("test@email.com", "testPassword")
+			if err != nil {
+				t.Errorf("login with rehashed password: %v", err)
+			}
+		})
+	}
+}
+
+func TestEmailsMatchIgnoringCase(t *testing.T) {
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			store, err := NewStore(driver, filepath.Join(t.TempDir(), "database"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			bob, err := store.CreateUser("Bob@example.com", "testPassword")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CreateUser("bob@example.com", "testPassword")
+			expectClientErr(t, err, ErrUserAlrExist)
+
+			user, err := store.Login("BOB@example.com", "testPassword")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Id != bob.Id || user.Email != "Bob@example.com" {
+				t.Errorf("Login() = %d %s; want %d Bob@example.com", user.Id, user.Email, bob.Id)
+			}
+
+			alice, err := store.CreateUser("alice@example.com", "testPassword")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.UpdateUser(alice.Id, "bOB@example.com", "testPassword")
+			expectClientErr(t, err, ErrUserAlrExist)
+			bob, err = store.UpdateUser(bob.Id, "bob@example.com", "testPassword")
+			if err != nil {
+				t.Fatalf("changing the case of own email: %v", err)
+			}
+			if bob.Email != "bob@example.com" {
+				t.Errorf("UpdateUser() email = %s; want bob@example.com", bob.Email)
+			}
+		})
+	}
+}
+
+func TestDuplicateEmailsBlockMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	legacy := `{
+		"schema_version": 6,
+		"sequences": {"chirps": 0, "users": 2},
+		"chirps": {},
+		"chirp_history": {},
+		"sessions": {},
+		"revoked_tokens": {},
+		"users": {
+			"1": {"id": 1, "email": "Bob@example.com", "role": "user"},
+			"2": {"id": 2, "email": "bob@example.com", "role": "user"}
+		}
+	}`
+	err := os.WriteFile(path, []byte(legacy), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDB(path)
+	if err == nil || !strings.Contains(err.Error(), "users 1 and 2") {
+		t.Errorf("NewDB() error = %v; want duplicate emails error", err)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			store, err := NewStore(driver, filepath.Join(t.TempDir(), "database"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			user, err := store.CreateUser("test@email.com", "testPassword")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Verified {
+				t.Fatal("new user is already verified")
+			}
+
+			for _, token := range []string{"first-token", "second-token"} {
+				err = store.CreateVerificationToken(user.Id, token, time.Hour)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err = store.VerifyEmail("first-token")
+			expectClientErr(t, err, ErrVerificationTokenInvalid)
+			_, err = store.VerifyEmail("unknown-token")
+			expectClientErr(t, err, ErrVerificationTokenInvalid)
+
+			verified, err := store.VerifyEmail("second-token")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !verified.Verified || verified.Id != user.Id {
+				t.Errorf("VerifyEmail() = %+v; want user %d verified", verified, user.Id)
+			}
+			user, err = store.GetUser(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !user.Verified {
+				t.Error("verification not stored")
+			}
+			_, err = store.VerifyEmail("second-token")
+			expectClientErr(t, err, ErrVerificationTokenInvalid)
+			err = store.CreateVerificationToken(user.Id, "third-token", time.Hour)
+			expectClientErr(t, err, ErrEmailAlrVerified)
+
+			other, err := store.CreateUser("other@email.com", "testPassword")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.CreateVerificationToken(other.Id, "expired-token", -time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.VerifyEmail("expired-token")
+			expectClientErr(t, err, ErrVerificationTokenInvalid)
+
+			err = store.CreateVerificationToken(other.Id, "old-email-token", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.UpdateUser(other.Id, "new@email.com", "testPassword")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.VerifyEmail("old-email-token")
+			expectClientErr(t, err, ErrVerificationTokenInvalid)
+		})
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			store, err := NewStore(driver, filepath.Join(t.TempDir(), "database"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			user, _ := store.CreateUser("test@email.com", "testPassword")
+			_, err = store.CreateSession(user.Id, "refresh-token", "", "", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = store.CreatePasswordResetToken("unknown@email.com", "unknown-token", time.Hour)
+			expectClientErr(t, err, ErrUserNotExist)
+			resetFor, err := store.CreatePasswordResetToken("Test@Email.com", "reset-token", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resetFor.Id != user.Id {
+				t.Errorf("CreatePasswordResetToken() user = %d; want %d", resetFor.Id, user.Id)
+			}
+			err = store.CreateVerificationToken(user.Id, "verify-token", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.ResetPassword("verify-token", "newPassword")
+			expectClientErr(t, err, ErrResetTokenInvalid)
+
+			user, err = store.ResetPassword("reset-token", "newPassword")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !user.Verified {
+				t.Error("reset didn't verify the email it was sent to")
+			}
+			_, err = store.ResetPassword("reset-token", "otherPassword")
+			expectClientErr(t, err, ErrResetTokenInvalid)
+
+			_, err = store.Login("test@email.com", "testPassword")
+			expectClientErr(t, err, ErrIncorrectPss)
+			_, err = store.Login("test@email.com", "newPassword")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessions, err := store.GetSessions(user.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 0 {
+				t.Errorf("sessions left after reset: %v", sessions)
+			}
+		})
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	for _, driver := range []string{"json", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			store, err := NewStore(driver, filepath.Join(t.TempDir(), "database"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			user, _ := store.CreateUser("test@email.com", "testPassword")
+			store.CreateUser("other@email.com", "testPassword")
+			err = store.CreateVerificationToken(user.Id, "verify-token", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.VerifyEmail("verify-token")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CreateSession(user.Id, "refresh-token", "test", "127.0.0.1", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ptr := func(s string) *string { return &s }
+
+			updated, err := store.PatchUser(user.Id, UserPatch{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated.Email != "test@email.com" || !updated.Verified {
+				t.Errorf("empty patch changed the user: %+v", updated)
+			}
+
+			// A new password logs the user out everywhere.
+			_, err = store.PatchUser(user.Id, UserPatch{Password: ptr("newPassword")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.CheckPassword(user.Id, "newPassword")
+			if err != nil {
+				t.Errorf("CheckPassword() = %v", err)
+			}
+			_, err = store.RotateSession("refresh-token", "refresh-token-2", time.Hour)
+			expectClientErr(t, err, ErrRefTokenInvalid)
+
+			// Changing only the case keeps the address verified.
+			updated, err = store.PatchUser(user.Id, UserPatch{Email: ptr("Test@email.com")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated.Email != "Test@email.com" || !updated.Verified {
+				t.Errorf("case change: got %+v", updated)
+			}
+
+			updated, err = store.PatchUser(user.Id, UserPatch{Email: ptr("new@email.com")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, _ := store.GetUser(user.Id)
+			if stored.Email != "new@email.com" || stored.Verified || updated.Verified {
+				t.Errorf("new email: stored %+v; returned %+v", stored, updated)
+			}
+
+			_, err = store.PatchUser(user.Id, UserPatch{Email: ptr("OTHER@email.com")})
+			expectClientErr(t, err, ErrUserAlrExist)
+			_, err = store.PatchUser(user.Id+2, UserPatch{Password: ptr("newPassword")})
+			expectClientErr(t, err, ErrUserNotExist)
+			err = store.CheckPassword(user.Id, "testPassword")
+			expectClientErr(t, err, ErrCurrentPssIncorrect)
+		})
+	}
+}
@@ -25,3 +25,8 @@ var UnauthErr = ClientErr{
 	HttpCode: http.StatusUnauthorized,
 	Message:  "Unauthorized",
 }
+
+var ForbiddenErr = ClientErr{
+	HttpCode: http.StatusForbidden,
+	Message:  "Forbidden",
+}
@@ -0,0 +1,206 @@
+package content_filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	ActionMask   = "mask"
+	ActionReject = "reject"
+	ActionFlag   = "flag"
+)
+
+const mask = "****"
+
+type Rule struct {
+	Word   string
+	Action string
+}
+
+// DefaultRules is the list used when no word list is configured.
+var DefaultRules = []Rule{
+	{Word: "kerfuffle", Action: ActionMask},
+	{Word: "sharbert", Action: ActionMask},
+	{Word: "fornax", Action: ActionMask},
+}
+
+type Result struct {
+	Body     string
+	Rejected bool
+	Flagged  bool
+	Matches  []string
+}
+
+// Filter checks text against a word list that can be swapped at any time,
+// including while other goroutines are applying it.
+type Filter struct {
+	path  string
+	rules atomic.Pointer[map[string]string]
+}
+
+func NewFilter(rules []Rule) *Filter {
+	filter := &Filter{}
+	filter.SetRules(rules)
+	return filter
+}
+
+// NewFileFilter loads its rules from path. Calling Reload re-reads the file.
+func NewFileFilter(path string) (*Filter, error) {
+	filter := &Filter{path: path}
+	err := filter.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func (filter *Filter) SetRules(rules []Rule) {
+	byWord := make(map[string]string, len(rules))
+	for _, rule := range rules {
+		byWord[fold(rule.Word)] = rule.Action
+	}
+	filter.rules.Store(&byWord)
+}
+
+// Reload re-reads the word list file. The current rules stay in place if the
+// file can't be read or parsed.
+func (filter *Filter) Reload() error {
+	if filter.path == "" {
+		return nil
+	}
+	file, err := os.Open(filter.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	rules, err := ParseRules(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filter.path, err)
+	}
+	filter.SetRules(rules)
+	return nil
+}
+
+// ParseRules reads one rule per line, either "word" (masked) or
+// "word:action". Blank lines and lines starting with # are ignored.
+func ParseRules(reader io.Reader) ([]Rule, error) {
+	rules := []Rule{}
+	scanner := bufio.NewScanner(reader)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		word, action, found := strings.Cut(line, ":")
+		word = strings.TrimSpace(word)
+		action = strings.TrimSpace(action)
+		if !found {
+			action = ActionMask
+		}
+		if action != ActionMask && action != ActionReject && action != ActionFlag {
+			return nil, fmt.Errorf("line %d: unknown action %q", lineNum, action)
+		}
+		if !isWord(word) {
+			return nil, fmt.Errorf("line %d: %q is not a single word", lineNum, word)
+		}
+		rules = append(rules, Rule{Word: word, Action: action})
+	}
+	return rules, scanner.Err()
+}
+
+// ParseRulesList parses a comma separated list of rules, as found in an
+// environment variable, e.g. "kerfuffle,sharbert:reject".
+func ParseRulesList(list string) ([]Rule, error) {
+	return ParseRules(strings.NewReader(strings.ReplaceAll(list, ",", "\n")))
+}
+
+// Apply masks every masked word in text and reports whether it contains any
+// word that should get the chirp rejected or flagged. Words are matched
+// regardless of case and of the punctuation around them.
+func (filter *Filter) Apply(text string) Result {
+	result := Result{Body: text}
+	if filter == nil {
+		return result
+	}
+	rules := *filter.rules.Load()
+
+	var body strings.Builder
+	last := 0
+	for _, span := range wordSpans(text) {
+		word := text[span[0]:span[1]]
+		action, ok := rules[fold(word)]
+		if !ok {
+			continue
+		}
+		result.Matches = append(result.Matches, word)
+		switch action {
+		case ActionReject:
+			result.Rejected = true
+		case ActionFlag:
+			result.Flagged = true
+		case ActionMask:
+			body.WriteString(text[last:span[0]])
+			body.WriteString(mask)
+			last = span[1]
+		}
+	}
+	body.WriteString(text[last:])
+	result.Body = body.String()
+	return result
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+}
+
+func isWord(word string) bool {
+	if word == "" {
+		return false
+	}
+	for _, r := range word {
+		if !isWordRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// wordSpans returns the byte offsets of every run of letters and digits.
+func wordSpans(text string) [][2]int {
+	spans := [][2]int{}
+	start := -1
+	for i, r := range text {
+		if isWordRune(r) {
+			if start < 0 {
+				start = i
+			}
+		} else if start >= 0 {
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(text)})
+	}
+	return spans
+}
+
+func fold(word string) string {
+	return strings.Map(func(r rune) rune {
+		if r == utf8.RuneError {
+			return -1
+		}
+		return unicode.ToLower(unicode.ToUpper(r))
+	}, word)
+}
@@ -0,0 +1,142 @@
+package content_filter
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+	filter := NewFilter(append(DefaultRules,
+		Rule{Word: "blorp", Action: ActionReject},
+		Rule{Word: "zibble", Action: ActionFlag},
+		Rule{Word: "çafé", Action: ActionMask},
+	))
+
+	tests := []struct {
+		name     string
+		input    string
+		expected Result
+	}{
+		{"empty string", "", Result{Body: ""}},
+		{"no words are processed", "Hello new world", Result{Body: "Hello new world"}},
+		{
+			"some words are processed",
+			"kerfuffle new world",
+			Result{Body: "**** new world", Matches: []string{"kerfuffle"}},
+		},
+		{
+			"all words are processed",
+			"kerfuffle sharbert fornax",
+			Result{Body: "**** **** ****", Matches: []string{"kerfuffle", "sharbert", "fornax"}},
+		},
+		{
+			"case and punctuation",
+			"What a KERFUFFLE! (Sharbert), fornax.",
+			Result{Body: "What a ****! (****), ****.", Matches: []string{"KERFUFFLE", "Sharbert", "fornax"}},
+		},
+		{
+			"part of a longer word",
+			"kerfuffles sharbertine",
+			Result{Body: "kerfuffles sharbertine"},
+		},
+		{
+			"unicode",
+			"ÇAFÉ or Çafé, not cafe",
+			Result{Body: "**** or ****, not cafe", Matches: []string{"ÇAFÉ", "Çafé"}},
+		},
+		{
+			"rejected",
+			"blorp kerfuffle",
+			Result{Body: "blorp ****", Rejected: true, Matches: []string{"blorp", "kerfuffle"}},
+		},
+		{
+			"flagged",
+			"Zibble!",
+			Result{Body: "Zibble!", Flagged: true, Matches: []string{"Zibble"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := filter.Apply(tt.input)
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Apply(%s) = %+v; want %+v", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []Rule
+		wantErr  bool
+	}{
+		{"empty", "", []Rule{}, false},
+		{
+			"comments and actions",
+			"# banned words\nkerfuffle\n\nsharbert : reject\nfornax:flag\n",
+			[]Rule{
+				{Word: "kerfuffle", Action: ActionMask},
+				{Word: "sharbert", Action: ActionReject},
+				{Word: "fornax", Action: ActionFlag},
+			},
+			false,
+		},
+		{"unknown action", "kerfuffle:delete", nil, true},
+		{"more than one word", "two words", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseRules(strings.NewReader(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRules(%q) error = %v; wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(rules, tt.expected) {
+				t.Errorf("ParseRules(%q) = %v; want %v", tt.input, rules, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.txt")
+	err := os.WriteFile(path, []byte("kerfuffle\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := NewFileFilter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(path, []byte("sharbert:reject\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = filter.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := filter.Apply("kerfuffle sharbert")
+	if result.Body != "kerfuffle sharbert" || !result.Rejected {
+		t.Errorf("rules not reloaded: got %+v", result)
+	}
+
+	err = os.WriteFile(path, []byte("sharbert:nope\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.Reload() == nil {
+		t.Fatal("expected Reload to fail on an invalid file")
+	}
+	result = filter.Apply("sharbert")
+	if !result.Rejected {
+		t.Errorf("invalid file replaced the rules: got %+v", result)
+	}
+}
@@ -0,0 +1,61 @@
+package email_address
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+const (
+	maxLength      = 254
+	maxLocalLength = 64
+)
+
+var ErrInvalid = errors.New("invalid email address")
+
+// Normalize checks that address is a single RFC 5322 address, without a
+// display name, and returns it trimmed and with its domain lowercased. The
+// local part keeps its case since, strictly, it's up to the receiving server
+// to decide whether it matters; Key is what accounts are matched by.
+func Normalize(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	if len(address) > maxLength || strings.ContainsAny(address, "<>") {
+		return "", ErrInvalid
+	}
+	parsed, err := mail.ParseAddress(address)
+	if err != nil || parsed.Name != "" {
+		return "", ErrInvalid
+	}
+
+	at := strings.LastIndex(parsed.Address, "@")
+	local, domain := parsed.Address[:at], strings.ToLower(parsed.Address[at+1:])
+	// Addresses on a bare host name or a domain literal are valid but can't be
+	// delivered to from the internet.
+	if len(local) > maxLocalLength || !strings.Contains(domain, ".") || strings.HasPrefix(domain, "[") {
+		return "", ErrInvalid
+	}
+
+	// String quotes the local part if it needs to be.
+	normalized := (&mail.Address{Address: local + "@" + domain}).String()
+	return strings.TrimSuffix(strings.TrimPrefix(normalized, "<"), ">"), nil
+}
+
+// StripPlusTag removes a "+tag" subaddress from a normalized address, so
+// "bob+chirpy@example.com" becomes "bob@example.com".
+func StripPlusTag(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 0 || strings.HasPrefix(address, `"`) {
+		return address
+	}
+	local, _, found := strings.Cut(address[:at], "+")
+	if !found || local == "" {
+		return address
+	}
+	return local + address[at:]
+}
+
+// Key is the form addresses are compared in: two addresses with the same key
+// belong to the same account.
+func Key(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
@@ -0,0 +1,66 @@
+package email_address
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		address  string
+		expected string
+		valid    bool
+	}{
+		{"simple", "bob@example.com", "bob@example.com", true},
+		{"surrounding space", "  bob@example.com\n", "bob@example.com", true},
+		{"domain lowercased", "Bob@EXAMPLE.Com", "Bob@example.com", true},
+		{"plus tag kept", "bob+chirpy@example.com", "bob+chirpy@example.com", true},
+		{"quoted local part", `"bob smith"@example.com`, `"bob smith"@example.com`, true},
+		{"empty", "", "", false},
+		{"no at", "bob.example.com", "", false},
+		{"no local part", "@example.com", "", false},
+		{"two ats", "bob@smith@example.com", "", false},
+		{"display name", "Bob <bob@example.com>", "", false},
+		{"angle brackets", "<bob@example.com>", "", false},
+		{"two addresses", "bob@example.com, alice@example.com", "", false},
+		{"bare host", "bob@localhost", "", false},
+		{"domain literal", "bob@[127.0.0.1]", "", false},
+		{"double dot", "bob..smith@example.com", "", false},
+		{"local part too long", strings.Repeat("a", 65) + "@example.com", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			normalized, err := Normalize(tt.address)
+			if tt.valid && err != nil {
+				t.Fatalf("Normalize(%q) error = %v", tt.address, err)
+			}
+			if !tt.valid && err != ErrInvalid {
+				t.Fatalf("Normalize(%q) = %q, %v; want %v", tt.address, normalized, err, ErrInvalid)
+			}
+			if normalized != tt.expected {
+				t.Errorf("Normalize(%q) = %q; want %q", tt.address, normalized, tt.expected)
+			}
+		})
+	}
+}
+
+func TestStripPlusTag(t *testing.T) {
+	tests := []struct {
+		address  string
+		expected string
+	}{
+		{"bob+chirpy@example.com", "bob@example.com"},
+		{"bob+a+b@example.com", "bob@example.com"},
+		{"bob@example.com", "bob@example.com"},
+		{"+chirpy@example.com", "+chirpy@example.com"},
+		{`"bob+chirpy"@example.com`, `"bob+chirpy"@example.com`},
+	}
+
+	for _, tt := range tests {
+		if stripped := StripPlusTag(tt.address); stripped != tt.expected {
+			t.Errorf("StripPlusTag(%q) = %q; want %q", tt.address, stripped, tt.expected)
+		}
+	}
+}
@@ -1,15 +1,163 @@
 package encryption
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"strings"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func Hash(str string) ([]byte, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(str), 4)
+const (
+	AlgBcrypt   = "bcrypt"
+	AlgArgon2id = "argon2id"
+)
+
+// Argon2Params are the argon2id cost parameters. Memory is in KiB.
+type Argon2Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// PasswordHasher hashes passwords with Algorithm. Hashes are self-describing
+// (bcrypt's "$2a$<cost>$..." and argon2id's PHC string format), so a hash made
+// with other parameters can still be verified and flagged for rehashing.
+type PasswordHasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// DefaultPasswordHasher follows the OWASP password storage recommendations.
+func DefaultPasswordHasher() PasswordHasher {
+	return PasswordHasher{
+		Algorithm:  AlgArgon2id,
+		BcryptCost: 12,
+		Argon2: Argon2Params{
+			Time:    2,
+			Memory:  19 * 1024,
+			Threads: 1,
+			SaltLen: 16,
+			KeyLen:  32,
+		},
+	}
+}
+
+// Validate reports settings Hash would reject or silently replace.
+func (hasher PasswordHasher) Validate() error {
+	if hasher.Algorithm != AlgBcrypt && hasher.Algorithm != AlgArgon2id {
+		return fmt.Errorf("unknown password hashing algorithm: %q", hasher.Algorithm)
+	}
+	if hasher.BcryptCost < bcrypt.MinCost || hasher.BcryptCost > bcrypt.MaxCost {
+		return fmt.Errorf("bcrypt cost %d is outside %d..%d", hasher.BcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	params := hasher.Argon2
+	if params.Time < 1 {
+		return errors.New("argon2 time must be at least 1")
+	}
+	if params.Threads < 1 {
+		return errors.New("argon2 threads must be at least 1")
+	}
+	if uint64(params.Memory) < 8*uint64(params.Threads) {
+		return fmt.Errorf("argon2 memory must be at least %d KiB, 8 per thread", 8*uint64(params.Threads))
+	}
+	return nil
+}
+
+var ErrUnknownHashFormat = errors.New("unknown password hash format")
+
+func (hasher PasswordHasher) Hash(password string) ([]byte, error) {
+	switch hasher.Algorithm {
+	case AlgBcrypt:
+		return bcrypt.GenerateFromPassword([]byte(password), hasher.BcryptCost)
+	case AlgArgon2id:
+		params := hasher.Argon2
+		salt := make([]byte, params.SaltLen)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return nil, err
+		}
+		key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+		return []byte(fmt.Sprintf(
+			"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, params.Memory, params.Time, params.Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		)), nil
+	default:
+		return nil, fmt.Errorf("unknown password hashing algorithm: %q", hasher.Algorithm)
+	}
+}
+
+// Verify reports whether password matches hash and, if it does, whether hash
+// should be replaced because it wasn't made with the hasher's current
+// algorithm and parameters.
+func (hasher PasswordHasher) Verify(hash []byte, password string) (bool, bool, error) {
+	if bytes.HasPrefix(hash, []byte("$argon2id$")) {
+		params, salt, key, err := decodeArgon2id(string(hash))
+		if err != nil {
+			return false, false, err
+		}
+		candidate := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+		if subtle.ConstantTimeCompare(candidate, key) != 1 {
+			return false, false, nil
+		}
+		current := hasher.Argon2
+		outdated := hasher.Algorithm != AlgArgon2id ||
+			params.Time != current.Time || params.Memory != current.Memory ||
+			params.Threads != current.Threads || params.SaltLen != current.SaltLen ||
+			params.KeyLen != current.KeyLen
+		return true, outdated, nil
+	}
+
+	cost, err := bcrypt.Cost(hash)
+	if err != nil {
+		return false, false, ErrUnknownHashFormat
+	}
+	err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, hasher.Algorithm != AlgBcrypt || cost != hasher.BcryptCost, nil
+}
+
+func decodeArgon2id(hash string) (Argon2Params, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=...,t=...,p=...", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
+	}
+	params := Argon2Params{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
 	if err != nil {
-		return []byte{}, errors.New("internal error")
+		return Argon2Params{}, nil, nil, ErrUnknownHashFormat
 	}
-	return hash, nil
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(key))
+	return params, salt, key, nil
 }
@@ -0,0 +1,98 @@
+package encryption
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHasher(t *testing.T) {
+	argon2id := DefaultPasswordHasher()
+	argon2id.Argon2.Memory = 64
+	cheaperArgon2id := argon2id
+	cheaperArgon2id.Argon2.Time = 1
+	bcryptHasher := argon2id
+	bcryptHasher.Algorithm = AlgBcrypt
+	bcryptHasher.BcryptCost = bcrypt.MinCost
+	costlierBcrypt := bcryptHasher
+	costlierBcrypt.BcryptCost = bcrypt.MinCost + 1
+
+	tests := []struct {
+		name        string
+		hashedWith  PasswordHasher
+		verifyWith  PasswordHasher
+		prefix      string
+		needsRehash bool
+	}{
+		{"argon2id", argon2id, argon2id, "$argon2id$v=19$m=64,t=2,p=1$", false},
+		{"bcrypt", bcryptHasher, bcryptHasher, "$2a$04$", false},
+		{"outdated argon2id params", cheaperArgon2id, argon2id, "$argon2id$v=19$m=64,t=1,p=1$", true},
+		{"outdated bcrypt cost", bcryptHasher, costlierBcrypt, "$2a$04$", true},
+		{"bcrypt to argon2id", bcryptHasher, argon2id, "$2a$04$", true},
+		{"argon2id to bcrypt", argon2id, bcryptHasher, "$argon2id$", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := tt.hashedWith.Hash("testPassword")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(hash), tt.prefix) {
+				t.Errorf("Hash() = %s; want prefix %s", hash, tt.prefix)
+			}
+
+			ok, needsRehash, err := tt.verifyWith.Verify(hash, "testPassword")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok || needsRehash != tt.needsRehash {
+				t.Errorf("Verify(correct) = %v, %v; want true, %v", ok, needsRehash, tt.needsRehash)
+			}
+			ok, _, err = tt.verifyWith.Verify(hash, "wrongPassword")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok {
+				t.Errorf("Verify(wrong) = true; want false")
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsUnknownFormat(t *testing.T) {
+	hasher := DefaultPasswordHasher()
+	for _, hash := range []string{"", "plaintext", "$argon2id$v=19$m=64$salt$key", "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5"} {
+		_, _, err := hasher.Verify([]byte(hash), "testPassword")
+		if err != ErrUnknownHashFormat {
+			t.Errorf("Verify(%q) error = %v; want %v", hash, err, ErrUnknownHashFormat)
+		}
+	}
+}
+
+func TestPasswordHasherValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*PasswordHasher)
+		wantErr bool
+	}{
+		{"defaults", func(*PasswordHasher) {}, false},
+		{"unknown algorithm", func(h *PasswordHasher) { h.Algorithm = "md5" }, true},
+		{"bcrypt cost too low", func(h *PasswordHasher) { h.BcryptCost = 3 }, true},
+		{"bcrypt cost too high", func(h *PasswordHasher) { h.BcryptCost = 32 }, true},
+		{"argon2 time 0", func(h *PasswordHasher) { h.Argon2.Time = 0 }, true},
+		{"argon2 threads 0", func(h *PasswordHasher) { h.Argon2.Threads = 0 }, true},
+		{"argon2 memory under 8 KiB per thread", func(h *PasswordHasher) { h.Argon2.Threads, h.Argon2.Memory = 4, 31 }, true},
+		{"argon2 minimum memory", func(h *PasswordHasher) { h.Argon2.Threads, h.Argon2.Memory = 4, 32 }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hasher := DefaultPasswordHasher()
+			tt.change(&hasher)
+			if err := hasher.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
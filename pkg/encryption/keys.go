@@ -0,0 +1,125 @@
+package encryption
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is an asymmetric key tokens are signed or verified with. Keys
+// loaded from a public key PEM have no Private key and only verify tokens,
+// which is how a rotated out key is kept until the tokens it signed expire.
+type SigningKey struct {
+	Id      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// LoadSigningKey reads an RSA (RS256) or Ed25519 (EdDSA) key from a PEM file
+// holding a PKCS #8 or PKCS #1 private key, or a PKIX public key.
+func LoadSigningKey(id string, path string) (SigningKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return SigningKey{}, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	key := SigningKey{Id: id}
+	if signer, ok := parsed.(crypto.Signer); ok {
+		key.Private = signer
+		key.Public = signer.Public()
+	} else {
+		key.Public = parsed
+	}
+	switch key.Public.(type) {
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return SigningKey{}, fmt.Errorf("%s: only RSA and Ed25519 keys are supported", path)
+	}
+	return key, nil
+}
+
+func (cfg TokenConfig) findKey(id string) (SigningKey, bool) {
+	for _, key := range cfg.Keys {
+		if key.Id == id {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+func (cfg TokenConfig) signingKey() (SigningKey, error) {
+	key := cfg.Keys[0]
+	if key.Private == nil {
+		return SigningKey{}, errors.New("signing key " + key.Id + " has no private key")
+	}
+	return key, nil
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public half of every configured key, so other services
+// can verify our tokens. HMAC secrets are never published.
+func (cfg TokenConfig) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range cfg.Keys {
+		jwk := JWK{Use: "sig", Kid: key.Id, Alg: key.Method.Alg()}
+		switch public := key.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
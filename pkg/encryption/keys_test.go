@@ -0,0 +1,184 @@
+package encryption
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadTestKeys(t *testing.T) (SigningKey, SigningKey, SigningKey) {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaDER, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	rsaSigning, err := LoadSigningKey("rsa-1", writePEM(t, "PRIVATE KEY", rsaDER))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	edSigning, err := LoadSigningKey("ed-1", writePEM(t, "PRIVATE KEY", edDER))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicDER, _ := x509.MarshalPKIXPublicKey(edKey.Public())
+	edVerifying, err := LoadSigningKey("ed-1", writePEM(t, "PUBLIC KEY", publicDER))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsaSigning, edSigning, edVerifying
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	rsaSigning, edSigning, edVerifying := loadTestKeys(t)
+
+	if rsaSigning.Method != jwt.SigningMethodRS256 || rsaSigning.Private == nil {
+		t.Errorf("RSA key: got method %v private %v", rsaSigning.Method, rsaSigning.Private != nil)
+	}
+	if edSigning.Method != jwt.SigningMethodEdDSA || edSigning.Private == nil {
+		t.Errorf("Ed25519 key: got method %v private %v", edSigning.Method, edSigning.Private != nil)
+	}
+	if edVerifying.Private != nil {
+		t.Error("public key PEM loaded with a private key")
+	}
+
+	_, err := LoadSigningKey("bad", writePEM(t, "CERTIFICATE", []byte("junk")))
+	if err == nil {
+		t.Error("expected an error for an unsupported PEM block")
+	}
+}
+
+func TestAsymmetricTokensAndRotation(t *testing.T) {
+	rsaSigning, edSigning, edVerifying := loadTestKeys(t)
+
+	oldCfg := NewTokenConfig("")
+	oldCfg.Keys = []SigningKey{edSigning}
+	oldToken, err := CreateToken(oldCfg, 1, "user", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The RSA key takes over signing; the Ed25519 key is kept to verify.
+	rotatedCfg := NewTokenConfig("")
+	rotatedCfg.Keys = []SigningKey{rsaSigning, edVerifying}
+	newToken, err := CreateToken(rotatedCfg, 1, "user", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(newToken, &Claims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header["kid"] != "rsa-1" || parsed.Header["alg"] != "RS256" {
+		t.Errorf("new token header: got %v", parsed.Header)
+	}
+
+	// An HS256 token signed with the public key must not be accepted.
+	publicDER, _ := x509.MarshalPKIXPublicKey(rsaSigning.Public)
+	confused := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "1"})
+	confused.Header["kid"] = "rsa-1"
+	confusedToken, _ := confused.SignedString(publicDER)
+
+	retiredCfg := NewTokenConfig("")
+	retiredCfg.Keys = []SigningKey{rsaSigning}
+
+	// HS256 tokens issued before the switch to keys, accepted during a grace period.
+	hmacToken, err := CreateToken(NewTokenConfig("secret"), 1, "user", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	graceCfg := NewTokenConfig("secret")
+	graceCfg.Keys = []SigningKey{rsaSigning}
+	graceCfg.HMACUntil = time.Now().Add(time.Hour)
+	graceOverCfg := graceCfg
+	graceOverCfg.HMACUntil = time.Now().Add(-time.Second)
+
+	tests := []struct {
+		name    string
+		cfg     TokenConfig
+		token   string
+		wantErr bool
+	}{
+		{"old token during rotation", rotatedCfg, oldToken, false},
+		{"new token", rotatedCfg, newToken, false},
+		{"old token after the key is retired", retiredCfg, oldToken, true},
+		{"HS256 token with an RSA kid", rotatedCfg, confusedToken, true},
+		{"HS256 token with an RSA kid during the grace period", graceCfg, confusedToken, true},
+		{"HS256 token during the grace period", graceCfg, hmacToken, false},
+		{"HS256 token after the grace period", graceOverCfg, hmacToken, true},
+		{"HS256 token without a grace period", retiredCfg, hmacToken, true},
+		{"new token during the grace period", graceCfg, newToken, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateToken(tt.token, tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateToken() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	verifyOnly := NewTokenConfig("")
+	verifyOnly.Keys = []SigningKey{edVerifying}
+	_, err = CreateToken(verifyOnly, 1, "user", 0)
+	if err == nil {
+		t.Error("expected CreateToken to fail without a private key")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	rsaSigning, _, edVerifying := loadTestKeys(t)
+	cfg := NewTokenConfig("secret")
+	cfg.Keys = []SigningKey{rsaSigning, edVerifying}
+
+	set := cfg.JWKS()
+	if len(set.Keys) != 2 {
+		t.Fatalf("JWKS() returned %d keys; want 2", len(set.Keys))
+	}
+
+	rsaJWK := set.Keys[0]
+	n, _ := base64.RawURLEncoding.DecodeString(rsaJWK.N)
+	rsaPublic := rsaSigning.Public.(*rsa.PublicKey)
+	if rsaJWK.Kty != "RSA" || rsaJWK.Kid != "rsa-1" || rsaJWK.Alg != "RS256" ||
+		rsaJWK.E != "AQAB" || string(n) != string(rsaPublic.N.Bytes()) {
+		t.Errorf("RSA JWK: got %+v", rsaJWK)
+	}
+
+	edJWK := set.Keys[1]
+	x, _ := base64.RawURLEncoding.DecodeString(edJWK.X)
+	if edJWK.Kty != "OKP" || edJWK.Crv != "Ed25519" || edJWK.Alg != "EdDSA" ||
+		string(x) != string(edVerifying.Public.(ed25519.PublicKey)) {
+		t.Errorf("Ed25519 JWK: got %+v", edJWK)
+	}
+
+	if keys := NewTokenConfig("secret").JWKS().Keys; len(keys) != 0 {
+		t.Errorf("HMAC secret published: %+v", keys)
+	}
+}
@@ -2,6 +2,8 @@ package encryption
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"fmt"
 	"strconv"
@@ -10,33 +12,175 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func CreateToken(id int, jwtSecret string) (string, error) {
+// Claims are the claims of the access tokens issued by CreateToken. Role is
+// informational: permissions are checked against the user's current role.
+type Claims struct {
+	Role string `json:"role"`
+	// IssuedAtNanos is iat with nanoseconds, so tokens issued in the same
+	// second as a password change can be told apart.
+	IssuedAtNanos int64 `json:"iat_ns,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Issued returns when the token was issued, as precisely as it says. Tokens
+// without iat_ns only have iat, to the second.
+func (claims *Claims) Issued() time.Time {
+	if claims.IssuedAtNanos != 0 {
+		return time.Unix(0, claims.IssuedAtNanos)
+	}
+	if claims.IssuedAt == nil {
+		return time.Time{}
+	}
+	return claims.IssuedAt.Time
+}
+
+const (
+	DefaultTokenTTL    = time.Hour
+	DefaultMaxTokenTTL = 24 * time.Hour
+	DefaultIssuer      = "chirpy"
+	DefaultAudience    = "chirpy-api"
+)
+
+// TokenConfig controls the access tokens the API issues and accepts. Tokens
+// are signed with Keys[0] and verified with whichever key their kid names; to
+// rotate, put the new key first and keep the old one until its tokens expire.
+// Without Keys, tokens are signed with HS256 using Secret.
+type TokenConfig struct {
+	Secret string
+	Keys   []SigningKey
+	// HS256 tokens signed with Secret are still accepted until HMACUntil
+	// once Keys are configured, so moving to Keys doesn't log everyone out.
+	HMACUntil  time.Time
+	DefaultTTL time.Duration
+	MaxTTL     time.Duration
+	Issuer     string
+	Audience   string
+}
+
+func NewTokenConfig(secret string) TokenConfig {
+	return TokenConfig{
+		Secret:     secret,
+		DefaultTTL: DefaultTokenTTL,
+		MaxTTL:     DefaultMaxTokenTTL,
+		Issuer:     DefaultIssuer,
+		Audience:   DefaultAudience,
+	}
+}
+
+// TTL returns the lifetime of a token the client asked to last requested,
+// where 0 means no preference, capped at MaxTTL.
+func (cfg TokenConfig) TTL(requested time.Duration) time.Duration {
+	if requested <= 0 {
+		requested = cfg.DefaultTTL
+	}
+	return min(requested, cfg.MaxTTL)
+}
+
+func CreateToken(cfg TokenConfig, id int, role string, ttl time.Duration) (string, error) {
+	jti, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
 	now := time.Now()
-	claims := &jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		IssuedAt:  jwt.NewNumericDate(now),
-		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
-		Subject:   strconv.Itoa(id),
+	claims := &Claims{
+		Role:          role,
+		IssuedAtNanos: now.UnixNano(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    cfg.Issuer,
+			Audience:  jwt.ClaimStrings{cfg.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(cfg.TTL(ttl))),
+			Subject:   strconv.Itoa(id),
+			ID:        jti,
+		},
+	}
+	if len(cfg.Keys) == 0 {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString([]byte(cfg.Secret))
+	}
+
+	key, err := cfg.signingKey()
+	if err != nil {
+		return "", err
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signedToken, err := token.SignedString([]byte(jwtSecret))
-	return signedToken, err
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.Id
+	return token.SignedString(key.Private)
 }
 
 func CreateRefToken() (string, error) {
-	refreshToken := make([]byte, 32)
-	_, err := rand.Read(refreshToken)
+	return randomHex(32)
+}
+
+func randomHex(size int) (string, error) {
+	random := make([]byte, size)
+	_, err := rand.Read(random)
 	if err != nil {
 		return "", err
 	}
-	return hex.EncodeToString(refreshToken), nil
+	return hex.EncodeToString(random), nil
+}
+
+// HashRefToken returns the digest refresh tokens are stored and looked up by,
+// so the database never holds a usable token.
+func HashRefToken(refreshToken string) string {
+	digest := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(digest[:])
+}
+
+// CreateOneTimeToken returns a token for a link sent by email, e.g. to verify
+// an address. Like refresh tokens, they're only stored as a digest.
+func CreateOneTimeToken() (string, error) {
+	return randomHex(32)
+}
+
+// HashOneTimeToken returns the digest one-time tokens are stored by.
+func HashOneTimeToken(token string) string {
+	return HashRefToken(token)
+}
+
+// RefTokenHashesEqual compares two refresh token digests in constant time.
+func RefTokenHashesEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// ValidateToken checks the signature, lifetime (exp and nbf), issuer and
+// audience of tokenStr.
+func ValidateToken(tokenStr string, cfg TokenConfig) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(
+		tokenStr,
+		&Claims{},
+		cfg.verificationKey,
+		jwt.WithIssuer(cfg.Issuer),
+		jwt.WithAudience(cfg.Audience),
+		jwt.WithExpirationRequired(),
+	)
+}
+
+// acceptsHMAC reports whether HS256 tokens signed with Secret are valid.
+func (cfg TokenConfig) acceptsHMAC() bool {
+	if len(cfg.Keys) == 0 {
+		return true
+	}
+	return cfg.Secret != "" && time.Now().Before(cfg.HMACUntil)
 }
 
-func ValidateToken(tokenStr string, jwtSecret string) (*jwt.Token, error) {
-	return jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{}, func(token *jwt.Token) (any, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(jwtSecret), nil
-	})
+func (cfg TokenConfig) verificationKey(token *jwt.Token) (any, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok && cfg.acceptsHMAC() {
+		return []byte(cfg.Secret), nil
+	}
+	if len(cfg.Keys) == 0 {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := cfg.findKey(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.Public, nil
 }
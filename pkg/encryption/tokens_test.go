@@ -0,0 +1,85 @@
+package encryption
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestTokenConfigTTL(t *testing.T) {
+	cfg := NewTokenConfig("secret")
+
+	tests := []struct {
+		name      string
+		requested time.Duration
+		expected  time.Duration
+	}{
+		{"no preference", 0, DefaultTokenTTL},
+		{"shorter than default", time.Minute, time.Minute},
+		{"longer than default", 2 * time.Hour, 2 * time.Hour},
+		{"capped at max", 48 * time.Hour, DefaultMaxTokenTTL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ttl := cfg.TTL(tt.requested); ttl != tt.expected {
+				t.Errorf("TTL(%v) = %v; want %v", tt.requested, ttl, tt.expected)
+			}
+		})
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	cfg := NewTokenConfig("secret")
+	otherService := cfg
+	otherService.Audience = "other-service"
+	otherIssuer := cfg
+	otherIssuer.Issuer = "someone-else"
+
+	sign := func(claims jwt.Claims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(cfg.Secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid, _ := CreateToken(cfg, 1, "user", 0)
+	wrongAudience, _ := CreateToken(otherService, 1, "user", 0)
+	wrongIssuer, _ := CreateToken(otherIssuer, 1, "user", 0)
+	now := time.Now()
+	notYetValid := sign(jwt.RegisteredClaims{
+		Issuer:    cfg.Issuer,
+		Audience:  jwt.ClaimStrings{cfg.Audience},
+		NotBefore: jwt.NewNumericDate(now.Add(time.Hour)),
+		ExpiresAt: jwt.NewNumericDate(now.Add(2 * time.Hour)),
+		Subject:   "1",
+	})
+	expired := sign(jwt.RegisteredClaims{
+		Issuer:    cfg.Issuer,
+		Audience:  jwt.ClaimStrings{cfg.Audience},
+		ExpiresAt: jwt.NewNumericDate(now.Add(-time.Minute)),
+		Subject:   "1",
+	})
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid", valid, false},
+		{"minted for another service", wrongAudience, true},
+		{"minted by another issuer", wrongIssuer, true},
+		{"not valid yet", notYetValid, true},
+		{"expired", expired, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateToken(tt.token, cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateToken() error = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
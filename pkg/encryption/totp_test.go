@@ -0,0 +1,102 @@
+package encryption
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 secret of the RFC 6238 test vectors,
+// "12345678901234567890", base32 encoded.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// The RFC's 8 digit codes, truncated to the last 6.
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		code, err := TOTPCode(rfc6238Secret, TOTPStep(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.expected {
+			t.Errorf("TOTPCode(T=%d) = %s; want %s", tt.unix, code, tt.expected)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	step := TOTPStep(now)
+	code := func(step int64) string {
+		code, _ := TOTPCode(rfc6238Secret, step)
+		return code
+	}
+
+	tests := []struct {
+		name  string
+		code  string
+		valid bool
+	}{
+		{"current step", code(step), true},
+		{"previous step", code(step - 1), true},
+		{"next step", code(step + 1), true},
+		{"too old", code(step - 2), false},
+		{"wrong code", "000000", false},
+		{"too short", code(step)[:5], false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, valid := ValidateTOTP(rfc6238Secret, tt.code, now)
+			if valid != tt.valid {
+				t.Errorf("ValidateTOTP(%s) = %v; want %v", tt.code, valid, tt.valid)
+			}
+		})
+	}
+
+	matched, _ := ValidateTOTP(rfc6238Secret, code(step-1), now)
+	if matched != step-1 {
+		t.Errorf("ValidateTOTP() step = %d; want %d", matched, step-1)
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("SECRET", "Chirpy", "bob@example.com")
+	expected := "otpauth://totp/Chirpy:bob@example.com?algorithm=SHA1&digits=6&issuer=Chirpy&period=30&secret=SECRET"
+	if uri != expected {
+		t.Errorf("TOTPURI() = %s; want %s", uri, expected)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 19 || strings.Count(code, "-") != 3 {
+			t.Errorf("badly formatted recovery code %q", code)
+		}
+		seen[code] = true
+	}
+	if len(seen) != 10 {
+		t.Errorf("GenerateRecoveryCodes(10) returned %d distinct codes", len(seen))
+	}
+
+	sloppy := strings.ToUpper(strings.ReplaceAll(codes[0], "-", " "))
+	if HashRecoveryCode(sloppy) != HashRecoveryCode(codes[0]) {
+		t.Errorf("HashRecoveryCode(%q) differs from HashRecoveryCode(%q)", sloppy, codes[0])
+	}
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/internal/db"
+	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+)
+
+type AdminUserResp struct {
+	Id          int       `json:"id"`
+	Email       string    `json:"email"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	Role        string    `json:"role"`
+	Banned      bool      `json:"banned"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func newAdminUserResp(user db.User) AdminUserResp {
+	return AdminUserResp{
+		Id:          user.Id,
+		Email:       user.Email,
+		IsChirpyRed: user.IsChirpyRed,
+		Role:        user.Role,
+		Banned:      user.Banned,
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
+	}
+}
+
+type AdminUsersResp struct {
+	Users []AdminUserResp `json:"users"`
+}
+
+type UserIdReq struct {
+	userID int
+}
+
+func (req *UserIdReq) validate(r *http.Request) *api_errors.ClientErr {
+	reqUserID := r.PathValue("userID")
+	userID, err := strconv.Atoi(reqUserID)
+	if reqUserID == "" || err != nil {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "invalid request params",
+			Errors:   map[string]string{"userID": "UserID not provided or invalid"},
+		}
+	}
+	req.userID = userID
+	return nil
+}
+
+type UserRoleReq struct {
+	Role string `json:"role"`
+}
+
+func (req *UserRoleReq) validate(r *http.Request) *api_errors.ClientErr {
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid JSON",
+		}
+	}
+
+	if !db.ValidRole(req.Role) {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid body parameters",
+			Errors: map[string]string{
+				"role": "role must be one of user, moderator or admin",
+			},
+		}
+	}
+	return nil
+}
+
+func (apiCfg *ApiConfig) GetAdminUsers(w http.ResponseWriter, r *http.Request) error {
+	users, err := apiCfg.DB.ListUsers()
+	if err != nil {
+		return err
+	}
+
+	resp := AdminUsersResp{Users: make([]AdminUserResp, 0, len(users))}
+	for _, user := range users {
+		resp.Users = append(resp.Users, newAdminUserResp(user))
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+func (apiCfg *ApiConfig) PutUserRole(w http.ResponseWriter, r *http.Request) error {
+	userIdReq := UserIdReq{}
+	if clientErr := userIdReq.validate(r); clientErr != nil {
+		return clientErr
+	}
+	roleReq := &UserRoleReq{}
+	if clientErr := roleReq.validate(r); clientErr != nil {
+		return clientErr
+	}
+	if clientErr := checkNotSelf(r, userIdReq.userID, "change their own role"); clientErr != nil {
+		return clientErr
+	}
+
+	user, err := apiCfg.DB.SetUserRole(userIdReq.userID, roleReq.Role)
+	if err != nil {
+		return err
+	}
+
+	respondWithJSON(w, http.StatusOK, newAdminUserResp(user))
+	return nil
+}
+
+func (apiCfg *ApiConfig) PostUserBan(w http.ResponseWriter, r *http.Request) error {
+	return apiCfg.setUserBanned(w, r, true)
+}
+
+func (apiCfg *ApiConfig) DeleteUserBan(w http.ResponseWriter, r *http.Request) error {
+	return apiCfg.setUserBanned(w, r, false)
+}
+
+func (apiCfg *ApiConfig) setUserBanned(w http.ResponseWriter, r *http.Request, banned bool) error {
+	userIdReq := UserIdReq{}
+	if clientErr := userIdReq.validate(r); clientErr != nil {
+		return clientErr
+	}
+	if clientErr := checkNotSelf(r, userIdReq.userID, "ban themselves"); clientErr != nil {
+		return clientErr
+	}
+
+	user, err := apiCfg.DB.SetUserBanned(userIdReq.userID, banned)
+	if err != nil {
+		return err
+	}
+
+	respondWithJSON(w, http.StatusOK, newAdminUserResp(user))
+	return nil
+}
+
+// DeleteUserLockout lets a user whose account was locked by failed logins try
+// again right away.
+func (apiCfg *ApiConfig) DeleteUserLockout(w http.ResponseWriter, r *http.Request) error {
+	userIdReq := UserIdReq{}
+	if clientErr := userIdReq.validate(r); clientErr != nil {
+		return clientErr
+	}
+
+	user, err := apiCfg.DB.UnlockUser(userIdReq.userID)
+	if err != nil {
+		return err
+	}
+
+	respondWithJSON(w, http.StatusOK, newAdminUserResp(user))
+	return nil
+}
+
+// checkNotSelf stops admins from locking themselves out, which could leave
+// the server without any admin.
+func checkNotSelf(r *http.Request, userID int, action string) *api_errors.ClientErr {
+	if currentUser(r).Id != userID {
+		return nil
+	}
+	return &api_errors.ClientErr{
+		HttpCode: http.StatusBadRequest,
+		Message:  "admins can't " + action,
+	}
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ajaen4/go-standard-lib-api/internal/db"
+	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+)
+
+type contextKey int
+
+const (
+	userContextKey contextKey = iota
+	claimsContextKey
+)
+
+// UserFromContext returns the user authenticated by RequireAuth.
+func UserFromContext(ctx context.Context) (db.User, bool) {
+	user, ok := ctx.Value(userContextKey).(db.User)
+	return user, ok
+}
+
+// ClaimsFromContext returns the claims of the access token RequireAuth
+// accepted.
+func ClaimsFromContext(ctx context.Context) (*encryption.Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(*encryption.Claims)
+	return claims, ok
+}
+
+// currentUser must only be called from handlers wrapped in RequireAuth.
+func currentUser(r *http.Request) db.User {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		panic("currentUser called on a route without RequireAuth")
+	}
+	return user
+}
+
+// currentClaims must only be called from handlers wrapped in RequireAuth.
+func currentClaims(r *http.Request) *encryption.Claims {
+	claims, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		panic("currentClaims called on a route without RequireAuth")
+	}
+	return claims
+}
+
+// RequireAuth validates the bearer JWT of the request and loads its user into
+// the request context before calling next.
+func (apiCfg *ApiConfig) RequireAuth(next CustomHandler) CustomHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		user, claims, err := apiCfg.authenticate(r)
+		if err != nil {
+			var clientErr *api_errors.ClientErr
+			if errors.As(err, &clientErr) && clientErr.HttpCode == http.StatusUnauthorized {
+				challenge := `Bearer realm="chirpy"`
+				if r.Header.Get("Authorization") != "" {
+					challenge += `, error="invalid_token"`
+				}
+				w.Header().Set("WWW-Authenticate", challenge)
+			}
+			return err
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		ctx = context.WithValue(ctx, claimsContextKey, claims)
+		return next(w, r.WithContext(ctx))
+	}
+}
+
+func unauthorized(logMess string) *api_errors.ClientErr {
+	apiErr := api_errors.UnauthErr
+	apiErr.LogMess = logMess
+	return &apiErr
+}
+
+// authenticate accepts a signed, unexpired access token unless it was revoked
+// on its own or issued no later than its user's TokensValidAfter.
+func (apiCfg *ApiConfig) authenticate(r *http.Request) (db.User, *encryption.Claims, error) {
+	tokenStr, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return db.User{}, nil, unauthorized("missing bearer token")
+	}
+
+	token, err := encryption.ValidateToken(tokenStr, apiCfg.TokenConfig)
+	if err != nil {
+		return db.User{}, nil, unauthorized(err.Error())
+	}
+	claims := token.Claims.(*encryption.Claims)
+
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return db.User{}, nil, unauthorized(err.Error())
+	}
+	if claims.ID == "" || claims.IssuedAt == nil {
+		return db.User{}, nil, unauthorized("token without jti or iat")
+	}
+
+	revoked, err := apiCfg.DB.IsAccessTokenRevoked(claims.ID)
+	if err != nil {
+		return db.User{}, nil, err
+	}
+	if revoked {
+		return db.User{}, nil, unauthorized("revoked token " + claims.ID)
+	}
+
+	user, err := apiCfg.DB.GetUser(userId)
+	if err != nil {
+		return db.User{}, nil, unauthorized(err.Error())
+	}
+	if !claims.Issued().After(user.TokensValidAfter) {
+		return db.User{}, nil, unauthorized("token issued before the user's tokens were invalidated")
+	}
+	if user.Banned {
+		apiErr := db.ErrUserBanned
+		return db.User{}, nil, &apiErr
+	}
+	return user, claims, nil
+}
+
+// GetJWKS publishes the public keys access tokens are signed with.
+func (apiCfg *ApiConfig) GetJWKS(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, apiCfg.TokenConfig.JWKS())
+	return nil
+}
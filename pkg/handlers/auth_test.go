@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/internal/db"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestRequireAuth(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	apiCfg := &ApiConfig{DB: store, TokenConfig: encryption.NewTokenConfig("secret")}
+
+	user, err := store.CreateUser("test@email.com", "testPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	validToken, _ := encryption.CreateToken(apiCfg.TokenConfig, user.Id, user.Role, 0)
+	otherSecretToken, _ := encryption.CreateToken(encryption.NewTokenConfig("other secret"), user.Id, user.Role, 0)
+	unknownUserToken, _ := encryption.CreateToken(apiCfg.TokenConfig, user.Id+1, user.Role, 0)
+
+	tests := []struct {
+		name         string
+		authHeader   string
+		expectedCode int
+		challenge    string
+	}{
+		{"no header", "", http.StatusUnauthorized, `Bearer realm="chirpy"`},
+		{"not a bearer token", "ApiKey " + validToken, http.StatusUnauthorized, `Bearer realm="chirpy", error="invalid_token"`},
+		{"wrong signature", "Bearer " + otherSecretToken, http.StatusUnauthorized, `Bearer realm="chirpy", error="invalid_token"`},
+		{"unknown user", "Bearer " + unknownUserToken, http.StatusUnauthorized, `Bearer realm="chirpy", error="invalid_token"`},
+		{"valid token", "Bearer " + validToken, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotUser db.User
+			handler := apiCfg.RequireAuth(func(w http.ResponseWriter, r *http.Request) error {
+				gotUser = currentUser(r)
+				return nil
+			})
+
+			req := httptest.NewRequest("GET", "/api/test", nil)
+			if tt.authHeader != "" {
+				req.Header.Set("Authorization", tt.authHeader)
+			}
+			w := httptest.NewRecorder()
+			NewHandler(handler).ServeHTTP(w, req)
+
+			if w.Code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", w.Code, tt.expectedCode)
+			}
+			if challenge := w.Header().Get("WWW-Authenticate"); challenge != tt.challenge {
+				t.Errorf("handler returned wrong WWW-Authenticate: got %q want %q", challenge, tt.challenge)
+			}
+			if tt.expectedCode == http.StatusOK && gotUser.Id != user.Id {
+				t.Errorf("handler got wrong user from context: got %v want %v", gotUser.Id, user.Id)
+			}
+		})
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	apiCfg := &ApiConfig{DB: store, TokenConfig: encryption.NewTokenConfig("secret")}
+
+	user, _ := store.CreateUser("user@email.com", "testPassword")
+	admin, _ := store.CreateUser("admin@email.com", "testPassword")
+	admin, _ = store.SetUserRole(admin.Id, db.RoleAdmin)
+	banned, _ := store.CreateUser("banned@email.com", "testPassword")
+	banned, _ = store.SetUserBanned(banned.Id, true)
+
+	tests := []struct {
+		name         string
+		user         db.User
+		expectedCode int
+	}{
+		{"user lacks permission", user, http.StatusForbidden},
+		{"admin has permission", admin, http.StatusOK},
+		{"banned user", banned, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := apiCfg.RequirePermission(PermManageUsers, func(w http.ResponseWriter, r *http.Request) error {
+				return nil
+			})
+
+			token, _ := encryption.CreateToken(apiCfg.TokenConfig, tt.user.Id, tt.user.Role, 0)
+			req := httptest.NewRequest("GET", "/api/admin/users", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			NewHandler(handler).ServeHTTP(w, req)
+
+			if w.Code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", w.Code, tt.expectedCode)
+			}
+		})
+	}
+}
+
+func TestRequireAuthRejectsRevokedTokens(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	apiCfg := &ApiConfig{DB: store, TokenConfig: encryption.NewTokenConfig("secret")}
+	user, _ := store.CreateUser("test@email.com", "testPassword")
+
+	serve := func(handler CustomHandler, token string) int {
+		req := httptest.NewRequest("POST", "/api/test", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		NewHandler(apiCfg.RequireAuth(handler)).ServeHTTP(w, req)
+		return w.Code
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) error { return nil }
+
+	loggedOut, _ := encryption.CreateToken(apiCfg.TokenConfig, user.Id, user.Role, 0)
+	if code := serve(apiCfg.PostLogout, loggedOut); code != http.StatusNoContent {
+		t.Fatalf("logout returned %v want %v", code, http.StatusNoContent)
+	}
+	if code := serve(ok, loggedOut); code != http.StatusUnauthorized {
+		t.Errorf("token used after logout: got %v want %v", code, http.StatusUnauthorized)
+	}
+
+	issuedEarlier, err := jwt.NewWithClaims(jwt.SigningMethodHS256, &encryption.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    apiCfg.TokenConfig.Issuer,
+			Audience:  jwt.ClaimStrings{apiCfg.TokenConfig.Audience},
+			IssuedAt:  jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			Subject:   strconv.Itoa(user.Id),
+			ID:        "issued-earlier",
+		},
+	}).SignedString([]byte(apiCfg.TokenConfig.Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(ok, issuedEarlier); code != http.StatusOK {
+		t.Fatalf("token rejected before password change: got %v", code)
+	}
+	_, err = store.UpdateUser(user.Id, user.Email, "newPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := serve(ok, issuedEarlier); code != http.StatusUnauthorized {
+		t.Errorf("token issued before password change: got %v want %v", code, http.StatusUnauthorized)
+	}
+	issuedAfter, _ := encryption.CreateToken(apiCfg.TokenConfig, user.Id, user.Role, 0)
+	if code := serve(ok, issuedAfter); code != http.StatusOK {
+		t.Errorf("token issued after password change: got %v want %v", code, http.StatusOK)
+	}
+
+	// iat only has seconds, so tokens issued in the same second as the
+	// change are told apart by iat_ns.
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	sameSecond, _ := encryption.CreateToken(apiCfg.TokenConfig, user.Id, user.Role, 0)
+	_, err = store.UpdateUser(user.Id, user.Email, "otherPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameSecondAfter, _ := encryption.CreateToken(apiCfg.TokenConfig, user.Id, user.Role, 0)
+	if code := serve(ok, sameSecond); code != http.StatusUnauthorized {
+		t.Errorf("token issued the same second before password change: got %v want %v", code, http.StatusUnauthorized)
+	}
+	if code := serve(ok, sameSecondAfter); code != http.StatusOK {
+		t.Errorf("token issued the same second after password change: got %v want %v", code, http.StatusOK)
+	}
+}
@@ -1,14 +1,17 @@
 package handlers
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/ajaen4/go-standard-lib-api/internal/db"
 	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
-	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+	"github.com/ajaen4/go-standard-lib-api/pkg/content_filter"
 )
 
 type PostChirpReq struct {
@@ -40,9 +43,49 @@ func (chirpReq *PostChirpReq) validate(r *http.Request) *api_errors.ClientErr {
 	return nil
 }
 
+const (
+	defaultChirpsLimit = 20
+	maxChirpsLimit     = 100
+)
+
 type GetChirpsReq struct {
 	authorId int
+	flagged  bool
 	sortBy   string
+	limit    int
+	afterId  int
+}
+
+type ChirpsResp struct {
+	Chirps     []db.Chirp `json:"chirps"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+// Cursors are opaque to clients: base64 encoded JSON, so the format can change
+// without breaking anyone who just passes next_cursor back.
+type chirpsCursor struct {
+	AfterId int `json:"after_id"`
+}
+
+func encodeCursor(afterId int) string {
+	jsonCursor, _ := json.Marshal(chirpsCursor{AfterId: afterId})
+	return base64.RawURLEncoding.EncodeToString(jsonCursor)
+}
+
+func decodeCursor(cursor string) (int, error) {
+	jsonCursor, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	decoded := chirpsCursor{}
+	err = json.Unmarshal(jsonCursor, &decoded)
+	if err != nil {
+		return 0, err
+	}
+	if decoded.AfterId <= 0 {
+		return 0, errors.New("cursor without position")
+	}
+	return decoded.AfterId, nil
 }
 
 func (req *GetChirpsReq) validate(r *http.Request) *api_errors.ClientErr {
@@ -62,6 +105,16 @@ func (req *GetChirpsReq) validate(r *http.Request) *api_errors.ClientErr {
 		}
 	}
 
+	flagged := r.URL.Query().Get("flagged")
+	if flagged != "" {
+		flaggedBool, err := strconv.ParseBool(flagged)
+		if err != nil {
+			apiErr.Errors["flagged"] = "invalid flagged query parameter"
+		} else {
+			req.flagged = flaggedBool
+		}
+	}
+
 	sortBy := r.URL.Query().Get("sort")
 	if sortBy == "" {
 		sortBy = "asc"
@@ -72,6 +125,83 @@ func (req *GetChirpsReq) validate(r *http.Request) *api_errors.ClientErr {
 		req.sortBy = sortBy
 	}
 
+	req.limit = defaultChirpsLimit
+	limit := r.URL.Query().Get("limit")
+	if limit != "" {
+		limitInt, err := strconv.Atoi(limit)
+		if err != nil || limitInt < 1 || limitInt > maxChirpsLimit {
+			apiErr.Errors["limit"] = "invalid limit query parameter"
+		} else {
+			req.limit = limitInt
+		}
+	}
+
+	cursor := r.URL.Query().Get("cursor")
+	if cursor != "" {
+		afterId, err := decodeCursor(cursor)
+		if err != nil {
+			apiErr.Errors["cursor"] = "invalid cursor query parameter"
+		} else {
+			req.afterId = afterId
+		}
+	}
+
+	if len(apiErr.Errors) > 0 {
+		return apiErr
+	}
+	return nil
+}
+
+type SearchChirpsReq struct {
+	text     string
+	authorId int
+	sortBy   string
+	limit    int
+}
+
+func (req *SearchChirpsReq) validate(r *http.Request) *api_errors.ClientErr {
+	apiErr := &api_errors.ClientErr{
+		HttpCode: http.StatusBadRequest,
+		Message:  "invalid request params",
+		Errors:   map[string]string{},
+	}
+
+	req.text = strings.TrimSpace(r.URL.Query().Get("q"))
+	if req.text == "" || len(req.text) > 140 {
+		apiErr.Errors["q"] = "invalid q query parameter"
+	}
+
+	authorId := r.URL.Query().Get("author_id")
+	if authorId != "" {
+		authorIdInt, err := strconv.Atoi(authorId)
+		if err != nil {
+			apiErr.Errors["author_id"] = "invalid author_id query parameter"
+		} else {
+			req.authorId = authorIdInt
+		}
+	}
+
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = db.SearchByRelevance
+	}
+	if sortBy != db.SearchByRelevance && sortBy != db.SearchByRecency {
+		apiErr.Errors["sort"] = "invalid sort query parameter"
+	} else {
+		req.sortBy = sortBy
+	}
+
+	req.limit = defaultChirpsLimit
+	limit := r.URL.Query().Get("limit")
+	if limit != "" {
+		limitInt, err := strconv.Atoi(limit)
+		if err != nil || limitInt < 1 || limitInt > maxChirpsLimit {
+			apiErr.Errors["limit"] = "invalid limit query parameter"
+		} else {
+			req.limit = limitInt
+		}
+	}
+
 	if len(apiErr.Errors) > 0 {
 		return apiErr
 	}
@@ -104,37 +234,18 @@ func (req *ChirpReq) validate(r *http.Request) *api_errors.ClientErr {
 }
 
 func (apiCfg *ApiConfig) PostChirp(w http.ResponseWriter, r *http.Request) error {
-	authHeader := r.Header.Get("Authorization")
-	tokenStr := strings.Replace(authHeader, "Bearer ", "", 1)
-	token, err := encryption.ValidateToken(tokenStr, apiCfg.JwtSecret)
-	if err != nil {
-		apiErr := api_errors.UnauthErr
-		apiErr.LogMess = err.Error()
-		return &apiErr
-	}
+	userId := currentUser(r).Id
 
-	subject, err := token.Claims.GetSubject()
-	if err != nil {
-		apiErr := api_errors.UnauthErr
-		apiErr.LogMess = err.Error()
-		return &apiErr
-	}
-
-	userId, err := strconv.Atoi(subject)
-	if err != nil {
-		apiErr := api_errors.UnauthErr
-		apiErr.LogMess = err.Error()
-		return &apiErr
+	chirpReq := &PostChirpReq{}
+	if clientErr := chirpReq.validate(r); clientErr != nil {
+		return clientErr
 	}
 
-	chirpReq := &PostChirpReq{}
-	err = chirpReq.validate(r)
+	filtered, err := apiCfg.filterChirp(chirpReq.Body)
 	if err != nil {
 		return err
 	}
-
-	cleanWords := ProcessWords(chirpReq.Body)
-	chirp, err := apiCfg.DB.CreateChirp(cleanWords, userId)
+	chirp, err := apiCfg.DB.CreateChirp(filtered.Body, userId, filtered.Flagged)
 	if err != nil {
 		return err
 	}
@@ -143,36 +254,80 @@ func (apiCfg *ApiConfig) PostChirp(w http.ResponseWriter, r *http.Request) error
 	return nil
 }
 
-func ProcessWords(str string) string {
-	words := strings.Split(str, " ")
-	newWords := make([]string, len(words))
-	for i, word := range words {
-		lWord := strings.ToLower(word)
-		if lWord == "kerfuffle" || lWord == "sharbert" || lWord == "fornax" {
-			newWords[i] = "****"
-		} else {
-			newWords[i] = word
+// filterChirp runs body through the content filter, rejecting the request if
+// it contains a banned word.
+func (apiCfg *ApiConfig) filterChirp(body string) (content_filter.Result, error) {
+	result := apiCfg.ContentFilter.Apply(body)
+	if result.Rejected {
+		return result, &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid body parameters",
+			LogMess:  fmt.Sprintf("chirp rejected by content filter: %v", result.Matches),
+			Errors:   map[string]string{"body": "body contains banned words"},
 		}
 	}
-	return strings.Join(newWords, " ")
+	return result, nil
 }
 
 func (apiCfg *ApiConfig) GetChirps(w http.ResponseWriter, request *http.Request) error {
 	chirpsReq := GetChirpsReq{}
-	chirpsReq.validate(request)
+	clientErr := chirpsReq.validate(request)
+	if clientErr != nil {
+		return clientErr
+	}
 
-	var chirps []db.Chirp
-	var err error
-	if chirpsReq.authorId == 0 {
-		chirps, err = apiCfg.DB.GetChirps(chirpsReq.sortBy)
-	} else {
-		chirps, err = apiCfg.DB.GetChirpsByAuthId(chirpsReq.authorId, chirpsReq.sortBy)
+	list := func(w http.ResponseWriter, request *http.Request) error {
+		return apiCfg.listChirps(w, request, chirpsReq)
 	}
+	// Flagged chirps are the moderation queue.
+	if chirpsReq.flagged {
+		return apiCfg.RequirePermission(PermModerateChirps, list)(w, request)
+	}
+	return list(w, request)
+}
+
+func (apiCfg *ApiConfig) listChirps(w http.ResponseWriter, request *http.Request, chirpsReq GetChirpsReq) error {
+	chirps, hasMore, err := apiCfg.DB.GetChirps(db.ChirpsQuery{
+		AuthorId: chirpsReq.authorId,
+		Flagged:  chirpsReq.flagged,
+		SortBy:   chirpsReq.sortBy,
+		AfterId:  chirpsReq.afterId,
+		Limit:    chirpsReq.limit,
+	})
 	if err != nil {
 		return err
 	}
 
-	respondWithJSON(w, http.StatusOK, chirps)
+	resp := ChirpsResp{Chirps: chirps}
+	if hasMore {
+		resp.NextCursor = encodeCursor(chirps[len(chirps)-1].Id)
+		nextQuery := request.URL.Query()
+		nextQuery.Set("cursor", resp.NextCursor)
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, request.URL.Path, nextQuery.Encode()))
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+func (apiCfg *ApiConfig) SearchChirps(w http.ResponseWriter, request *http.Request) error {
+	searchReq := SearchChirpsReq{}
+	clientErr := searchReq.validate(request)
+	if clientErr != nil {
+		return clientErr
+	}
+
+	chirps, err := apiCfg.DB.SearchChirps(db.SearchQuery{
+		Text:     searchReq.text,
+		AuthorId: searchReq.authorId,
+		SortBy:   searchReq.sortBy,
+		Limit:    searchReq.limit,
+	})
+	if err != nil {
+		return err
+	}
+
+	respondWithJSON(w, http.StatusOK, ChirpsResp{Chirps: chirps})
 	return nil
 }
 
@@ -192,37 +347,66 @@ func (apiCfg *ApiConfig) GetChirp(w http.ResponseWriter, request *http.Request)
 	return nil
 }
 
-func (apiCfg *ApiConfig) DeleteChirp(w http.ResponseWriter, r *http.Request) error {
-	authHeader := r.Header.Get("Authorization")
-	tokenStr := strings.Replace(authHeader, "Bearer ", "", 1)
-	token, err := encryption.ValidateToken(tokenStr, apiCfg.JwtSecret)
-	if err != nil {
-		apiErr := api_errors.UnauthErr
-		apiErr.LogMess = err.Error()
-		return &apiErr
+func (apiCfg *ApiConfig) PutChirp(w http.ResponseWriter, r *http.Request) error {
+	userId := currentUser(r).Id
+
+	chirpReq := ChirpReq{}
+	if clientErr := chirpReq.validate(r); clientErr != nil {
+		return clientErr
+	}
+	putChirpReq := &PostChirpReq{}
+	if clientErr := putChirpReq.validate(r); clientErr != nil {
+		return clientErr
 	}
 
-	subject, err := token.Claims.GetSubject()
+	filtered, err := apiCfg.filterChirp(putChirpReq.Body)
 	if err != nil {
-		apiErr := api_errors.UnauthErr
-		apiErr.LogMess = err.Error()
-		return &apiErr
+		return err
 	}
-
-	userId, err := strconv.Atoi(subject)
+	chirp, err := apiCfg.DB.UpdateChirp(
+		userId, chirpReq.chirpID, filtered.Body, filtered.Flagged, apiCfg.ChirpEditWindow,
+	)
 	if err != nil {
-		apiErr := api_errors.UnauthErr
-		apiErr.LogMess = err.Error()
-		return &apiErr
+		return err
 	}
 
+	respondWithJSON(w, http.StatusOK, chirp)
+	return nil
+}
+
+type ChirpHistoryResp struct {
+	ChirpId  int               `json:"chirp_id"`
+	Versions []db.ChirpVersion `json:"versions"`
+}
+
+func (apiCfg *ApiConfig) GetChirpHistory(w http.ResponseWriter, request *http.Request) error {
 	chirpReq := ChirpReq{}
-	err = chirpReq.validate(r)
+	clientErr := chirpReq.validate(request)
+	if clientErr != nil {
+		return clientErr
+	}
+
+	versions, err := apiCfg.DB.GetChirpHistory(currentUser(request).Id, chirpReq.chirpID)
 	if err != nil {
 		return err
 	}
 
-	err = apiCfg.DB.DeleteChirp(userId, chirpReq.chirpID)
+	respondWithJSON(w, http.StatusOK, ChirpHistoryResp{
+		ChirpId:  chirpReq.chirpID,
+		Versions: versions,
+	})
+	return nil
+}
+
+func (apiCfg *ApiConfig) DeleteChirp(w http.ResponseWriter, r *http.Request) error {
+	userId := currentUser(r).Id
+
+	chirpReq := ChirpReq{}
+	if clientErr := chirpReq.validate(r); clientErr != nil {
+		return clientErr
+	}
+
+	err := apiCfg.DB.DeleteChirp(userId, chirpReq.chirpID)
 	if err != nil {
 		return err
 	}
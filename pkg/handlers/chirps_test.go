@@ -3,34 +3,16 @@ package handlers
 import (
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/ajaen4/go-standard-lib-api/internal/db"
 	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
 )
 
-func TestProcessWords(t *testing.T) {
-	tests := []struct {
-		name     string
-		input    string
-		expected string
-	}{
-		{"empty string", "", ""},
-		{"no words are processed", "Hello new world", "Hello new world"},
-		{"some words are processed", "kerfuffle new world", "**** new world"},
-		{"all words are processed", "kerfuffle sharbert fornax", "**** **** ****"},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			result := ProcessWords(tt.input)
-			if result != tt.expected {
-				t.Errorf("ProcessWords(%s) = %s; want %s", tt.input, result, tt.expected)
-			}
-		})
-	}
-}
-
 func TestPostChirpReq_validate(t *testing.T) {
 
 	tests := []struct {
@@ -115,6 +97,71 @@ func TestPostChirpReq_validate(t *testing.T) {
 	}
 }
 
+func TestGetChirpsReq_validate(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		expectedRes GetChirpsReq
+		expectedErr *api_errors.ClientErr
+	}{
+		{
+			"defaults",
+			"",
+			GetChirpsReq{sortBy: "asc", limit: defaultChirpsLimit},
+			nil,
+		},
+		{
+			"all params",
+			"?author_id=2&sort=desc&limit=5&cursor=" + encodeCursor(10),
+			GetChirpsReq{authorId: 2, sortBy: "desc", limit: 5, afterId: 10},
+			nil,
+		},
+		{
+			"limit too high",
+			"?limit=1000",
+			GetChirpsReq{},
+			&api_errors.ClientErr{
+				HttpCode: http.StatusBadRequest,
+				Message:  "invalid request params",
+				Errors: map[string]string{
+					"limit": "invalid limit query parameter",
+				},
+			},
+		},
+		{
+			"malformed cursor",
+			"?cursor=not-a-cursor",
+			GetChirpsReq{},
+			&api_errors.ClientErr{
+				HttpCode: http.StatusBadRequest,
+				Message:  "invalid request params",
+				Errors: map[string]string{
+					"cursor": "invalid cursor query parameter",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "/api/chirps"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			chirpsReq := GetChirpsReq{}
+			resultErr := chirpsReq.validate(req)
+			if !compareErrors(resultErr, tt.expectedErr) {
+				t.Errorf("Error returned, got %v want %v", resultErr, tt.expectedErr)
+			}
+
+			if tt.expectedErr == nil && chirpsReq != tt.expectedRes {
+				t.Errorf("Got %v want %v", chirpsReq, tt.expectedRes)
+			}
+		})
+	}
+}
+
 func compareErrors(err1, err2 *api_errors.ClientErr) bool {
 	if err1 == nil && err2 == nil {
 		return true
@@ -138,3 +185,45 @@ func compareErrors(err1, err2 *api_errors.ClientErr) bool {
 	}
 	return true
 }
+
+func TestGetFlaggedChirps(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	apiCfg := &ApiConfig{DB: store, TokenConfig: encryption.NewTokenConfig("secret")}
+
+	user, _ := store.CreateUser("user@email.com", "testPassword")
+	moderator, _ := store.CreateUser("moderator@email.com", "testPassword")
+	moderator, _ = store.SetUserRole(moderator.Id, db.RoleModerator)
+	store.CreateChirp("flagged body", user.Id, true)
+	userToken, _ := encryption.CreateToken(apiCfg.TokenConfig, user.Id, user.Role, 0)
+	moderatorToken, _ := encryption.CreateToken(apiCfg.TokenConfig, moderator.Id, moderator.Role, 0)
+
+	tests := []struct {
+		name         string
+		query        string
+		token        string
+		expectedCode int
+	}{
+		{"anyone lists chirps", "", "", http.StatusOK},
+		{"anonymous moderation queue", "?flagged=true", "", http.StatusUnauthorized},
+		{"user moderation queue", "?flagged=true", userToken, http.StatusForbidden},
+		{"moderator moderation queue", "?flagged=true", moderatorToken, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/chirps"+tt.query, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			NewHandler(apiCfg.GetChirps).ServeHTTP(w, req)
+
+			if w.Code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", w.Code, tt.expectedCode)
+			}
+		})
+	}
+}
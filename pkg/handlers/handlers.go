@@ -3,38 +3,139 @@ package handlers
 import (
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/ajaen4/go-standard-lib-api/internal/db"
 	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+	"github.com/ajaen4/go-standard-lib-api/pkg/content_filter"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+	"github.com/ajaen4/go-standard-lib-api/pkg/mailer"
+	"github.com/ajaen4/go-standard-lib-api/pkg/password_policy"
+)
+
+const (
+	DefaultChirpEditWindow = 15 * time.Minute
+	DefaultRefreshTokenTTL = 60 * 24 * time.Hour
+
+	DefaultVerificationTokenTTL  = 24 * time.Hour
+	DefaultPasswordResetTokenTTL = 30 * time.Minute
+	DefaultLoginChallengeTTL     = 5 * time.Minute
+)
+
+// Failed logins are slowed down after a few tries and locked out after many.
+// An IP may be shared by many users, so it's allowed more.
+var (
+	DefaultAccountThrottle = db.ThrottlePolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+		ResetAfter:      time.Hour,
+	}
+	DefaultIPThrottle = db.ThrottlePolicy{
+		FreeAttempts:    10,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    100,
+		LockoutDuration: 15 * time.Minute,
+		ResetAfter:      time.Hour,
+	}
+)
+
+// Password reset emails are slowed down after a few, so they can't be used to
+// flood an inbox or keep replacing the link a user was sent.
+var (
+	DefaultResetAccountThrottle = db.ThrottlePolicy{
+		FreeAttempts: 3,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		ResetAfter:   24 * time.Hour,
+	}
+	DefaultResetIPThrottle = db.ThrottlePolicy{
+		FreeAttempts: 10,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		ResetAfter:   24 * time.Hour,
+	}
 )
 
 type ApiConfig struct {
-	JwtSecret      string
-	PolkaKey       string
-	FileserverHits int
-	DB             *db.DB
+	TokenConfig     encryption.TokenConfig
+	PolkaKey        string
+	FileserverHits  int
+	ChirpEditWindow time.Duration
+	RefreshTokenTTL time.Duration
+	ContentFilter   *content_filter.Filter
+	PasswordPolicy  password_policy.Policy
+	// StripEmailPlusTags makes "bob+tag@example.com" the same account as
+	// "bob@example.com".
+	StripEmailPlusTags bool
+	// Mailer sends verification and password reset emails; without one none
+	// are sent, and the endpoints that only send mail answer 503.
+	Mailer                mailer.Mailer
+	AppURL                string // base URL of the web app, for links in emails
+	VerificationTokenTTL  time.Duration
+	PasswordResetTokenTTL time.Duration
+	LoginChallengeTTL     time.Duration // how long a user has to enter their second factor
+	RequireVerifiedEmail  bool          // only users with a verified email can post chirps
+	// Throttling of failed logins, per account and per client IP. The zero
+	// values don't throttle.
+	AccountThrottle db.ThrottlePolicy
+	IPThrottle      db.ThrottlePolicy
+	// Throttling of password reset requests, per account and per client IP.
+	ResetAccountThrottle db.ThrottlePolicy
+	ResetIPThrottle      db.ThrottlePolicy
+	DB                   db.Store
 }
 
 func AssignHandlers(mux *http.ServeMux, apiCfg *ApiConfig) {
 	mux.HandleFunc("GET /api/healthz", HealthCheck)
+	mux.HandleFunc("GET /.well-known/jwks.json", NewHandler(apiCfg.GetJWKS))
 
 	fileHandler := http.FileServer(http.Dir("."))
 
 	mux.Handle("GET /app/*", apiCfg.MiddlewareMetricsInc(fileHandler))
-	mux.HandleFunc("GET /admin/metrics", apiCfg.MetricsCount)
-	mux.HandleFunc("/api/reset", apiCfg.MetricsReset)
+	mux.HandleFunc("GET /admin/metrics", NewHandler(apiCfg.RequirePermission(PermReadMetrics, apiCfg.MetricsCount)))
+	mux.HandleFunc("/api/reset", NewHandler(apiCfg.RequirePermission(PermResetMetrics, apiCfg.MetricsReset)))
 
 	mux.HandleFunc("GET /api/chirps", NewHandler(apiCfg.GetChirps))
+	mux.HandleFunc("GET /api/chirps/search", NewHandler(apiCfg.SearchChirps))
 	mux.HandleFunc("GET /api/chirps/{chirpID}", NewHandler(apiCfg.GetChirp))
-	mux.HandleFunc("POST /api/chirps", NewHandler(apiCfg.PostChirp))
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", NewHandler(apiCfg.DeleteChirp))
+	mux.HandleFunc("POST /api/chirps", NewHandler(apiCfg.RequirePermission(PermWriteChirps, apiCfg.RequireVerified(apiCfg.PostChirp))))
+	mux.HandleFunc("PUT /api/chirps/{chirpID}", NewHandler(apiCfg.RequirePermission(PermWriteChirps, apiCfg.RequireVerified(apiCfg.PutChirp))))
+	mux.HandleFunc("DELETE /api/chirps/{chirpID}", NewHandler(apiCfg.RequirePermission(PermWriteChirps, apiCfg.DeleteChirp)))
+	mux.HandleFunc("GET /api/chirps/{chirpID}/history", NewHandler(apiCfg.RequireAuth(apiCfg.GetChirpHistory)))
 
 	mux.HandleFunc("POST /api/users", NewHandler(apiCfg.PostUser))
-	mux.HandleFunc("PUT /api/users", NewHandler(apiCfg.PutUser))
+	mux.HandleFunc("PUT /api/users", NewHandler(apiCfg.RequireAuth(apiCfg.PutUser)))
+	mux.HandleFunc("GET /api/users/me", NewHandler(apiCfg.RequireAuth(apiCfg.GetCurrentUser)))
+	mux.HandleFunc("PATCH /api/users/me", NewHandler(apiCfg.RequireAuth(apiCfg.PatchUser)))
+	mux.HandleFunc("GET /api/users/{userID}", NewHandler(apiCfg.GetUserProfile))
+	mux.HandleFunc("POST /api/users/verify", NewHandler(apiCfg.PostVerifyEmail))
+	mux.HandleFunc("POST /api/users/verify/resend", NewHandler(apiCfg.RequireAuth(apiCfg.PostResendVerification)))
+	mux.HandleFunc("POST /api/users/2fa", NewHandler(apiCfg.RequireAuth(apiCfg.PostTOTPEnroll)))
+	mux.HandleFunc("POST /api/users/2fa/confirm", NewHandler(apiCfg.RequireAuth(apiCfg.PostTOTPConfirm)))
+	mux.HandleFunc("DELETE /api/users/2fa", NewHandler(apiCfg.RequireAuth(apiCfg.DeleteTOTP)))
+
+	mux.HandleFunc("POST /api/password/forgot", NewHandler(apiCfg.PostForgotPassword))
+	mux.HandleFunc("POST /api/password/reset", NewHandler(apiCfg.PostResetPassword))
 
 	mux.HandleFunc("POST /api/login", NewHandler(apiCfg.PostLogin))
+	mux.HandleFunc("POST /api/login/2fa", NewHandler(apiCfg.PostLoginTwoFactor))
 	mux.HandleFunc("POST /api/refresh", NewHandler(apiCfg.PostRefToken))
 	mux.HandleFunc("POST /api/revoke", NewHandler(apiCfg.PostRevokeToken))
+	mux.HandleFunc("POST /api/logout", NewHandler(apiCfg.RequireAuth(apiCfg.PostLogout)))
+
+	mux.HandleFunc("GET /api/admin/users", NewHandler(apiCfg.RequirePermission(PermManageUsers, apiCfg.GetAdminUsers)))
+	mux.HandleFunc("PUT /api/admin/users/{userID}/role", NewHandler(apiCfg.RequirePermission(PermManageUsers, apiCfg.PutUserRole)))
+	mux.HandleFunc("POST /api/admin/users/{userID}/ban", NewHandler(apiCfg.RequirePermission(PermManageUsers, apiCfg.PostUserBan)))
+	mux.HandleFunc("DELETE /api/admin/users/{userID}/ban", NewHandler(apiCfg.RequirePermission(PermManageUsers, apiCfg.DeleteUserBan)))
+	mux.HandleFunc("DELETE /api/admin/users/{userID}/lockout", NewHandler(apiCfg.RequirePermission(PermManageUsers, apiCfg.DeleteUserLockout)))
+
+	mux.HandleFunc("GET /api/sessions", NewHandler(apiCfg.RequireAuth(apiCfg.GetSessions)))
+	mux.HandleFunc("DELETE /api/sessions", NewHandler(apiCfg.RequireAuth(apiCfg.DeleteSessions)))
+	mux.HandleFunc("DELETE /api/sessions/{sessionID}", NewHandler(apiCfg.RequireAuth(apiCfg.DeleteSession)))
 
 	mux.HandleFunc("POST /api/polka/webhooks", NewHandler(apiCfg.PostPolka))
 
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/internal/db"
+	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+)
+
+// loginAttemptKey names a counter of failed logins, see db.LoginAttempts.
+type loginAttemptKey struct {
+	kind string
+	key  string
+}
+
+func (apiCfg *ApiConfig) throttlePolicy(kind string) db.ThrottlePolicy {
+	switch kind {
+	case db.AttemptsByIP:
+		return apiCfg.IPThrottle
+	case db.ResetsByAccount:
+		return apiCfg.ResetAccountThrottle
+	case db.ResetsByIP:
+		return apiCfg.ResetIPThrottle
+	}
+	return apiCfg.AccountThrottle
+}
+
+// dbKeys adds to keys the policies they're throttled by.
+func (apiCfg *ApiConfig) dbKeys(keys []loginAttemptKey) []db.LoginAttemptKey {
+	dbKeys := make([]db.LoginAttemptKey, 0, len(keys))
+	for _, key := range keys {
+		dbKeys = append(dbKeys, db.LoginAttemptKey{Kind: key.kind, Key: key.key, Policy: apiCfg.throttlePolicy(key.kind)})
+	}
+	return dbKeys
+}
+
+// reserveLoginAttempts counts a login against every key as failed before its
+// credentials are checked, so parallel logins can't all get in before a block.
+// While any key is blocked it refuses the login without checking the
+// password, so the refusal looks the same as a wrong one.
+func (apiCfg *ApiConfig) reserveLoginAttempts(keys ...loginAttemptKey) ([]db.LoginAttempts, error) {
+	return apiCfg.DB.ReserveLoginAttempts(apiCfg.dbKeys(keys)...)
+}
+
+// releaseLoginAttempts takes back reserved attempts that didn't fail, and
+// forgets the failures counted against clear.
+func (apiCfg *ApiConfig) releaseLoginAttempts(reserved []db.LoginAttempts, clear ...loginAttemptKey) error {
+	return apiCfg.DB.ReleaseLoginAttempts(reserved, apiCfg.dbKeys(clear)...)
+}
+
+// failLoginAttempts settles reserved once the login failed with err: if err
+// means the credentials were wrong the attempts stay counted, otherwise
+// they're released. It returns err either way.
+func (apiCfg *ApiConfig) failLoginAttempts(err error, reserved []db.LoginAttempts) error {
+	if !wrongCredentials(err) {
+		if releaseErr := apiCfg.releaseLoginAttempts(reserved); releaseErr != nil {
+			return releaseErr
+		}
+		return err
+	}
+	for _, attempts := range reserved {
+		logLockout(attempts)
+	}
+	return err
+}
+
+// checkAsLogin runs check, which proves the current user is who they say,
+// throttled and counted like a login to their account from the request's IP.
+// Once it passes the failures counted against clear are forgotten.
+func (apiCfg *ApiConfig) checkAsLogin(request *http.Request, user db.User, check func() error, clear ...loginAttemptKey) error {
+	reserved, err := apiCfg.reserveLoginAttempts(
+		loginAttemptKey{db.AttemptsByAccount, user.Email},
+		loginAttemptKey{db.AttemptsByIP, clientIP(request)},
+	)
+	if err != nil {
+		return err
+	}
+	err = check()
+	if err != nil {
+		return apiCfg.failLoginAttempts(err, reserved)
+	}
+	return apiCfg.releaseLoginAttempts(reserved, clear...)
+}
+
+// recordLoginFailure counts err against keys if it means the credentials were
+// wrong, and returns err either way.
+func (apiCfg *ApiConfig) recordLoginFailure(err error, keys ...loginAttemptKey) error {
+	if !wrongCredentials(err) {
+		return err
+	}
+	for _, key := range keys {
+		attempts, countErr := apiCfg.DB.RecordLoginFailure(key.kind, key.key, apiCfg.throttlePolicy(key.kind))
+		if countErr != nil {
+			return countErr
+		}
+		logLockout(attempts)
+	}
+	return err
+}
+
+func wrongCredentials(err error) bool {
+	var clientErr *api_errors.ClientErr
+	return errors.As(err, &clientErr) &&
+		(clientErr.HttpCode == http.StatusUnauthorized || clientErr.Message == db.ErrCurrentPssIncorrect.Message)
+}
+
+func logLockout(attempts db.LoginAttempts) {
+	if attempts.Locked {
+		log.Printf("Locked logins for %s %s until %s after %d failures",
+			attempts.Kind, attempts.Key, attempts.BlockedUntil.Format(time.RFC3339), attempts.Failures)
+	}
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/internal/db"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	apiCfg := &ApiConfig{
+		DB:              store,
+		TokenConfig:     encryption.NewTokenConfig("secret"),
+		RefreshTokenTTL: DefaultRefreshTokenTTL,
+		AccountThrottle: db.ThrottlePolicy{LockoutAfter: 3, LockoutDuration: time.Hour},
+		IPThrottle:      db.ThrottlePolicy{LockoutAfter: 4, LockoutDuration: time.Hour},
+	}
+	user, _ := store.CreateUser("test@email.com", "testPassword")
+	admin, _ := store.CreateUser("admin@email.com", "testPassword")
+	admin, _ = store.SetUserRole(admin.Id, db.RoleAdmin)
+
+	login := func(ip string, email string, password string) (int, string) {
+		body := `{"email": "` + email + `", "password": "` + password + `"}`
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader(body))
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		NewHandler(apiCfg.PostLogin).ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	_, unknownEmail := login("10.0.0.1", "unknown@email.com", "testPassword")
+	_, wrongPassword := login("10.0.0.1", "test@email.com", "wrongPassword")
+	if unknownEmail != wrongPassword {
+		t.Errorf("unknown email and wrong password responses differ: %s and %s", unknownEmail, wrongPassword)
+	}
+
+	tests := []struct {
+		name         string
+		ip           string
+		email        string
+		password     string
+		expectedCode int
+	}{
+		{"second failure", "10.0.0.2", "test@email.com", "wrongPassword", http.StatusUnauthorized},
+		{"third failure locks the account", "10.0.0.3", "Test@Email.com", "wrongPassword", http.StatusUnauthorized},
+		{"locked account", "10.0.0.4", "test@email.com", "testPassword", http.StatusUnauthorized},
+		{"other account", "10.0.0.4", "admin@email.com", "testPassword", http.StatusOK},
+		{"third failure from the IP", "10.0.0.1", "unknown@email.com", "wrongPassword", http.StatusUnauthorized},
+		{"fourth failure locks the IP", "10.0.0.1", "other@email.com", "wrongPassword", http.StatusUnauthorized},
+		{"locked IP", "10.0.0.1", "admin@email.com", "testPassword", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := login(tt.ip, tt.email, tt.password)
+			if code != tt.expectedCode {
+				t.Errorf("login returned %v want %v", code, tt.expectedCode)
+			}
+			if code == http.StatusUnauthorized && body != wrongPassword {
+				t.Errorf("login failure response %s differs from %s", body, wrongPassword)
+			}
+		})
+	}
+
+	adminToken, _ := encryption.CreateToken(apiCfg.TokenConfig, admin.Id, admin.Role, 0)
+	req := httptest.NewRequest("DELETE", "/api/admin/users/"+strconv.Itoa(user.Id)+"/lockout", nil)
+	req.SetPathValue("userID", strconv.Itoa(user.Id))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	w := httptest.NewRecorder()
+	NewHandler(apiCfg.RequirePermission(PermManageUsers, apiCfg.DeleteUserLockout)).ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unlock returned %v want %v", w.Code, http.StatusOK)
+	}
+	if code, _ := login("10.0.0.4", "test@email.com", "testPassword"); code != http.StatusOK {
+		t.Errorf("login after unlock returned %v want %v", code, http.StatusOK)
+	}
+}
+
+func TestLoginThrottleParallel(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	apiCfg := &ApiConfig{
+		DB:              store,
+		TokenConfig:     encryption.NewTokenConfig("secret"),
+		AccountThrottle: db.ThrottlePolicy{LockoutAfter: 3, LockoutDuration: time.Hour},
+	}
+	store.CreateUser("test@email.com", "testPassword")
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body := `{"email": "test@email.com", "password": "wrongPassword"}`
+			req := httptest.NewRequest("POST", "/api/login", strings.NewReader(body))
+			req.RemoteAddr = "10.0.0." + strconv.Itoa(i) + ":1234"
+			NewHandler(apiCfg.PostLogin).ServeHTTP(httptest.NewRecorder(), req)
+		}()
+	}
+	wg.Wait()
+
+	attempts, err := store.GetLoginAttempts(db.AttemptsByAccount, "test@email.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts.Failures != 3 || !attempts.Locked {
+		t.Errorf("parallel logins got past the lockout: %+v", attempts)
+	}
+}
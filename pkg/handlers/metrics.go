@@ -12,11 +12,12 @@ func (apiCfg *ApiConfig) MiddlewareMetricsInc(next http.Handler) http.Handler {
 	})
 }
 
-func (apiCfg *ApiConfig) MetricsReset(w http.ResponseWriter, r *http.Request) {
+func (apiCfg *ApiConfig) MetricsReset(w http.ResponseWriter, r *http.Request) error {
 	apiCfg.FileserverHits = 0
+	return nil
 }
 
-func (apiCfg *ApiConfig) MetricsCount(w http.ResponseWriter, request *http.Request) {
+func (apiCfg *ApiConfig) MetricsCount(w http.ResponseWriter, request *http.Request) error {
 	w.Header().Add("Content-Type", "text/html")
 	w.Write([]byte(fmt.Sprintf(`<html>
 
@@ -27,4 +28,5 @@ func (apiCfg *ApiConfig) MetricsCount(w http.ResponseWriter, request *http.Reque
 	
 	</html>
 	`, apiCfg.FileserverHits)))
+	return nil
 }
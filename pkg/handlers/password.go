@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/ajaen4/go-standard-lib-api/internal/db"
+	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+	"github.com/ajaen4/go-standard-lib-api/pkg/email_address"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+	"github.com/ajaen4/go-standard-lib-api/pkg/mailer"
+)
+
+type ForgotPasswordReq struct {
+	Email string `json:"email"`
+}
+
+func (forgotReq *ForgotPasswordReq) validate(r *http.Request) error {
+	err := json.NewDecoder(r.Body).Decode(forgotReq)
+	if err != nil {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid JSON",
+		}
+	}
+	forgotReq.Email, err = email_address.Normalize(forgotReq.Email)
+	if err != nil {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid body parameters",
+			Errors:   map[string]string{"email": "invalid email"},
+		}
+	}
+	return nil
+}
+
+type ResetPasswordReq struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (resetReq *ResetPasswordReq) validate(r *http.Request) error {
+	err := json.NewDecoder(r.Body).Decode(resetReq)
+	if err != nil {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid JSON",
+		}
+	}
+
+	apiErr := &api_errors.ClientErr{
+		HttpCode: http.StatusBadRequest,
+		Message:  "Invalid body parameters",
+		Errors:   map[string]string{},
+	}
+	if resetReq.Token == "" {
+		apiErr.Errors["token"] = "invalid token"
+	}
+	if resetReq.Password == "" {
+		apiErr.Errors["password"] = "invalid password"
+	}
+	if len(apiErr.Errors) > 0 {
+		return apiErr
+	}
+	return nil
+}
+
+// PostForgotPassword mails a password reset token to the account with the
+// given email. It answers the same whether or not there is one, or the request
+// was throttled, and does the work in the background so the response time
+// doesn't tell either. Without a Mailer it fails with ErrMailDisabled.
+func (apiCfg *ApiConfig) PostForgotPassword(w http.ResponseWriter, request *http.Request) error {
+	forgotReq := &ForgotPasswordReq{}
+	if reqErr := forgotReq.validate(request); reqErr != nil {
+		return reqErr
+	}
+	if apiCfg.Mailer == nil {
+		apiErr := ErrMailDisabled
+		return &apiErr
+	}
+
+	// Checked here rather than in the background, so a flood of requests
+	// doesn't start a goroutine each.
+	_, err := apiCfg.reserveLoginAttempts(loginAttemptKey{db.ResetsByIP, clientIP(request)})
+	var clientErr *api_errors.ClientErr
+	if errors.As(err, &clientErr) {
+		log.Printf("password reset not sent: %s", err)
+	} else if err != nil {
+		return err
+	} else {
+		go apiCfg.requestPasswordReset(apiCfg.canonicalEmail(forgotReq.Email))
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// requestPasswordReset stores a reset token for the account with email and
+// mails it to them, unless too many were asked for lately.
+func (apiCfg *ApiConfig) requestPasswordReset(email string) {
+	_, err := apiCfg.reserveLoginAttempts(loginAttemptKey{db.ResetsByAccount, email})
+	if err != nil {
+		log.Printf("password reset not sent: %s", err)
+		return
+	}
+
+	token, err := encryption.CreateOneTimeToken()
+	if err != nil {
+		log.Printf("Error creating password reset token: %s", err)
+		return
+	}
+	user, err := apiCfg.DB.CreatePasswordResetToken(email, token, apiCfg.PasswordResetTokenTTL)
+	var clientErr *api_errors.ClientErr
+	if errors.As(err, &clientErr) && clientErr.Message == db.ErrUserNotExist.Message {
+		log.Print("password reset requested for an unknown email")
+	} else if err != nil {
+		log.Printf("Error creating password reset token: %s", err)
+	} else {
+		apiCfg.sendPasswordResetEmail(user, token)
+	}
+}
+
+func (apiCfg *ApiConfig) sendPasswordResetEmail(user db.User, token string) {
+	body := fmt.Sprintf("Your Chirpy password reset token is:\n\n%s\n", token)
+	if apiCfg.AppURL != "" {
+		body = fmt.Sprintf(
+			"Choose a new Chirpy password by opening:\n\n%s/reset-password?token=%s\n",
+			apiCfg.AppURL, url.QueryEscape(token),
+		)
+	}
+	body += "\nIf you didn't ask to reset your password, you can ignore this email.\n"
+	err := apiCfg.Mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body:    body,
+	})
+	if err != nil {
+		log.Printf("Error sending password reset email to user %d: %s", user.Id, err)
+	}
+}
+
+// PostResetPassword sets a new password with a token from
+// PostForgotPassword, logging the user out of every session.
+func (apiCfg *ApiConfig) PostResetPassword(w http.ResponseWriter, request *http.Request) error {
+	resetReq := &ResetPasswordReq{}
+	if reqErr := resetReq.validate(request); reqErr != nil {
+		return reqErr
+	}
+	if err := apiCfg.checkPassword(resetReq.Password); err != nil {
+		return err
+	}
+
+	_, err := apiCfg.DB.ResetPassword(resetReq.Token, resetReq.Password)
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/internal/db"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+	"github.com/ajaen4/go-standard-lib-api/pkg/password_policy"
+)
+
+func TestPasswordReset(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	outbox := &recordingMailer{}
+	apiCfg := &ApiConfig{
+		DB:                    store,
+		TokenConfig:           encryption.NewTokenConfig("secret"),
+		Mailer:                outbox,
+		AppURL:                "https://chirpy.example.com",
+		PasswordResetTokenTTL: DefaultPasswordResetTokenTTL,
+		PasswordPolicy:        password_policy.DefaultPolicy(),
+	}
+	user, _ := store.CreateUser("test@email.com", "testPassword")
+	_, err = store.CreateSession(user.Id, "refresh-token", "", "", DefaultRefreshTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(handler CustomHandler, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/password", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		NewHandler(handler).ServeHTTP(w, req)
+		return w
+	}
+
+	unknown := serve(apiCfg.PostForgotPassword, `{"email": "unknown@email.com"}`)
+	known := serve(apiCfg.PostForgotPassword, `{"email": "TEST@email.com"}`)
+	if unknown.Code != http.StatusAccepted || known.Code != http.StatusAccepted {
+		t.Fatalf("forgot password returned %v for an unknown and %v for a known email", unknown.Code, known.Code)
+	}
+	if unknown.Body.String() != known.Body.String() {
+		t.Errorf("responses differ: %q and %q", unknown.Body, known.Body)
+	}
+	sent := outbox.waitForMail(t, 1)
+	if len(sent) != 1 || sent[0].To != "test@email.com" {
+		t.Fatalf("reset email not sent to the user only: %+v", sent)
+	}
+	token := outbox.lastToken(t, 1)
+
+	tests := []struct {
+		name         string
+		payload      string
+		expectedCode int
+	}{
+		{"weak password", `{"token": "` + token + `", "password": "short"}`, http.StatusBadRequest},
+		{"wrong token", `{"token": "wrong-token", "password": "newPassword"}`, http.StatusBadRequest},
+		{"valid token", `{"token": "` + token + `", "password": "newPassword"}`, http.StatusNoContent},
+		{"token already used", `{"token": "` + token + `", "password": "otherPassword"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(apiCfg.PostResetPassword, tt.payload); w.Code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", w.Code, tt.expectedCode)
+			}
+		})
+	}
+
+	_, err = store.Login("test@email.com", "newPassword")
+	if err != nil {
+		t.Errorf("login with new password: %v", err)
+	}
+	_, err = store.RotateSession("refresh-token", "new-refresh-token", DefaultRefreshTokenTTL)
+	if err == nil {
+		t.Error("refresh token still valid after password reset")
+	}
+}
+
+func TestPasswordResetThrottle(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	outbox := &recordingMailer{}
+	apiCfg := &ApiConfig{
+		DB:                    store,
+		TokenConfig:           encryption.NewTokenConfig("secret"),
+		Mailer:                outbox,
+		PasswordResetTokenTTL: DefaultPasswordResetTokenTTL,
+		ResetAccountThrottle:  db.ThrottlePolicy{LockoutAfter: 2, LockoutDuration: time.Hour},
+		ResetIPThrottle:       db.ThrottlePolicy{LockoutAfter: 4, LockoutDuration: time.Hour},
+	}
+	store.CreateUser("test@email.com", "testPassword")
+	store.CreateUser("other@email.com", "testPassword")
+
+	forgot := func(ip string, email string) {
+		req := httptest.NewRequest("POST", "/api/password/forgot", strings.NewReader(`{"email": "`+email+`"}`))
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		NewHandler(apiCfg.PostForgotPassword).ServeHTTP(w, req)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("forgot password returned %v want %v", w.Code, http.StatusAccepted)
+		}
+	}
+
+	for range 3 {
+		forgot("10.0.0.1", "test@email.com")
+	}
+	forgot("10.0.0.1", "other@email.com")
+	sent := outbox.waitForMail(t, 3)
+	toTest := 0
+	for _, msg := range sent {
+		if msg.To == "test@email.com" {
+			toTest++
+		}
+	}
+	if toTest != 2 {
+		t.Errorf("sent %d reset emails to one account; want 2", toTest)
+	}
+
+	forgot("10.0.0.1", "other@email.com")
+	attempts, _ := store.GetLoginAttempts(db.ResetsByIP, "10.0.0.1")
+	if attempts.Failures != 4 || !attempts.Blocked(time.Now()) {
+		t.Errorf("reset requests from a blocked IP still counted: %+v", attempts)
+	}
+	attempts, _ = store.GetLoginAttempts(db.AttemptsByAccount, "test@email.com")
+	if attempts.Failures != 0 {
+		t.Errorf("reset requests counted as failed logins: %+v", attempts)
+	}
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/ajaen4/go-standard-lib-api/internal/db"
+	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+)
+
+type Permission string
+
+const (
+	PermWriteChirps    Permission = "chirps:write"
+	PermModerateChirps Permission = "chirps:moderate"
+	PermReadMetrics    Permission = "metrics:read"
+	PermResetMetrics   Permission = "metrics:reset"
+	PermManageUsers    Permission = "users:manage"
+)
+
+var rolePermissions = map[string][]Permission{
+	db.RoleUser:      {PermWriteChirps},
+	db.RoleModerator: {PermWriteChirps, PermModerateChirps},
+	db.RoleAdmin:     {PermWriteChirps, PermModerateChirps, PermReadMetrics, PermResetMetrics, PermManageUsers},
+}
+
+func HasPermission(role string, perm Permission) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission authenticates the request like RequireAuth and then only
+// calls next if the user's role grants perm. The role is read from the stored
+// user rather than the token, so role changes apply immediately.
+func (apiCfg *ApiConfig) RequirePermission(perm Permission, next CustomHandler) CustomHandler {
+	return apiCfg.RequireAuth(func(w http.ResponseWriter, r *http.Request) error {
+		user := currentUser(r)
+		if !HasPermission(user.Role, perm) {
+			apiErr := api_errors.ForbiddenErr
+			apiErr.LogMess = "user " + user.Email + " lacks permission " + string(perm)
+			return &apiErr
+		}
+		return next(w, r)
+	})
+}
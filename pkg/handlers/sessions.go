@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+)
+
+type SessionResp struct {
+	Id         int       `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type SessionsResp struct {
+	Sessions []SessionResp `json:"sessions"`
+}
+
+type SessionReq struct {
+	sessionID int
+}
+
+func (req *SessionReq) validate(r *http.Request) *api_errors.ClientErr {
+	reqSessionID := r.PathValue("sessionID")
+	sessionID, err := strconv.Atoi(reqSessionID)
+	if reqSessionID == "" || err != nil {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "invalid request params",
+			Errors:   map[string]string{"sessionID": "SessionID not provided or invalid"},
+		}
+	}
+	req.sessionID = sessionID
+	return nil
+}
+
+// clientIP returns the address the request came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (apiCfg *ApiConfig) GetSessions(w http.ResponseWriter, r *http.Request) error {
+	sessions, err := apiCfg.DB.GetSessions(currentUser(r).Id)
+	if err != nil {
+		return err
+	}
+
+	resp := SessionsResp{Sessions: make([]SessionResp, 0, len(sessions))}
+	for _, session := range sessions {
+		resp.Sessions = append(resp.Sessions, SessionResp{
+			Id:         session.Id,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+		})
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+func (apiCfg *ApiConfig) DeleteSession(w http.ResponseWriter, r *http.Request) error {
+	sessionReq := SessionReq{}
+	if clientErr := sessionReq.validate(r); clientErr != nil {
+		return clientErr
+	}
+
+	err := apiCfg.DB.DeleteSession(currentUser(r).Id, sessionReq.sessionID)
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// DeleteSessions logs the user out of every device.
+func (apiCfg *ApiConfig) DeleteSessions(w http.ResponseWriter, r *http.Request) error {
+	err := apiCfg.DB.DeleteSessions(currentUser(r).Id)
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
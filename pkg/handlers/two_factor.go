@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/ajaen4/go-standard-lib-api/internal/db"
+	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+)
+
+const (
+	totpIssuer        = "Chirpy"
+	recoveryCodeCount = 10
+)
+
+type TOTPEnrollResp struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type RecoveryCodesResp struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type LoginChallengeResp struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+}
+
+type TOTPCodeReq struct {
+	Code string `json:"code"`
+}
+
+func (codeReq *TOTPCodeReq) validate(r *http.Request) error {
+	err := json.NewDecoder(r.Body).Decode(codeReq)
+	if err != nil {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid JSON",
+		}
+	}
+	if codeReq.Code == "" {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid body parameters",
+			Errors:   map[string]string{"code": "invalid code"},
+		}
+	}
+	return nil
+}
+
+type LoginChallengeReq struct {
+	ChallengeToken   string `json:"challenge_token"`
+	Code             string `json:"code"`
+	ExpiresInSeconds int    `json:"expires_in_seconds,omitempty"`
+}
+
+func (challengeReq *LoginChallengeReq) validate(r *http.Request) error {
+	err := json.NewDecoder(r.Body).Decode(challengeReq)
+	if err != nil {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid JSON",
+		}
+	}
+
+	apiErr := &api_errors.ClientErr{
+		HttpCode: http.StatusBadRequest,
+		Message:  "Invalid body parameters",
+		Errors:   map[string]string{},
+	}
+	if challengeReq.ChallengeToken == "" {
+		apiErr.Errors["challenge_token"] = "invalid challenge_token"
+	}
+	if challengeReq.Code == "" {
+		apiErr.Errors["code"] = "invalid code"
+	}
+	if challengeReq.ExpiresInSeconds < 0 {
+		apiErr.Errors["expires_in_seconds"] = "expires_in_seconds can't be negative"
+	}
+	if len(apiErr.Errors) > 0 {
+		return apiErr
+	}
+	return nil
+}
+
+// respondWithLoginChallenge answers a correct password from a user with
+// two-factor authentication with a token to send back with their code to
+// PostLoginTwoFactor.
+func (apiCfg *ApiConfig) respondWithLoginChallenge(w http.ResponseWriter, user db.User) error {
+	token, err := encryption.CreateOneTimeToken()
+	if err != nil {
+		return err
+	}
+	err = apiCfg.DB.CreateLoginChallenge(user.Id, token, apiCfg.LoginChallengeTTL)
+	if err != nil {
+		return err
+	}
+
+	respondWithJSON(w, http.StatusOK, LoginChallengeResp{
+		TwoFactorRequired: true,
+		ChallengeToken:    token,
+	})
+	return nil
+}
+
+func (apiCfg *ApiConfig) PostLoginTwoFactor(w http.ResponseWriter, request *http.Request) error {
+	challengeReq := &LoginChallengeReq{}
+	if reqErr := challengeReq.validate(request); reqErr != nil {
+		return reqErr
+	}
+
+	reserved, err := apiCfg.reserveLoginAttempts(loginAttemptKey{db.AttemptsByIP, clientIP(request)})
+	if err != nil {
+		return err
+	}
+
+	user, err := apiCfg.DB.CompleteLoginChallenge(challengeReq.ChallengeToken, challengeReq.Code)
+	if err != nil {
+		// The challenge only says which account it's for once its token
+		// checks out, so only wrong codes count against the account.
+		if user.Id != 0 {
+			err = apiCfg.recordLoginFailure(err, loginAttemptKey{db.AttemptsByAccount, user.Email})
+		}
+		return apiCfg.failLoginAttempts(err, reserved)
+	}
+	err = apiCfg.releaseLoginAttempts(reserved, loginAttemptKey{db.AttemptsByAccount, user.Email})
+	if err != nil {
+		return err
+	}
+
+	return apiCfg.respondWithLogin(w, request, user, challengeReq.ExpiresInSeconds)
+}
+
+// PostTOTPEnroll starts enrolling the current user in two-factor
+// authentication. It isn't required at login until confirmed.
+func (apiCfg *ApiConfig) PostTOTPEnroll(w http.ResponseWriter, request *http.Request) error {
+	user := currentUser(request)
+
+	secret, err := encryption.GenerateTOTPSecret()
+	if err != nil {
+		return err
+	}
+	err = apiCfg.DB.EnrollTOTP(user.Id, secret)
+	if err != nil {
+		return err
+	}
+
+	respondWithJSON(w, http.StatusOK, TOTPEnrollResp{
+		Secret: secret,
+		URI:    encryption.TOTPURI(secret, totpIssuer, user.Email),
+	})
+	return nil
+}
+
+// PostTOTPConfirm enables two-factor authentication given a code from the
+// enrolled secret, and returns the recovery codes. They're only ever shown
+// here. Wrong codes count as failed logins, like those to DeleteTOTP.
+func (apiCfg *ApiConfig) PostTOTPConfirm(w http.ResponseWriter, request *http.Request) error {
+	codeReq := &TOTPCodeReq{}
+	if reqErr := codeReq.validate(request); reqErr != nil {
+		return reqErr
+	}
+
+	recoveryCodes, err := encryption.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return err
+	}
+	// A correct code doesn't clear the account's failures: whoever enrolled
+	// the secret can always give one.
+	user := currentUser(request)
+	err = apiCfg.checkAsLogin(request, user, func() error {
+		_, err := apiCfg.DB.ConfirmTOTP(user.Id, codeReq.Code, recoveryCodes)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	respondWithJSON(w, http.StatusOK, RecoveryCodesResp{RecoveryCodes: recoveryCodes})
+	return nil
+}
+
+func (apiCfg *ApiConfig) DeleteTOTP(w http.ResponseWriter, request *http.Request) error {
+	codeReq := &TOTPCodeReq{}
+	if reqErr := codeReq.validate(request); reqErr != nil {
+		return reqErr
+	}
+
+	user := currentUser(request)
+	err := apiCfg.checkAsLogin(request, user, func() error {
+		return apiCfg.DB.DisableTOTP(user.Id, codeReq.Code)
+	})
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/internal/db"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+)
+
+func TestTwoFactorLogin(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	apiCfg := &ApiConfig{
+		DB:                store,
+		TokenConfig:       encryption.NewTokenConfig("secret"),
+		RefreshTokenTTL:   DefaultRefreshTokenTTL,
+		LoginChallengeTTL: DefaultLoginChallengeTTL,
+	}
+	user, _ := store.CreateUser("test@email.com", "testPassword")
+	accessToken, _ := encryption.CreateToken(apiCfg.TokenConfig, user.Id, user.Role, 0)
+
+	serve := func(handler CustomHandler, body string, resp any) int {
+		req := httptest.NewRequest("POST", "/api/test", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		w := httptest.NewRecorder()
+		NewHandler(handler).ServeHTTP(w, req)
+		if resp != nil && w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+	login := `{"email": "test@email.com", "password": "testPassword"}`
+
+	enrollment := TOTPEnrollResp{}
+	if code := serve(apiCfg.RequireAuth(apiCfg.PostTOTPEnroll), "", &enrollment); code != http.StatusOK {
+		t.Fatalf("enroll returned %v", code)
+	}
+	uri, err := url.Parse(enrollment.URI)
+	if err != nil || uri.Scheme != "otpauth" || uri.Query().Get("secret") != enrollment.Secret {
+		t.Fatalf("bad otpauth URI %q", enrollment.URI)
+	}
+	loginResp := LogInResp{}
+	if code := serve(apiCfg.PostLogin, login, &loginResp); code != http.StatusOK || loginResp.Token == "" {
+		t.Fatalf("unconfirmed enrollment changed login: got %v %+v", code, loginResp)
+	}
+
+	step := encryption.TOTPStep(time.Now())
+	totp := func(step int64) string {
+		code, _ := encryption.TOTPCode(enrollment.Secret, step)
+		return code
+	}
+	recovery := RecoveryCodesResp{}
+	code := serve(apiCfg.RequireAuth(apiCfg.PostTOTPConfirm), `{"code": "`+totp(step)+`"}`, &recovery)
+	if code != http.StatusOK || len(recovery.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("confirm returned %v with %d recovery codes", code, len(recovery.RecoveryCodes))
+	}
+
+	challenge := LoginChallengeResp{}
+	if code := serve(apiCfg.PostLogin, login, &challenge); code != http.StatusOK || !challenge.TwoFactorRequired {
+		t.Fatalf("login without a second factor: got %v %+v", code, challenge)
+	}
+
+	tests := []struct {
+		name         string
+		payload      string
+		expectedCode int
+	}{
+		{"missing code", `{"challenge_token": "` + challenge.ChallengeToken + `"}`, http.StatusBadRequest},
+		{"wrong challenge", `{"challenge_token": "wrong", "code": "` + totp(step+1) + `"}`, http.StatusUnauthorized},
+		{"wrong code", `{"challenge_token": "` + challenge.ChallengeToken + `", "code": "000000"}`, http.StatusUnauthorized},
+		{"valid code", `{"challenge_token": "` + challenge.ChallengeToken + `", "code": "` + totp(step+1) + `"}`, http.StatusOK},
+		{"challenge used", `{"challenge_token": "` + challenge.ChallengeToken + `", "code": "` + recovery.RecoveryCodes[0] + `"}`, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loginResp := LogInResp{}
+			code := serve(apiCfg.PostLoginTwoFactor, tt.payload, &loginResp)
+			if code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", code, tt.expectedCode)
+			}
+			if code == http.StatusOK && (loginResp.Token == "" || loginResp.RefToken == "") {
+				t.Errorf("no tokens issued: %+v", loginResp)
+			}
+		})
+	}
+
+	failureBody := func(handler CustomHandler, body string) string {
+		req := httptest.NewRequest("POST", "/api/test", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		NewHandler(handler).ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("handler returned %v want %v", w.Code, http.StatusUnauthorized)
+		}
+		return w.Body.String()
+	}
+	accountFailures := func() int {
+		attempts, _ := store.GetLoginAttempts(db.AttemptsByAccount, user.Email)
+		return attempts.Failures
+	}
+
+	wrongPassword := failureBody(apiCfg.PostLogin, `{"email": "test@email.com", "password": "wrongPassword"}`)
+	guessed := LoginChallengeResp{}
+	if code := serve(apiCfg.PostLogin, login, &guessed); code != http.StatusOK || !guessed.TwoFactorRequired {
+		t.Fatalf("login without a second factor: got %v %+v", code, guessed)
+	}
+	if failures := accountFailures(); failures != 1 {
+		t.Errorf("password step left %d account failures; want 1", failures)
+	}
+	wrongChallenge := failureBody(apiCfg.PostLoginTwoFactor, `{"challenge_token": "wrong", "code": "000000"}`)
+	for range db.MaxLoginChallengeFailures {
+		wrongCode := failureBody(apiCfg.PostLoginTwoFactor, `{"challenge_token": "`+guessed.ChallengeToken+`", "code": "000000"}`)
+		if wrongCode != wrongPassword || wrongChallenge != wrongPassword {
+			t.Errorf("two-factor failures %s and %s differ from %s", wrongCode, wrongChallenge, wrongPassword)
+		}
+	}
+	if failures := accountFailures(); failures != 1+db.MaxLoginChallengeFailures {
+		t.Errorf("wrong codes left %d account failures; want %d", failures, 1+db.MaxLoginChallengeFailures)
+	}
+	code = serve(apiCfg.PostLoginTwoFactor, `{"challenge_token": "`+guessed.ChallengeToken+`", "code": "`+recovery.RecoveryCodes[1]+`"}`, nil)
+	if code != http.StatusUnauthorized {
+		t.Errorf("challenge still usable after %d wrong codes: got %v", db.MaxLoginChallengeFailures, code)
+	}
+
+	if code := serve(apiCfg.PostLogin, login, &guessed); code != http.StatusOK || !guessed.TwoFactorRequired {
+		t.Fatalf("login without a second factor: got %v %+v", code, guessed)
+	}
+	code = serve(apiCfg.PostLoginTwoFactor, `{"challenge_token": "`+guessed.ChallengeToken+`", "code": "`+recovery.RecoveryCodes[1]+`"}`, nil)
+	if code != http.StatusOK || accountFailures() != 0 {
+		t.Errorf("login returned %v and left %d account failures; want %v and none", code, accountFailures(), http.StatusOK)
+	}
+}
+
+func TestTOTPCodesThrottled(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	apiCfg := &ApiConfig{
+		DB:              store,
+		TokenConfig:     encryption.NewTokenConfig("secret"),
+		AccountThrottle: db.ThrottlePolicy{LockoutAfter: 3, LockoutDuration: time.Hour},
+	}
+	user, _ := store.CreateUser("test@email.com", "testPassword")
+	accessToken, _ := encryption.CreateToken(apiCfg.TokenConfig, user.Id, user.Role, 0)
+
+	serve := func(handler CustomHandler, body string, resp any) int {
+		req := httptest.NewRequest("POST", "/api/test", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		w := httptest.NewRecorder()
+		NewHandler(apiCfg.RequireAuth(handler)).ServeHTTP(w, req)
+		if resp != nil && w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code
+	}
+	accountFailures := func() int {
+		attempts, _ := store.GetLoginAttempts(db.AttemptsByAccount, user.Email)
+		return attempts.Failures
+	}
+
+	enrollment := TOTPEnrollResp{}
+	if code := serve(apiCfg.PostTOTPEnroll, "", &enrollment); code != http.StatusOK {
+		t.Fatalf("enroll returned %v", code)
+	}
+	step := encryption.TOTPStep(time.Now())
+	totp := func(step int64) string {
+		code, _ := encryption.TOTPCode(enrollment.Secret, step)
+		return code
+	}
+
+	// Wrong codes lock the account like wrong passwords, after which even
+	// the right code is refused.
+	for range 3 {
+		if code := serve(apiCfg.PostTOTPConfirm, `{"code": "000000"}`, nil); code != http.StatusUnauthorized {
+			t.Fatalf("wrong confirm code returned %v", code)
+		}
+	}
+	if code := serve(apiCfg.PostTOTPConfirm, `{"code": "`+totp(step)+`"}`, nil); code != http.StatusUnauthorized {
+		t.Errorf("confirm while locked: got %v want %v", code, http.StatusUnauthorized)
+	}
+	if user, _ := store.GetUser(user.Id); user.TOTPEnabled {
+		t.Fatal("TOTP enabled while locked")
+	}
+
+	store.UnlockUser(user.Id)
+	if code := serve(apiCfg.PostTOTPConfirm, `{"code": "`+totp(step)+`"}`, &RecoveryCodesResp{}); code != http.StatusOK {
+		t.Fatalf("confirm returned %v", code)
+	}
+	if failures := accountFailures(); failures != 0 {
+		t.Errorf("confirm left %d account failures; want none", failures)
+	}
+
+	// The code used to confirm can't be replayed, and counts as a failure.
+	if code := serve(apiCfg.DeleteTOTP, `{"code": "`+totp(step)+`"}`, nil); code != http.StatusUnauthorized {
+		t.Errorf("replayed disable code: got %v want %v", code, http.StatusUnauthorized)
+	}
+	if code := serve(apiCfg.DeleteTOTP, `{"code": "000000"}`, nil); code != http.StatusUnauthorized {
+		t.Errorf("wrong disable code: got %v want %v", code, http.StatusUnauthorized)
+	}
+	if failures := accountFailures(); failures != 2 {
+		t.Errorf("wrong disable codes left %d account failures; want 2", failures)
+	}
+	if code := serve(apiCfg.DeleteTOTP, `{"code": "`+totp(step+1)+`"}`, nil); code != http.StatusNoContent {
+		t.Errorf("disable returned %v want %v", code, http.StatusNoContent)
+	}
+}
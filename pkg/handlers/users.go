@@ -2,14 +2,23 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
-	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ajaen4/go-standard-lib-api/internal/db"
 	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+	"github.com/ajaen4/go-standard-lib-api/pkg/email_address"
 	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
 )
 
+var ErrUserNotFound = api_errors.ClientErr{
+	HttpCode: http.StatusNotFound,
+	Message:  "user not found",
+}
+
 type UserReq struct {
 	Email            string `json:"email"`
 	Password         string `json:"password"`
@@ -31,11 +40,95 @@ func (userReq *UserReq) validate(r *http.Request) error {
 		Message:  "Invalid body parameters",
 		Errors:   map[string]string{},
 	}
-	if len(userReq.Email) == 0 {
+	userReq.Email, err = email_address.Normalize(userReq.Email)
+	if err != nil {
 		apiErr.Errors["email"] = "invalid email"
 	}
 	if len(userReq.Password) == 0 {
-		apiErr.Errors["password"] = "invalid email"
+		apiErr.Errors["password"] = "invalid password"
+	}
+	if userReq.ExpiresInSeconds < 0 {
+		apiErr.Errors["expires_in_seconds"] = "expires_in_seconds can't be negative"
+	}
+
+	if len(apiErr.Errors) > 0 {
+		return apiErr
+	}
+
+	return nil
+}
+
+// LoginReq leaves the email as typed apart from surrounding spaces: accounts
+// made before the email rules tightened must still be able to log in.
+type LoginReq struct {
+	Email            string `json:"email"`
+	Password         string `json:"password"`
+	ExpiresInSeconds int    `json:"expires_in_seconds,omitempty"`
+}
+
+func (loginReq *LoginReq) validate(r *http.Request) error {
+	err := json.NewDecoder(r.Body).Decode(loginReq)
+	if err != nil {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid JSON",
+		}
+	}
+
+	apiErr := &api_errors.ClientErr{
+		HttpCode: http.StatusBadRequest,
+		Message:  "Invalid body parameters",
+		Errors:   map[string]string{},
+	}
+	loginReq.Email = strings.TrimSpace(loginReq.Email)
+	if len(loginReq.Email) == 0 {
+		apiErr.Errors["email"] = "invalid email"
+	}
+	if len(loginReq.Password) == 0 {
+		apiErr.Errors["password"] = "invalid password"
+	}
+	if loginReq.ExpiresInSeconds < 0 {
+		apiErr.Errors["expires_in_seconds"] = "expires_in_seconds can't be negative"
+	}
+
+	if len(apiErr.Errors) > 0 {
+		return apiErr
+	}
+
+	return nil
+}
+
+// UserPatchReq changes only the fields it sets. Changing the email or password
+// needs CurrentPassword too.
+type UserPatchReq struct {
+	Email           *string `json:"email"`
+	Password        *string `json:"password"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+func (patchReq *UserPatchReq) validate(r *http.Request) error {
+	err := json.NewDecoder(r.Body).Decode(patchReq)
+	if err != nil {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid JSON",
+		}
+	}
+
+	apiErr := &api_errors.ClientErr{
+		HttpCode: http.StatusBadRequest,
+		Message:  "Invalid body parameters",
+		Errors:   map[string]string{},
+	}
+	if patchReq.Email != nil {
+		email, err := email_address.Normalize(*patchReq.Email)
+		if err != nil {
+			apiErr.Errors["email"] = "invalid email"
+		}
+		patchReq.Email = &email
+	}
+	if patchReq.Password != nil && len(*patchReq.Password) == 0 {
+		apiErr.Errors["password"] = "invalid password"
 	}
 
 	if len(apiErr.Errors) > 0 {
@@ -45,22 +138,92 @@ func (userReq *UserReq) validate(r *http.Request) error {
 	return nil
 }
 
+// canonicalEmail applies the plus tag policy to a normalized email, so
+// signing up, logging in and changing email all agree on the address.
+func (apiCfg *ApiConfig) canonicalEmail(email string) string {
+	if apiCfg.StripEmailPlusTags {
+		return email_address.StripPlusTag(email)
+	}
+	return email
+}
+
+// loginEmail picks the address a login is for. Accounts made before plus
+// tags were stripped keep theirs, so when only the address as typed has an
+// account, that's the one.
+func (apiCfg *ApiConfig) loginEmail(email string) (string, error) {
+	canonical := apiCfg.canonicalEmail(email)
+	if canonical == email {
+		return email, nil
+	}
+	registered, err := apiCfg.DB.EmailRegistered(canonical)
+	if err != nil || registered {
+		return canonical, err
+	}
+	legacy, err := apiCfg.DB.EmailRegistered(email)
+	if err != nil || !legacy {
+		return canonical, err
+	}
+	return email, nil
+}
+
+// checkPassword applies the password policy to a password being set, which
+// passwords only checked at login are exempt from.
+func (apiCfg *ApiConfig) checkPassword(password string) error {
+	problems, err := apiCfg.PasswordPolicy.Check(password)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid body parameters",
+			Errors:   map[string]string{"password": strings.Join(problems, "; ")},
+		}
+	}
+	return nil
+}
+
 type UserResp struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Id          int       `json:"id"`
+	Email       string    `json:"email"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	IsVerified  bool      `json:"is_verified"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+func newUserResp(user db.User) UserResp {
+	return UserResp{
+		Id:          user.Id,
+		Email:       user.Email,
+		IsChirpyRed: user.IsChirpyRed,
+		IsVerified:  user.Verified,
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
+	}
+}
+
+// ProfileResp is what anyone can see about a user.
+type ProfileResp struct {
+	Id          int       `json:"id"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
 }
 
 type LogInResp struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
-	Token       string `json:"token"`
-	RefToken    string `json:"refresh_token"`
+	Id          int       `json:"id"`
+	Email       string    `json:"email"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	IsVerified  bool      `json:"is_verified"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	Token       string    `json:"token"`
+	RefToken    string    `json:"refresh_token"`
 }
 
 type TokenResp struct {
-	Token string `json:"token"`
+	Token    string `json:"token"`
+	RefToken string `json:"refresh_token"`
 }
 
 func (apiCfg *ApiConfig) PostUser(w http.ResponseWriter, request *http.Request) error {
@@ -68,87 +231,196 @@ func (apiCfg *ApiConfig) PostUser(w http.ResponseWriter, request *http.Request)
 	if reqErr := userReq.validate(request); reqErr != nil {
 		return reqErr
 	}
+	if err := apiCfg.checkPassword(userReq.Password); err != nil {
+		return err
+	}
 
-	User, err := apiCfg.DB.CreateUser(userReq.Email, userReq.Password)
+	User, err := apiCfg.DB.CreateUser(apiCfg.canonicalEmail(userReq.Email), userReq.Password)
 	if err != nil {
 		return err
 	}
+	// The account exists either way, and the user can ask for another email.
+	err = apiCfg.sendVerificationEmail(User)
+	if err != nil {
+		log.Printf("Error sending verification email to user %d: %s", User.Id, err)
+	}
 
-	respondWithJSON(w, http.StatusCreated, UserResp{
-		Id:          User.Id,
-		Email:       User.Email,
-		IsChirpyRed: User.IsChirpyRed,
-	})
+	respondWithJSON(w, http.StatusCreated, newUserResp(User))
 	return nil
 }
 
+// PutUser replaces the email and password of the current user.
+//
+// Deprecated: PUT /api/users doesn't ask for the current password and is only
+// kept for existing clients; use PATCH /api/users/me, which does.
 func (apiCfg *ApiConfig) PutUser(w http.ResponseWriter, request *http.Request) error {
+	id := currentUser(request).Id
 
-	authHeader := request.Header.Get("Authorization")
-	tokenStr := strings.Replace(authHeader, "Bearer ", "", 1)
-	token, err := encryption.ValidateToken(tokenStr, apiCfg.JwtSecret)
-	if err != nil {
-		apiErr := api_errors.UnauthErr
-		apiErr.LogMess = err.Error()
-		return &apiErr
+	userReq := &UserReq{}
+	if reqErr := userReq.validate(request); reqErr != nil {
+		return reqErr
+	}
+	if err := apiCfg.checkPassword(userReq.Password); err != nil {
+		return err
 	}
 
-	subject, err := token.Claims.GetSubject()
+	user, err := apiCfg.DB.UpdateUser(id, apiCfg.canonicalEmail(userReq.Email), userReq.Password)
 	if err != nil {
-		apiErr := api_errors.UnauthErr
-		apiErr.LogMess = err.Error()
-		return &apiErr
+		return err
 	}
 
-	id, err := strconv.Atoi(subject)
+	respondWithJSON(w, http.StatusOK, newUserResp(user))
+	return nil
+}
+
+// PatchUser updates the fields of the current user given in the request. A
+// new email has to be verified again.
+func (apiCfg *ApiConfig) PatchUser(w http.ResponseWriter, request *http.Request) error {
+	user := currentUser(request)
+
+	patchReq := &UserPatchReq{}
+	if reqErr := patchReq.validate(request); reqErr != nil {
+		return reqErr
+	}
+	patch := db.UserPatch{Password: patchReq.Password}
+	if patchReq.Email != nil {
+		if email := apiCfg.canonicalEmail(*patchReq.Email); email != user.Email {
+			patch.Email = &email
+		}
+	}
+	if patch.Password != nil {
+		if err := apiCfg.checkPassword(*patch.Password); err != nil {
+			return err
+		}
+	}
+	if patch.Email != nil || patch.Password != nil {
+		if err := apiCfg.reauthenticate(request, user, patchReq.CurrentPassword); err != nil {
+			return err
+		}
+	}
+
+	updated, err := apiCfg.DB.PatchUser(user.Id, patch)
 	if err != nil {
-		apiErr := api_errors.UnauthErr
-		apiErr.LogMess = err.Error()
-		return &apiErr
+		return err
+	}
+	if patch.Email != nil && !updated.Verified {
+		err = apiCfg.sendVerificationEmail(updated)
+		if err != nil {
+			log.Printf("Error sending verification email to user %d: %s", updated.Id, err)
+		}
 	}
 
-	userReq := &UserReq{}
-	if reqErr := userReq.validate(request); reqErr != nil {
-		return reqErr
+	respondWithJSON(w, http.StatusOK, newUserResp(updated))
+	return nil
+}
+
+// reauthenticate checks the password of a user changing their email or
+// password. Wrong guesses count as failed logins, so a stolen access token
+// can't be used to find the password either.
+func (apiCfg *ApiConfig) reauthenticate(request *http.Request, user db.User, password string) error {
+	if password == "" {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid body parameters",
+			Errors: map[string]string{
+				"current_password": "current password is required to change email or password",
+			},
+		}
 	}
 
-	user, err := apiCfg.DB.UpdateUser(id, userReq.Email, userReq.Password)
+	return apiCfg.checkAsLogin(request, user, func() error {
+		return apiCfg.DB.CheckPassword(user.Id, password)
+	}, loginAttemptKey{db.AttemptsByAccount, user.Email})
+}
+
+func (apiCfg *ApiConfig) GetCurrentUser(w http.ResponseWriter, request *http.Request) error {
+	respondWithJSON(w, http.StatusOK, newUserResp(currentUser(request)))
+	return nil
+}
+
+func (apiCfg *ApiConfig) GetUserProfile(w http.ResponseWriter, request *http.Request) error {
+	userIdReq := UserIdReq{}
+	if clientErr := userIdReq.validate(request); clientErr != nil {
+		return clientErr
+	}
+
+	user, err := apiCfg.DB.GetUser(userIdReq.userID)
+	var clientErr *api_errors.ClientErr
+	if errors.As(err, &clientErr) && clientErr.Message == db.ErrUserNotExist.Message {
+		notFound := ErrUserNotFound
+		return &notFound
+	}
 	if err != nil {
 		return err
 	}
 
-	respondWithJSON(w, http.StatusOK, UserResp{
-		Email:       user.Email,
-		Id:          id,
+	respondWithJSON(w, http.StatusOK, ProfileResp{
+		Id:          user.Id,
 		IsChirpyRed: user.IsChirpyRed,
+		CreatedAt:   user.CreatedAt,
 	})
 	return nil
 }
 
 func (apiCfg *ApiConfig) PostLogin(w http.ResponseWriter, request *http.Request) error {
-	userReq := &UserReq{}
-	if reqErr := userReq.validate(request); reqErr != nil {
+	loginReq := &LoginReq{}
+	if reqErr := loginReq.validate(request); reqErr != nil {
 		return reqErr
 	}
 
-	base64RefToken, err := encryption.CreateRefToken()
+	email, err := apiCfg.loginEmail(loginReq.Email)
+	if err != nil {
+		return err
+	}
+	reserved, err := apiCfg.reserveLoginAttempts(
+		loginAttemptKey{db.AttemptsByAccount, email},
+		loginAttemptKey{db.AttemptsByIP, clientIP(request)},
+	)
 	if err != nil {
 		return err
 	}
 
-	User, err := apiCfg.DB.Login(userReq.Email, userReq.Password)
+	User, err := apiCfg.DB.Login(email, loginReq.Password)
+	if err != nil {
+		return apiCfg.failLoginAttempts(err, reserved)
+	}
+	if User.TOTPEnabled {
+		if err := apiCfg.releaseLoginAttempts(reserved); err != nil {
+			return err
+		}
+		return apiCfg.respondWithLoginChallenge(w, User)
+	}
+
+	// Failures from the IP are kept, or an attacker could clear them by
+	// logging in to an account of their own.
+	err = apiCfg.releaseLoginAttempts(reserved, loginAttemptKey{db.AttemptsByAccount, User.Email})
 	if err != nil {
 		return err
 	}
+	return apiCfg.respondWithLogin(w, request, User, loginReq.ExpiresInSeconds)
+}
 
-	signedToken, err := encryption.CreateToken(User.Id, apiCfg.JwtSecret)
+// respondWithLogin starts a session for a user who has passed every login
+// step and returns its tokens. The caller forgets the failed logins against
+// their account.
+func (apiCfg *ApiConfig) respondWithLogin(w http.ResponseWriter, request *http.Request, User db.User, expiresInSeconds int) error {
+	base64RefToken, err := encryption.CreateRefToken()
+	if err != nil {
+		return err
+	}
+
+	signedToken, err := encryption.CreateToken(
+		apiCfg.TokenConfig, User.Id, User.Role, time.Duration(expiresInSeconds)*time.Second,
+	)
 	if err != nil {
 		apiErr := api_errors.UnauthErr
 		apiErr.LogMess = err.Error()
 		return &apiErr
 	}
 
-	err = apiCfg.DB.SaveRefToken(User.Id, base64RefToken)
+	_, err = apiCfg.DB.CreateSession(
+		User.Id, base64RefToken, request.UserAgent(), clientIP(request), apiCfg.RefreshTokenTTL,
+	)
 	if err != nil {
 		return err
 	}
@@ -157,6 +429,9 @@ func (apiCfg *ApiConfig) PostLogin(w http.ResponseWriter, request *http.Request)
 		Id:          User.Id,
 		Email:       User.Email,
 		IsChirpyRed: User.IsChirpyRed,
+		IsVerified:  User.Verified,
+		CreatedAt:   User.CreatedAt,
+		UpdatedAt:   User.UpdatedAt,
 		Token:       signedToken,
 		RefToken:    base64RefToken,
 	})
@@ -167,20 +442,32 @@ func (apiCfg *ApiConfig) PostRefToken(w http.ResponseWriter, request *http.Reque
 	authHeader := request.Header.Get("Authorization")
 	refreshToken := strings.Replace(authHeader, "Bearer ", "", 1)
 
-	User, err := apiCfg.DB.ValidateRefToken(refreshToken)
+	newRefreshToken, err := encryption.CreateRefToken()
 	if err != nil {
-		apiErr := api_errors.UnauthErr
-		apiErr.LogMess = err.Error()
+		return err
+	}
+
+	session, err := apiCfg.DB.RotateSession(refreshToken, newRefreshToken, apiCfg.RefreshTokenTTL)
+	if err != nil {
+		return err
+	}
+	User, err := apiCfg.DB.GetUser(session.UserId)
+	if err != nil {
+		return err
+	}
+	if User.Banned {
+		apiErr := db.ErrUserBanned
 		return &apiErr
 	}
 
-	signedToken, err := encryption.CreateToken(User.Id, apiCfg.JwtSecret)
+	signedToken, err := encryption.CreateToken(apiCfg.TokenConfig, User.Id, User.Role, 0)
 	if err != nil {
 		return err
 	}
 
 	respondWithJSON(w, http.StatusOK, TokenResp{
-		Token: signedToken,
+		Token:    signedToken,
+		RefToken: newRefreshToken,
 	})
 	return nil
 }
@@ -189,11 +476,51 @@ func (apiCfg *ApiConfig) PostRevokeToken(w http.ResponseWriter, request *http.Re
 	authHeader := request.Header.Get("Authorization")
 	refreshToken := strings.Replace(authHeader, "Bearer ", "", 1)
 
-	err := apiCfg.DB.RevokeRefToken(refreshToken)
+	err := apiCfg.DB.RevokeSession(refreshToken)
 	if err != nil {
-		apiErr := api_errors.UnauthErr
-		apiErr.LogMess = err.Error()
-		return &apiErr
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type LogoutReq struct {
+	RefToken string `json:"refresh_token"`
+}
+
+func (logoutReq *LogoutReq) validate(r *http.Request) error {
+	if r.ContentLength == 0 {
+		return nil
+	}
+	err := json.NewDecoder(r.Body).Decode(logoutReq)
+	if err != nil {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid JSON",
+		}
+	}
+	return nil
+}
+
+// PostLogout revokes the access token the request was made with and, if one
+// is given, the session of the refresh token in the body.
+func (apiCfg *ApiConfig) PostLogout(w http.ResponseWriter, request *http.Request) error {
+	logoutReq := &LogoutReq{}
+	if reqErr := logoutReq.validate(request); reqErr != nil {
+		return reqErr
+	}
+
+	claims := currentClaims(request)
+	err := apiCfg.DB.RevokeAccessToken(claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		return err
+	}
+	if logoutReq.RefToken != "" {
+		err = apiCfg.DB.RevokeUserSession(currentUser(request).Id, logoutReq.RefToken)
+		if err != nil {
+			return err
+		}
 	}
 
 	w.WriteHeader(http.StatusNoContent)
@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/internal/db"
+	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+	"github.com/ajaen4/go-standard-lib-api/pkg/password_policy"
+)
+
+func TestPostUserValidation(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	policy := password_policy.DefaultPolicy()
+	policy.Require = []string{password_policy.ClassDigit}
+	apiCfg := &ApiConfig{DB: store, TokenConfig: encryption.NewTokenConfig("secret"), PasswordPolicy: policy}
+
+	tests := []struct {
+		name         string
+		payload      string
+		expectedCode int
+		expectedErrs map[string]string
+	}{
+		{"empty password", `{"email": "a@email.com", "password": ""}`, http.StatusBadRequest, map[string]string{
+			"password": "invalid password",
+		}},
+		{"weak password", `{"email": "b@email.com", "password": "short"}`, http.StatusBadRequest, map[string]string{
+			"password": "password must be at least 8 characters long; password must contain a digit",
+		}},
+		{"strong password", `{"email": "c@email.com", "password": "testPassw0rd"}`, http.StatusCreated, nil},
+		{"invalid email", `{"email": "Bob <d@email.com>", "password": "testPassw0rd"}`, http.StatusBadRequest, map[string]string{
+			"email": "invalid email",
+		}},
+		{"same email in another case", `{"email": " C@EMAIL.COM ", "password": "testPassw0rd"}`, http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/users", strings.NewReader(tt.payload))
+			w := httptest.NewRecorder()
+			NewHandler(apiCfg.PostUser).ServeHTTP(w, req)
+
+			if w.Code != tt.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", w.Code, tt.expectedCode)
+			}
+			if tt.expectedErrs == nil {
+				return
+			}
+			resp := api_errors.ClientErr{}
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resp.Errors, tt.expectedErrs) {
+				t.Errorf("handler returned wrong errors: got %v want %v", resp.Errors, tt.expectedErrs)
+			}
+		})
+	}
+}
+
+func TestPostLoginEmail(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	apiCfg := &ApiConfig{
+		DB:                 store,
+		TokenConfig:        encryption.NewTokenConfig("secret"),
+		RefreshTokenTTL:    DefaultRefreshTokenTTL,
+		StripEmailPlusTags: true,
+	}
+	// Accounts made before the email rules and plus tag stripping.
+	store.CreateUser("legacy@localhost", "testPassword")
+	store.CreateUser("bob+old@email.com", "testPassword")
+	store.CreateUser("alice@email.com", "testPassword")
+
+	tests := []struct {
+		name         string
+		email        string
+		expectedCode int
+	}{
+		{"email Normalize refuses", "legacy@localhost", http.StatusOK},
+		{"email in another case with spaces", " Legacy@LOCALHOST ", http.StatusOK},
+		{"account with a plus tag", "bob+old@email.com", http.StatusOK},
+		{"plus tag stripped", "alice+chirpy@email.com", http.StatusOK},
+		{"unknown email with a plus tag", "carol+chirpy@email.com", http.StatusUnauthorized},
+		{"empty email", " ", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"email": "` + tt.email + `", "password": "testPassword"}`
+			req := httptest.NewRequest("POST", "/api/login", strings.NewReader(body))
+			w := httptest.NewRecorder()
+			NewHandler(apiCfg.PostLogin).ServeHTTP(w, req)
+
+			if w.Code != tt.expectedCode {
+				t.Errorf("handler returned wrong status code: got %v want %v", w.Code, tt.expectedCode)
+			}
+		})
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	outbox := &recordingMailer{}
+	apiCfg := &ApiConfig{
+		DB:                   store,
+		TokenConfig:          encryption.NewTokenConfig("secret"),
+		PasswordPolicy:       password_policy.DefaultPolicy(),
+		Mailer:               outbox,
+		AppURL:               "https://chirpy.example.com",
+		VerificationTokenTTL: DefaultVerificationTokenTTL,
+	}
+	user, _ := store.CreateUser("test@email.com", "testPassword")
+	store.CreateUser("other@email.com", "testPassword")
+	store.CreateVerificationToken(user.Id, "verify-token", time.Hour)
+	store.VerifyEmail("verify-token")
+	store.CreateSession(user.Id, "refresh-token", "test", "127.0.0.1", time.Hour)
+	accessToken, _ := encryption.CreateToken(apiCfg.TokenConfig, user.Id, user.Role, 0)
+
+	send := func(method string, payload string, expectedCode int) UserResp {
+		t.Helper()
+		req := httptest.NewRequest(method, "/api/users", strings.NewReader(payload))
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+		w := httptest.NewRecorder()
+		handler := apiCfg.PatchUser
+		if method == "PUT" {
+			handler = apiCfg.PutUser
+		}
+		NewHandler(apiCfg.RequireAuth(handler)).ServeHTTP(w, req)
+
+		if w.Code != expectedCode {
+			t.Fatalf("%s %s returned wrong status code: got %v want %v", method, payload, w.Code, expectedCode)
+		}
+		resp := UserResp{}
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp
+	}
+
+	// Changing the email or password takes the current password.
+	send("PATCH", `{"email": "new@email.com"}`, http.StatusBadRequest)
+	send("PATCH", `{"email": "new@email.com", "current_password": "wrongPassword"}`, http.StatusForbidden)
+	send("PATCH", `{"password": "short", "current_password": "testPassword"}`, http.StatusBadRequest)
+	send("PATCH", `{"email": "other@email.com", "current_password": "testPassword"}`, http.StatusBadRequest)
+
+	resp := send("PATCH", `{"email": " test@email.com "}`, http.StatusOK)
+	if resp.Email != "test@email.com" || !resp.IsVerified {
+		t.Errorf("unchanged email: got %+v", resp)
+	}
+
+	resp = send("PATCH", `{"email": "new@email.com", "current_password": "testPassword"}`, http.StatusOK)
+	if resp.Email != "new@email.com" || resp.IsVerified {
+		t.Errorf("new email: got %+v", resp)
+	}
+	sent := outbox.waitForMail(t, 1)
+	if len(sent) != 1 || sent[0].To != "new@email.com" {
+		t.Errorf("re-verification email not sent to the new address: %+v", sent)
+	}
+
+	resp = send("PATCH", `{"password": "newPassword", "current_password": "testPassword"}`, http.StatusOK)
+	if resp.Email != "new@email.com" {
+		t.Errorf("new password: got %+v", resp)
+	}
+	err = store.CheckPassword(user.Id, "newPassword")
+	if err != nil {
+		t.Errorf("password not changed: %s", err)
+	}
+	sessions, _ := store.GetSessions(user.Id)
+	if len(sessions) != 0 {
+		t.Errorf("sessions kept after a password change: %+v", sessions)
+	}
+
+	// The deprecated PUT keeps taking both fields without the current password.
+	// The new password revoked the old access token.
+	accessToken, _ = encryption.CreateToken(apiCfg.TokenConfig, user.Id, user.Role, 0)
+	resp = send("PUT", `{"email": "put@email.com", "password": "putPassword"}`, http.StatusOK)
+	if resp.Email != "put@email.com" {
+		t.Errorf("PUT: got %+v", resp)
+	}
+	err = store.CheckPassword(user.Id, "putPassword")
+	if err != nil {
+		t.Errorf("password not replaced by PUT: %s", err)
+	}
+}
+
+func TestGetUsers(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	apiCfg := &ApiConfig{DB: store, TokenConfig: encryption.NewTokenConfig("secret")}
+	user, _ := store.CreateUser("test@email.com", "testPassword")
+	accessToken, _ := encryption.CreateToken(apiCfg.TokenConfig, user.Id, user.Role, 0)
+
+	req := httptest.NewRequest("GET", "/api/users/me", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	w := httptest.NewRecorder()
+	NewHandler(apiCfg.RequireAuth(apiCfg.GetCurrentUser)).ServeHTTP(w, req)
+	me := UserResp{}
+	json.NewDecoder(w.Body).Decode(&me)
+	if w.Code != http.StatusOK || me.Id != user.Id || me.Email != user.Email {
+		t.Errorf("GET /api/users/me returned %v %+v", w.Code, me)
+	}
+
+	tests := []struct {
+		name         string
+		userID       string
+		expectedCode int
+	}{
+		{"existing user", strconv.Itoa(user.Id), http.StatusOK},
+		{"unknown user", strconv.Itoa(user.Id + 1), http.StatusNotFound},
+		{"invalid id", "abc", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/users/"+tt.userID, nil)
+			req.SetPathValue("userID", tt.userID)
+			w := httptest.NewRecorder()
+			NewHandler(apiCfg.GetUserProfile).ServeHTTP(w, req)
+
+			if w.Code != tt.expectedCode {
+				t.Fatalf("handler returned wrong status code: got %v want %v", w.Code, tt.expectedCode)
+			}
+			if w.Code == http.StatusOK && strings.Contains(w.Body.String(), user.Email) {
+				t.Errorf("public profile shows the email: %s", w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/ajaen4/go-standard-lib-api/internal/db"
+	"github.com/ajaen4/go-standard-lib-api/pkg/api_errors"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+	"github.com/ajaen4/go-standard-lib-api/pkg/mailer"
+)
+
+var ErrEmailNotVerified = api_errors.ClientErr{
+	HttpCode: http.StatusForbidden,
+	Message:  "email address not verified",
+}
+
+// ErrMailDisabled answers requests that only send mail when there's no Mailer.
+var ErrMailDisabled = api_errors.ClientErr{
+	HttpCode: http.StatusServiceUnavailable,
+	Message:  "email is not available",
+}
+
+type VerifyEmailReq struct {
+	Token string `json:"token"`
+}
+
+func (verifyReq *VerifyEmailReq) validate(r *http.Request) error {
+	err := json.NewDecoder(r.Body).Decode(verifyReq)
+	if err != nil {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid JSON",
+		}
+	}
+	if verifyReq.Token == "" {
+		return &api_errors.ClientErr{
+			HttpCode: http.StatusBadRequest,
+			Message:  "Invalid body parameters",
+			Errors:   map[string]string{"token": "invalid token"},
+		}
+	}
+	return nil
+}
+
+// RequireVerified rejects users who haven't verified their email yet, when
+// RequireVerifiedEmail is set. It must be wrapped in RequireAuth.
+func (apiCfg *ApiConfig) RequireVerified(next CustomHandler) CustomHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if apiCfg.RequireVerifiedEmail && !currentUser(r).Verified {
+			apiErr := ErrEmailNotVerified
+			return &apiErr
+		}
+		return next(w, r)
+	}
+}
+
+// sendVerificationEmail mails user a token that proves they own their email.
+// Without a Mailer nothing is sent.
+func (apiCfg *ApiConfig) sendVerificationEmail(user db.User) error {
+	if apiCfg.Mailer == nil {
+		return nil
+	}
+	token, err := encryption.CreateOneTimeToken()
+	if err != nil {
+		return err
+	}
+	err = apiCfg.DB.CreateVerificationToken(user.Id, token, apiCfg.VerificationTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Your Chirpy verification token is:\n\n%s\n", token)
+	if apiCfg.AppURL != "" {
+		body = fmt.Sprintf(
+			"Confirm this is your email address by opening:\n\n%s/verify-email?token=%s\n",
+			apiCfg.AppURL, url.QueryEscape(token),
+		)
+	}
+	body += "\nIf you didn't sign up for Chirpy, you can ignore this email.\n"
+	return apiCfg.Mailer.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your Chirpy email address",
+		Body:    body,
+	})
+}
+
+func (apiCfg *ApiConfig) PostVerifyEmail(w http.ResponseWriter, request *http.Request) error {
+	verifyReq := &VerifyEmailReq{}
+	if reqErr := verifyReq.validate(request); reqErr != nil {
+		return reqErr
+	}
+
+	user, err := apiCfg.DB.VerifyEmail(verifyReq.Token)
+	if err != nil {
+		return err
+	}
+
+	respondWithJSON(w, http.StatusOK, newUserResp(user))
+	return nil
+}
+
+// PostResendVerification mails the current user a new verification token,
+// replacing the one sent before.
+func (apiCfg *ApiConfig) PostResendVerification(w http.ResponseWriter, request *http.Request) error {
+	user := currentUser(request)
+	if user.Verified {
+		apiErr := db.ErrEmailAlrVerified
+		return &apiErr
+	}
+	if apiCfg.Mailer == nil {
+		apiErr := ErrMailDisabled
+		return &apiErr
+	}
+
+	err := apiCfg.sendVerificationEmail(user)
+	if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ajaen4/go-standard-lib-api/internal/db"
+	"github.com/ajaen4/go-standard-lib-api/pkg/encryption"
+	"github.com/ajaen4/go-standard-lib-api/pkg/mailer"
+	"github.com/ajaen4/go-standard-lib-api/pkg/password_policy"
+)
+
+// recordingMailer keeps every message instead of sending it. Handlers may
+// send from another goroutine, so use waitForMail before looking at sent.
+type recordingMailer struct {
+	mux  sync.Mutex
+	sent []mailer.Message
+}
+
+func (m *recordingMailer) Send(msg mailer.Message) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func (m *recordingMailer) waitForMail(t *testing.T, count int) []mailer.Message {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		m.mux.Lock()
+		sent := slices.Clone(m.sent)
+		m.mux.Unlock()
+		if len(sent) >= count {
+			return sent
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d emails, got %d", count, len(sent))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// lastToken returns the token from the link in the last message sent.
+func (m *recordingMailer) lastToken(t *testing.T, count int) string {
+	t.Helper()
+	sent := m.waitForMail(t, count)
+	_, token, found := strings.Cut(sent[len(sent)-1].Body, "token=")
+	if !found {
+		t.Fatalf("no token in email: %s", sent[len(sent)-1].Body)
+	}
+	return strings.Fields(token)[0]
+}
+
+func TestEmailVerification(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	outbox := &recordingMailer{}
+	apiCfg := &ApiConfig{
+		DB:                   store,
+		TokenConfig:          encryption.NewTokenConfig("secret"),
+		Mailer:               outbox,
+		AppURL:               "https://chirpy.example.com",
+		VerificationTokenTTL: DefaultVerificationTokenTTL,
+		RequireVerifiedEmail: true,
+	}
+
+	serve := func(handler CustomHandler, body string, token string) int {
+		req := httptest.NewRequest("POST", "/api/test", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		NewHandler(handler).ServeHTTP(w, req)
+		return w.Code
+	}
+	posted := false
+	postChirp := apiCfg.RequireAuth(apiCfg.RequireVerified(func(w http.ResponseWriter, r *http.Request) error {
+		posted = true
+		return nil
+	}))
+
+	code := serve(apiCfg.PostUser, `{"email": "test@email.com", "password": "testPassword"}`, "")
+	if code != http.StatusCreated {
+		t.Fatalf("PostUser returned %v", code)
+	}
+	if len(outbox.sent) != 1 || outbox.sent[0].To != "test@email.com" {
+		t.Fatalf("verification email not sent: %+v", outbox.sent)
+	}
+	if !strings.Contains(outbox.sent[0].Body, "https://chirpy.example.com/verify-email?token=") {
+		t.Errorf("email has no verification link: %s", outbox.sent[0].Body)
+	}
+	firstToken := outbox.lastToken(t, 1)
+
+	user, err := store.Login("test@email.com", "testPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessToken, _ := encryption.CreateToken(apiCfg.TokenConfig, user.Id, user.Role, 0)
+	if code := serve(postChirp, "", accessToken); code != http.StatusForbidden || posted {
+		t.Errorf("unverified user posting: got %v want %v", code, http.StatusForbidden)
+	}
+
+	if code := serve(apiCfg.RequireAuth(apiCfg.PostResendVerification), "", accessToken); code != http.StatusNoContent {
+		t.Fatalf("resend returned %v", code)
+	}
+	secondToken := outbox.lastToken(t, 2)
+	if code := serve(apiCfg.PostVerifyEmail, `{"token": "`+firstToken+`"}`, ""); code != http.StatusBadRequest {
+		t.Errorf("replaced token: got %v want %v", code, http.StatusBadRequest)
+	}
+	if code := serve(apiCfg.PostVerifyEmail, `{"token": "`+secondToken+`"}`, ""); code != http.StatusOK {
+		t.Fatalf("verify returned %v", code)
+	}
+
+	if code := serve(postChirp, "", accessToken); code != http.StatusOK || !posted {
+		t.Errorf("verified user posting: got %v want %v", code, http.StatusOK)
+	}
+	if code := serve(apiCfg.RequireAuth(apiCfg.PostResendVerification), "", accessToken); code != http.StatusBadRequest {
+		t.Errorf("resend after verifying: got %v want %v", code, http.StatusBadRequest)
+	}
+}
+
+func TestMailDisabled(t *testing.T) {
+	store, err := db.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	apiCfg := &ApiConfig{
+		DB:             store,
+		TokenConfig:    encryption.NewTokenConfig("secret"),
+		PasswordPolicy: password_policy.DefaultPolicy(),
+	}
+
+	serve := func(handler CustomHandler, body string, token string) int {
+		req := httptest.NewRequest("POST", "/api/test", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		NewHandler(handler).ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Signing up still works, there's just no email to verify with.
+	if code := serve(apiCfg.PostUser, `{"email": "test@email.com", "password": "testPassword"}`, ""); code != http.StatusCreated {
+		t.Fatalf("PostUser returned %v", code)
+	}
+	user, _ := store.Login("test@email.com", "testPassword")
+	accessToken, _ := encryption.CreateToken(apiCfg.TokenConfig, user.Id, user.Role, 0)
+	if code := serve(apiCfg.RequireAuth(apiCfg.PostResendVerification), "", accessToken); code != http.StatusServiceUnavailable {
+		t.Errorf("resend without a mailer: got %v want %v", code, http.StatusServiceUnavailable)
+	}
+	if code := serve(apiCfg.PostForgotPassword, `{"email": "test@email.com"}`, ""); code != http.StatusServiceUnavailable {
+		t.Errorf("forgot password without a mailer: got %v want %v", code, http.StatusServiceUnavailable)
+	}
+}
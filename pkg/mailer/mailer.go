@@ -0,0 +1,132 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages to users. Send returns once the message has been
+// handed over, not once it's been delivered.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// SMTPMailer sends messages through an SMTP relay, using STARTTLS when the
+// server supports it.
+type SMTPMailer struct {
+	Addr string // host:port
+	From string
+	Auth smtp.Auth
+}
+
+// NewSMTPMailer authenticates with PLAIN auth when username isn't empty.
+func NewSMTPMailer(addr string, from string, username string, password string) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := envelopeSender(from); err != nil {
+		return nil, err
+	}
+	mailer := &SMTPMailer{Addr: addr, From: from}
+	if username != "" {
+		mailer.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer, nil
+}
+
+func (mailer *SMTPMailer) Send(msg Message) error {
+	sender, err := envelopeSender(mailer.From)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(mailer.Addr, mailer.Auth, sender, []string{msg.To}, format(mailer.From, msg, time.Now()))
+}
+
+// envelopeSender is the bare address of from, which may have a display name
+// like "Chirpy <no-reply@example.com>" that MAIL FROM doesn't accept.
+func envelopeSender(from string) (string, error) {
+	address, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", fmt.Errorf("invalid sender %q: %w", from, err)
+	}
+	return address.Address, nil
+}
+
+// FileMailer appends every message to a file instead of sending it, for local
+// development and tests.
+type FileMailer struct {
+	From string
+	path string
+	mux  sync.Mutex
+}
+
+func NewFileMailer(path string, from string) *FileMailer {
+	return &FileMailer{From: from, path: path}
+}
+
+func (mailer *FileMailer) Send(msg Message) error {
+	mailer.mux.Lock()
+	defer mailer.mux.Unlock()
+
+	file, err := os.OpenFile(mailer.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(format(mailer.From, msg, time.Now()), "\r\n"...))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// LogMailer writes every message to the standard logger instead of sending
+// it, so tokens can be picked up from the server output. Only use it locally:
+// anyone who can read the logs can use the tokens.
+type LogMailer struct {
+	From string
+}
+
+func (mailer LogMailer) Send(msg Message) error {
+	log.Printf("mail to %s:\n%s", msg.To, format(mailer.From, msg, time.Now()))
+	return nil
+}
+
+var _ Mailer = (*SMTPMailer)(nil)
+var _ Mailer = (*FileMailer)(nil)
+var _ Mailer = LogMailer{}
+
+// format renders msg as a plain text RFC 5322 message. Line breaks are
+// removed from the headers so a crafted subject can't add headers of its own.
+func format(from string, msg Message, date time.Time) []byte {
+	var builder strings.Builder
+	oneLine := strings.NewReplacer("\r", "", "\n", " ").Replace
+	writeHeader := func(name string, value string) {
+		fmt.Fprintf(&builder, "%s: %s\r\n", name, oneLine(value))
+	}
+	writeHeader("From", from)
+	writeHeader("To", msg.To)
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", oneLine(msg.Subject)))
+	writeHeader("Date", date.Format(time.RFC1123Z))
+	writeHeader("MIME-Version", "1.0")
+	writeHeader("Content-Type", "text/plain; charset=UTF-8")
+	builder.WriteString("\r\n")
+	builder.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	builder.WriteString("\r\n")
+	return []byte(builder.String())
+}
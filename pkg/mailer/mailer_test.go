@@ -0,0 +1,80 @@
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	date := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	msg := Message{
+		To:      "bob@example.com",
+		Subject: "Verify\r\nBcc: eve@example.com",
+		Body:    "line one\nline two",
+	}
+
+	expected := "From: chirpy@example.com\r\n" +
+		"To: bob@example.com\r\n" +
+		"Subject: Verify Bcc: eve@example.com\r\n" +
+		"Date: Wed, 01 May 2024 12:00:00 +0000\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		"line one\r\nline two\r\n"
+	if formatted := string(format("chirpy@example.com", msg, date)); formatted != expected {
+		t.Errorf("format() = %q; want %q", formatted, expected)
+	}
+
+	encoded := string(format("chirpy@example.com", Message{Subject: "Vérifiez"}, date))
+	if !strings.Contains(encoded, "Subject: =?utf-8?q?V=C3=A9rifiez?=\r\n") {
+		t.Errorf("non-ASCII subject not encoded: %q", encoded)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.txt")
+	mailer := NewFileMailer(path, "chirpy@example.com")
+
+	for _, to := range []string{"bob@example.com", "alice@example.com"} {
+		err := mailer.Send(Message{To: to, Subject: "Hello", Body: "token: 1234"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"To: bob@example.com\r\n", "To: alice@example.com\r\n", "token: 1234\r\n"} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("mail file missing %q: %s", expected, content)
+		}
+	}
+}
+
+func TestEnvelopeSender(t *testing.T) {
+	tests := []struct {
+		from     string
+		expected string
+		wantErr  bool
+	}{
+		{"chirpy@example.com", "chirpy@example.com", false},
+		{"Chirpy <no-reply@example.com>", "no-reply@example.com", false},
+		{"not an address", "", true},
+	}
+	for _, tt := range tests {
+		sender, err := envelopeSender(tt.from)
+		if sender != tt.expected || (err != nil) != tt.wantErr {
+			t.Errorf("envelopeSender(%q) = %q, %v; want %q, wantErr %v", tt.from, sender, err, tt.expected, tt.wantErr)
+		}
+	}
+
+	_, err := NewSMTPMailer("localhost:25", "not an address", "", "")
+	if err == nil {
+		t.Error("expected NewSMTPMailer to reject an invalid sender")
+	}
+}
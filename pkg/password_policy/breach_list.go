@@ -0,0 +1,126 @@
+package password_policy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const rangePrefixLen = 5
+
+// BreachList looks passwords up in a local copy of the Pwned Passwords list:
+// a file of "SHA1:COUNT" lines with uppercase hex digests, sorted by digest.
+// Lookups work like the k-anonymity range API, fetching every suffix sharing
+// the first five characters of the digest and comparing them here, so the
+// file can be swapped for the remote API without changing the callers.
+type BreachList struct {
+	path string
+}
+
+func OpenBreachList(path string) (*BreachList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	return &BreachList{path: path}, nil
+}
+
+func (list *BreachList) Contains(password string) (bool, error) {
+	digest := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(digest[:]))
+
+	suffixes, err := list.Range(hash[:rangePrefixLen])
+	if err != nil {
+		return false, err
+	}
+	for _, suffix := range suffixes {
+		if suffix == hash[rangePrefixLen:] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Range returns the digest suffixes of every breached password whose digest
+// starts with prefix.
+func (list *BreachList) Range(prefix string) ([]string, error) {
+	prefix = strings.ToUpper(prefix)
+	file, err := os.Open(list.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Binary search for the first line whose digest isn't below prefix. Any
+	// offset is mapped to the line starting at or after it.
+	low, high := int64(0), info.Size()
+	for low < high {
+		mid := low + (high-low)/2
+		_, line, err := lineFrom(file, mid, info.Size())
+		if err != nil {
+			return nil, err
+		}
+		if line == "" || digestOf(line) >= prefix {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+
+	start, _, err := lineFrom(file, low, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	suffixes := []string{}
+	scanner := bufio.NewScanner(io.NewSectionReader(file, start, info.Size()-start))
+	for scanner.Scan() {
+		digest := digestOf(scanner.Text())
+		if !strings.HasPrefix(digest, prefix) {
+			break
+		}
+		suffixes = append(suffixes, digest[len(prefix):])
+	}
+	return suffixes, scanner.Err()
+}
+
+// lineFrom returns the offset and contents of the first line starting at or
+// after offset, or an empty line past the end of the file.
+func lineFrom(file *os.File, offset int64, size int64) (int64, string, error) {
+	start := offset
+	if offset > 0 {
+		// offset starts a line only if the byte before it ends one.
+		start = offset - 1
+	}
+	reader := bufio.NewReader(io.NewSectionReader(file, start, size-start))
+	if offset > 0 {
+		skipped, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return size, "", nil
+		}
+		if err != nil {
+			return 0, "", err
+		}
+		start += int64(len(skipped))
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return 0, "", err
+	}
+	return start, strings.TrimRight(line, "\r\n"), nil
+}
+
+func digestOf(line string) string {
+	digest, _, _ := strings.Cut(line, ":")
+	return strings.ToUpper(strings.TrimSpace(digest))
+}
@@ -0,0 +1,109 @@
+package password_policy
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxBcryptBytes is the longest password bcrypt can hash; it ignores every
+// byte past it.
+const MaxBcryptBytes = 72
+
+const (
+	ClassLower  = "lower"
+	ClassUpper  = "upper"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+)
+
+var classDescriptions = map[string]string{
+	ClassLower:  "a lowercase letter",
+	ClassUpper:  "an uppercase letter",
+	ClassDigit:  "a digit",
+	ClassSymbol: "a symbol",
+}
+
+// Policy is what a new password has to satisfy. The zero value only rejects
+// empty passwords.
+type Policy struct {
+	MinLength int      // in characters
+	MaxBytes  int      // 0 means no limit
+	Require   []string // character classes the password must contain
+	Breached  *BreachList
+}
+
+// DefaultPolicy follows NIST SP 800-63B: a minimum length and no composition
+// rules, capped at what bcrypt can hash.
+func DefaultPolicy() Policy {
+	return Policy{
+		MinLength: 8,
+		MaxBytes:  MaxBcryptBytes,
+	}
+}
+
+// ParseClasses parses a comma separated list of character classes, e.g.
+// "lower,upper,digit".
+func ParseClasses(list string) ([]string, error) {
+	classes := []string{}
+	for _, class := range strings.Split(list, ",") {
+		class = strings.TrimSpace(class)
+		if class == "" {
+			continue
+		}
+		if _, ok := classDescriptions[class]; !ok {
+			return nil, fmt.Errorf("unknown character class %q", class)
+		}
+		classes = append(classes, class)
+	}
+	return classes, nil
+}
+
+// Check returns every rule password breaks, as messages that can be shown to
+// the user. The error is only set when the breached password list can't be
+// read.
+func (policy Policy) Check(password string) ([]string, error) {
+	problems := []string{}
+	length := utf8.RuneCountInString(password)
+	if length == 0 {
+		return append(problems, "password can't be empty"), nil
+	}
+	if length < policy.MinLength {
+		problems = append(problems, fmt.Sprintf("password must be at least %d characters long", policy.MinLength))
+	}
+	if policy.MaxBytes > 0 && len(password) > policy.MaxBytes {
+		problems = append(problems, fmt.Sprintf("password must be at most %d bytes long", policy.MaxBytes))
+	}
+	for _, class := range policy.Require {
+		if !strings.ContainsFunc(password, classMatcher(class)) {
+			problems = append(problems, "password must contain "+classDescriptions[class])
+		}
+	}
+
+	if policy.Breached != nil {
+		breached, err := policy.Breached.Contains(password)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			problems = append(problems, "password has appeared in a data breach")
+		}
+	}
+	return problems, nil
+}
+
+func classMatcher(class string) func(rune) bool {
+	switch class {
+	case ClassLower:
+		return unicode.IsLower
+	case ClassUpper:
+		return unicode.IsUpper
+	case ClassDigit:
+		return unicode.IsDigit
+	default:
+		return func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+		}
+	}
+}
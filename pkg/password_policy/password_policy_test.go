@@ -0,0 +1,131 @@
+package password_policy
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	strict := DefaultPolicy()
+	strict.Require = []string{ClassLower, ClassUpper, ClassDigit, ClassSymbol}
+
+	tests := []struct {
+		name     string
+		policy   Policy
+		password string
+		expected []string
+	}{
+		{"zero policy accepts anything", Policy{}, "a", []string{}},
+		{"empty", DefaultPolicy(), "", []string{"password can't be empty"}},
+		{"too short", DefaultPolicy(), "short", []string{"password must be at least 8 characters long"}},
+		{"length counts characters", DefaultPolicy(), "pässwörd", []string{}},
+		{"too long for bcrypt", DefaultPolicy(), strings.Repeat("a", 73), []string{"password must be at most 72 bytes long"}},
+		{"multibyte over the limit", DefaultPolicy(), strings.Repeat("ä", 37), []string{"password must be at most 72 bytes long"}},
+		{"missing classes", strict, "longpassword", []string{
+			"password must contain an uppercase letter",
+			"password must contain a digit",
+			"password must contain a symbol",
+		}},
+		{"all classes", strict, "Long-passw0rd", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems, err := tt.policy.Check(tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(problems, tt.expected) {
+				t.Errorf("Check(%q) = %q; want %q", tt.password, problems, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseClasses(t *testing.T) {
+	classes, err := ParseClasses("lower, digit,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(classes, []string{ClassLower, ClassDigit}) {
+		t.Errorf("ParseClasses() = %v", classes)
+	}
+	_, err = ParseClasses("lower,emoji")
+	if err == nil {
+		t.Error("ParseClasses() accepted an unknown class")
+	}
+}
+
+func TestBreachList(t *testing.T) {
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8 and of
+	// "123456" is 7C4A8D09CA3762AF61E59520943DC26494F8941B.
+	lines := []string{
+		"00000A1B2C3D4E5F60718293A4B5C6D7E8F90A1B:3",
+		"5BAA60000000000000000000000000000000000A:1",
+		"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824",
+		"5BAA6FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF:2",
+		"7C4A8D09CA3762AF61E59520943DC26494F8941B:37359195",
+		"FFFFF0000000000000000000000000000000000F:1",
+	}
+	path := filepath.Join(t.TempDir(), "pwned-passwords.txt")
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := OpenBreachList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	suffixes, err := list.Range("5baa6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"0000000000000000000000000000000000A", "1E4C9B93F3F0682250B6CF8331B7EE68FD8", "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF"}
+	if !slices.Equal(suffixes, expected) {
+		t.Errorf("Range(5baa6) = %v; want %v", suffixes, expected)
+	}
+
+	for prefix, count := range map[string]int{"00000": 1, "FFFFF": 1, "12345": 0, "7C4A8": 1} {
+		suffixes, err := list.Range(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(suffixes) != count {
+			t.Errorf("Range(%s) = %v; want %d suffixes", prefix, suffixes, count)
+		}
+	}
+
+	tests := []struct {
+		password string
+		breached bool
+	}{
+		{"password", true},
+		{"123456", true},
+		{"correct horse battery staple", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			breached, err := list.Contains(tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if breached != tt.breached {
+				t.Errorf("Contains(%q) = %v; want %v", tt.password, breached, tt.breached)
+			}
+		})
+	}
+
+	policy := DefaultPolicy()
+	policy.Breached = list
+	problems, err := policy.Check("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(problems, []string{"password has appeared in a data breach"}) {
+		t.Errorf("Check(password) = %q", problems)
+	}
+}